@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AffinityConfig enables cookie-based session affinity
+type AffinityConfig struct {
+	Cookie string        // Cookie name, affinity is off when empty
+	TTL    time.Duration // How long a client sticks to its backend, defaults to 1 hour
+	Secret string        // Key for signing cookies, random per process when empty
+}
+
+// affinity pins clients to the backend that served their first request with a
+// signed cookie. The cookie holds an ID derived from the backend's URL, its
+// expiry and an HMAC over both, so clients can neither pick a backend nor
+// extend the TTL themselves.
+type affinity struct {
+	cookie   string
+	ttl      time.Duration
+	key      []byte
+	backends map[string]*Backend // By backendID
+	now      func() time.Time
+}
+
+func newAffinity(config AffinityConfig, backends []*Backend) (*affinity, error) {
+	a := &affinity{
+		cookie:   config.Cookie,
+		ttl:      config.TTL,
+		key:      []byte(config.Secret),
+		backends: make(map[string]*Backend, len(backends)),
+		now:      time.Now,
+	}
+
+	// Set defaults
+	if a.ttl == 0 {
+		a.ttl = time.Hour
+	}
+	if len(a.key) == 0 {
+		a.key = make([]byte, 32)
+		if _, err := rand.Read(a.key); err != nil {
+			return nil, fmt.Errorf("failed to generate affinity secret: %v", err)
+		}
+		log.Printf("No affinity secret set, cookies won't be valid after a restart or on other proxies")
+	}
+
+	for _, backend := range backends {
+		a.backends[backendID(backend)] = backend
+	}
+	return a, nil
+}
+
+// backendID names a backend in cookies. It's derived from the URL rather than
+// the backend's position, so cookies stay valid when other backends are added
+// or removed, and doesn't reveal the backend's address.
+func backendID(backend *Backend) string {
+	return strconv.FormatUint(hashString(backend.URL.String()), 36)
+}
+
+// backend returns the backend named by r's affinity cookie, or nil if there is
+// no valid cookie or its backend is no longer configured
+func (a *affinity) backend(r *http.Request) *Backend {
+	cookie, err := r.Cookie(a.cookie)
+	if err != nil {
+		return nil
+	}
+
+	id, expires, ok := a.verify(cookie.Value)
+	if !ok || a.now().Unix() >= expires {
+		return nil
+	}
+	return a.backends[id]
+}
+
+// issue sets the cookie pinning the client to backend
+func (a *affinity) issue(w http.ResponseWriter, backend *Backend) {
+	id := backendID(backend)
+	expires := a.now().Add(a.ttl).Unix()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     a.cookie,
+		Value:    id + "." + strconv.FormatInt(expires, 10) + "." + a.sign(id, expires),
+		Path:     "/",
+		MaxAge:   int(a.ttl.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// verify splits a cookie value into the backend ID and expiry if its
+// signature is valid
+func (a *affinity) verify(value string) (string, int64, bool) {
+	parts := strings.Split(value, ".")
+	if len(parts) != 3 {
+		return "", 0, false
+	}
+
+	id := parts[0]
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	if !hmac.Equal([]byte(parts[2]), []byte(a.sign(id, expires))) {
+		return "", 0, false
+	}
+	return id, expires, true
+}
+
+// sign returns the HMAC-SHA256 of the backend ID and expiry
+func (a *affinity) sign(id string, expires int64) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(id + "." + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
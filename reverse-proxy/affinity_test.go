@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newAffinityBalancer creates a round-robin load balancer with cookie
+// affinity over backendURLs
+func newAffinityBalancer(t *testing.T, secret string, backendURLs ...string) *LoadBalancer {
+	t.Helper()
+	quietLogs(t)
+
+	lb, err := NewLoadBalancer(LoadBalancerConfig{
+		Backends: backendURLs,
+		Affinity: AffinityConfig{Cookie: "backend", TTL: time.Minute, Secret: secret},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	return lb
+}
+
+// startNamedBackends starts backends that reply with their name
+func startNamedBackends(t *testing.T, names ...string) []string {
+	t.Helper()
+
+	backendURLs := make([]string, len(names))
+	for i, name := range names {
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}))
+		t.Cleanup(backend.Close)
+		backendURLs[i] = backend.URL
+	}
+	return backendURLs
+}
+
+// send proxies a request carrying cookie, if any, and returns the backend
+// that answered and the affinity cookie set on the response, if any
+func send(lb *LoadBalancer, cookie *http.Cookie) (string, *http.Cookie) {
+	req := httptest.NewRequest("GET", "/", nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+
+	rec := httptest.NewRecorder()
+	lb.ServeHTTP(rec, req)
+
+	for _, set := range rec.Result().Cookies() {
+		if set.Name == "backend" {
+			return rec.Body.String(), set
+		}
+	}
+	return rec.Body.String(), nil
+}
+
+func TestAffinity_PinsClientToFirstBackend(t *testing.T) {
+	lb := newAffinityBalancer(t, "secret", startNamedBackends(t, "a", "b", "c")...)
+
+	// Round-robin moves on for each new client
+	first, cookie := send(lb, nil)
+	if cookie == nil {
+		t.Fatal("Expected an affinity cookie on the first response")
+	}
+	if !cookie.HttpOnly || cookie.MaxAge != 60 {
+		t.Errorf("Expected an HttpOnly cookie with a 60s max age, got %+v", cookie)
+	}
+	if strings.Contains(cookie.Value, "127.0.0.1") {
+		t.Errorf("Expected the cookie not to reveal the backend address, got %q", cookie.Value)
+	}
+
+	// The client keeps going back to its backend, and isn't sent a new cookie
+	for range 10 {
+		got, reissued := send(lb, cookie)
+		if got != first {
+			t.Fatalf("Expected the pinned backend %s, got %s", first, got)
+		}
+		if reissued != nil {
+			t.Fatalf("Expected no new cookie while the pinned backend is up, got %+v", reissued)
+		}
+	}
+
+	// Clients without the cookie are still balanced
+	if second, _ := send(lb, nil); second == first {
+		t.Errorf("Expected a new client to get the next backend, got %s again", second)
+	}
+}
+
+func TestAffinity_RejectsForgedCookies(t *testing.T) {
+	backendURLs := startNamedBackends(t, "a", "b")
+	lb := newAffinityBalancer(t, "secret", backendURLs...)
+
+	_, cookie := send(lb, nil)
+	id, expires, ok := lb.affinity.verify(cookie.Value)
+	if !ok {
+		t.Fatalf("Expected the issued cookie to verify, got %q", cookie.Value)
+	}
+	signature := lb.affinity.sign(id, expires)
+	other := backendID(lb.backends[1])
+	later := strconv.FormatInt(expires+3600, 10)
+	guessed := newAffinityBalancer(t, "guess", backendURLs...).affinity
+
+	forged := map[string]string{
+		"empty":               "",
+		"garbage":             "garbage",
+		"unsigned":            other,
+		"another backend":     other + "." + strconv.FormatInt(expires, 10) + "." + signature,
+		"extended expiry":     id + "." + later + "." + signature,
+		"tampered signature":  id + "." + strconv.FormatInt(expires, 10) + "." + signature + "x",
+		"signed with a guess": other + "." + later + "." + guessed.sign(other, expires+3600),
+	}
+	for name, value := range forged {
+		if backend := lb.affinity.backend(requestWithCookie(value)); backend != nil {
+			t.Errorf("%s: expected cookie %q to be rejected, got %s", name, value, backend.URL.Host)
+		}
+	}
+}
+
+// requestWithCookie returns a request carrying an affinity cookie
+func requestWithCookie(value string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "backend", Value: value})
+	return req
+}
+
+func TestAffinity_ExpiredCookieIsRebalanced(t *testing.T) {
+	lb := newAffinityBalancer(t, "secret", startNamedBackends(t, "a", "b")...)
+
+	_, cookie := send(lb, nil)
+
+	// Past the TTL the cookie is ignored even if the client kept sending it
+	lb.affinity.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	if _, reissued := send(lb, cookie); reissued == nil {
+		t.Error("Expected a new cookie once the old one expired")
+	}
+}
+
+func TestAffinity_FailsOverWhenBackendRemoved(t *testing.T) {
+	backendURLs := startNamedBackends(t, "a", "b", "c")
+
+	// Pin one client to each backend
+	before := newAffinityBalancer(t, "secret", backendURLs...)
+	cookies := make(map[string]*http.Cookie)
+	for range backendURLs {
+		name, cookie := send(before, nil)
+		cookies[name] = cookie
+	}
+
+	// Restart without b, keeping the same secret
+	after := newAffinityBalancer(t, "secret", backendURLs[0], backendURLs[2])
+
+	// Clients of the remaining backends keep them
+	for _, name := range []string{"a", "c"} {
+		if got, reissued := send(after, cookies[name]); got != name || reissued != nil {
+			t.Errorf("Expected %s's client to stay on %s without a new cookie, got %s", name, name, got)
+		}
+	}
+
+	// b's client is balanced elsewhere and pinned there
+	got, reissued := send(after, cookies["b"])
+	if got == "b" {
+		t.Fatal("Expected the removed backend not to be used")
+	}
+	if reissued == nil {
+		t.Fatal("Expected a new cookie after failing over")
+	}
+	for range 5 {
+		if again, _ := send(after, reissued); again != got {
+			t.Fatalf("Expected the new cookie to pin %s, got %s", got, again)
+		}
+	}
+}
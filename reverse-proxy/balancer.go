@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+)
+
+// Balancing strategies accepted by NewBalancer
+const (
+	RoundRobin       = "round-robin"
+	LeastOutstanding = "least-outstanding"
+	Random           = "random"
+	PowerOfTwo       = "power-of-two"
+	ConsistentHash   = "hash"
+)
+
+// Strategies lists the balancing strategies, for flag help and errors
+var Strategies = []string{RoundRobin, LeastOutstanding, Random, PowerOfTwo, ConsistentHash}
+
+// Balancer picks the backend for each request. Implementations must be safe
+// for concurrent use.
+type Balancer interface {
+	Next(r *http.Request) *Backend
+}
+
+// NewBalancer creates the balancer for config.Strategy over backends. Every
+// strategy needs at least one backend to pick from.
+func NewBalancer(config LoadBalancerConfig, backends []*Backend) (Balancer, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("at least one backend required")
+	}
+
+	switch config.Strategy {
+	case RoundRobin, "":
+		return &roundRobin{backends: backends}, nil
+	case LeastOutstanding:
+		return &leastOutstanding{backends: backends}, nil
+	case Random:
+		return newRandom(backends), nil
+	case PowerOfTwo:
+		return &powerOfTwo{backends: backends}, nil
+	case ConsistentHash:
+		return newConsistentHash(backends, config.HashKey, config.VirtualNodes), nil
+	default:
+		return nil, fmt.Errorf("unknown strategy %q, expected one of %v", config.Strategy, Strategies)
+	}
+}
+
+// roundRobin is nginx's smooth weighted round-robin. Every pick, each
+// backend's current weight grows by its weight and the highest is chosen and
+// lowered by the total, so a heavy backend's turns are spread out instead of
+// coming in a burst. Equal weights give plain round-robin.
+type roundRobin struct {
+	backends []*Backend
+	mu       sync.Mutex
+}
+
+func (b *roundRobin) Next(r *http.Request) *Backend {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var best *Backend
+	total := 0
+	for _, backend := range b.backends {
+		backend.currentWeight += backend.Weight
+		total += backend.Weight
+
+		if best == nil || backend.currentWeight > best.currentWeight {
+			best = backend
+		}
+	}
+	best.currentWeight -= total
+
+	return best
+}
+
+// leastOutstanding picks the backend with the fewest in-flight requests
+// relative to its weight. The scan starts one place further along each time
+// so ties, e.g. when the proxy is idle, are spread across backends.
+type leastOutstanding struct {
+	backends []*Backend
+	mu       sync.Mutex
+	start    int
+}
+
+func (b *leastOutstanding) Next(r *http.Request) *Backend {
+	b.mu.Lock()
+	start := b.start
+	b.start = (b.start + 1) % len(b.backends)
+	b.mu.Unlock()
+
+	best := b.backends[start]
+	for i := 1; i < len(b.backends); i++ {
+		backend := b.backends[(start+i)%len(b.backends)]
+		if backend.lessLoaded(best) {
+			best = backend
+		}
+	}
+	return best
+}
+
+// random picks a backend at random with probability proportional to its
+// weight
+type random struct {
+	backends []*Backend
+	total    int
+}
+
+func newRandom(backends []*Backend) *random {
+	b := &random{backends: backends}
+	for _, backend := range backends {
+		b.total += backend.Weight
+	}
+	return b
+}
+
+func (b *random) Next(r *http.Request) *Backend {
+	n := rand.IntN(b.total)
+	for _, backend := range b.backends {
+		if n < backend.Weight {
+			return backend
+		}
+		n -= backend.Weight
+	}
+	return b.backends[len(b.backends)-1]
+}
+
+// powerOfTwo samples two different backends at random and picks the less
+// loaded one. It avoids the herd behaviour of always choosing the global
+// minimum while still steering requests away from slow backends.
+type powerOfTwo struct {
+	backends []*Backend
+}
+
+func (b *powerOfTwo) Next(r *http.Request) *Backend {
+	if len(b.backends) == 1 {
+		return b.backends[0]
+	}
+
+	i := rand.IntN(len(b.backends))
+	j := rand.IntN(len(b.backends) - 1)
+	if j >= i {
+		j++
+	}
+
+	first, second := b.backends[i], b.backends[j]
+	if second.lessLoaded(first) {
+		return second
+	}
+	return first
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// picks returns the hosts of the next n backends
+func picks(lb *LoadBalancer, n int) []string {
+	hosts := make([]string, n)
+	for i := range hosts {
+		hosts[i] = lb.NextBackend(httptest.NewRequest("GET", "/", nil)).URL.Host
+	}
+	return hosts
+}
+
+func TestRoundRobin_EqualWeights(t *testing.T) {
+	lb, err := NewLoadBalancer(LoadBalancerConfig{Backends: []string{"http://a", "http://b", "http://c"}})
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	got := strings.Join(picks(lb, 9), ",")
+	if want := "a,b,c,a,b,c,a,b,c"; got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestRoundRobin_SmoothWeighted(t *testing.T) {
+	lb, err := NewLoadBalancer(LoadBalancerConfig{Backends: []string{"http://a=5", "http://b=1", "http://c=1"}})
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	// The heavy backend's turns are interleaved rather than five in a row
+	got := strings.Join(picks(lb, 7), ",")
+	if want := "a,a,b,a,c,a,a"; got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestRoundRobin_WeightedDistribution(t *testing.T) {
+	weights := map[string]int{"a": 7, "b": 3, "c": 2, "d": 1}
+	backendURLs := []string{"http://a=7", "http://b=3", "http://c=2", "http://d=1"}
+
+	lb, err := NewLoadBalancer(LoadBalancerConfig{Backends: backendURLs})
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	// Every cycle of 13 picks gives each backend exactly its weight
+	const cycles = 1000
+	counts := make(map[string]int)
+	longestRun, run, last := 0, 0, ""
+	for _, host := range picks(lb, 13*cycles) {
+		counts[host]++
+
+		if host == last {
+			run++
+		} else {
+			run, last = 1, host
+		}
+		longestRun = max(longestRun, run)
+	}
+
+	for host, weight := range weights {
+		if counts[host] != weight*cycles {
+			t.Errorf("Expected %s to get %d picks, got %d", host, weight*cycles, counts[host])
+		}
+	}
+
+	// Weight 7 of 13 means some back-to-back picks, but never a long burst
+	if longestRun > 2 {
+		t.Errorf("Expected at most 2 picks in a row of one backend, got %d", longestRun)
+	}
+}
+
+func TestNewBalancer_UnknownStrategy(t *testing.T) {
+	_, err := NewLoadBalancer(LoadBalancerConfig{Backends: []string{"http://a"}, Strategy: "fastest"})
+	if err == nil {
+		t.Fatal("Expected an error for an unknown strategy")
+	}
+}
+
+func TestNewBalancer_NoBackends(t *testing.T) {
+	for _, strategy := range Strategies {
+		if _, err := NewLoadBalancer(LoadBalancerConfig{Strategy: strategy}); err == nil {
+			t.Errorf("%s: expected an error without backends", strategy)
+		}
+	}
+}
+
+// newTestBalancer creates a load balancer over backendURLs using strategy
+func newTestBalancer(t *testing.T, strategy string, backendURLs ...string) *LoadBalancer {
+	t.Helper()
+
+	lb, err := NewLoadBalancer(LoadBalancerConfig{Backends: backendURLs, Strategy: strategy})
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	return lb
+}
+
+func TestLeastOutstanding_PicksLeastLoaded(t *testing.T) {
+	lb := newTestBalancer(t, LeastOutstanding, "http://a=2", "http://b", "http://c")
+	a, b, c := lb.backends[0], lb.backends[1], lb.backends[2]
+
+	// Relative to its weight, a with 2 requests is as busy as b with 1
+	a.inFlight.Store(2)
+	b.inFlight.Store(1)
+	c.inFlight.Store(3)
+
+	counts := make(map[string]int)
+	for _, host := range picks(lb, 100) {
+		counts[host]++
+	}
+	if counts["c"] != 0 {
+		t.Errorf("Expected the busiest backend to be skipped, got %v", counts)
+	}
+
+	// Ties are spread rather than always going to the first backend
+	if counts["a"] == 0 || counts["b"] == 0 {
+		t.Errorf("Expected ties to be shared between a and b, got %v", counts)
+	}
+}
+
+func TestLeastOutstanding_TracksInFlightRequests(t *testing.T) {
+	quietLogs(t)
+
+	// The slow backend holds every request until released
+	release := make(chan struct{})
+	var slowHits, fastHits atomic.Int64
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowHits.Add(1)
+		<-release
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fastHits.Add(1)
+	}))
+	defer fast.Close()
+
+	lb := newTestBalancer(t, LeastOutstanding, slow.URL, fast.URL)
+	slowBackend := lb.backends[0]
+
+	// The first request goes to the slow backend and stays in flight
+	done := make(chan struct{})
+	go func() {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		close(done)
+	}()
+	for slowBackend.InFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Everything after that completes on the fast backend, so it's never the
+	// more loaded one
+	for range 20 {
+		lb.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if slowHits.Load() != 1 || fastHits.Load() != 20 {
+		t.Errorf("Expected 1 slow and 20 fast requests, got %d and %d", slowHits.Load(), fastHits.Load())
+	}
+
+	close(release)
+	<-done
+	if inFlight := slowBackend.InFlight(); inFlight != 0 {
+		t.Errorf("Expected no requests in flight after completion, got %d", inFlight)
+	}
+}
+
+func TestRandom_WeightedDistribution(t *testing.T) {
+	lb := newTestBalancer(t, Random, "http://a=3", "http://b")
+
+	const n = 40000
+	counts := make(map[string]int)
+	for _, host := range picks(lb, n) {
+		counts[host]++
+	}
+
+	// Expect 75% on a, allowing for randomness
+	if share := float64(counts["a"]) / n; share < 0.73 || share > 0.77 {
+		t.Errorf("Expected about 75%% of picks on a, got %.1f%%", share*100)
+	}
+}
+
+func TestPowerOfTwo_AvoidsBusiestBackend(t *testing.T) {
+	lb := newTestBalancer(t, PowerOfTwo, "http://a", "http://b", "http://c")
+	lb.backends[2].inFlight.Store(10)
+
+	// c loses every comparison, and a and b are both sampled
+	counts := make(map[string]int)
+	for _, host := range picks(lb, 1000) {
+		counts[host]++
+	}
+	if counts["c"] != 0 || counts["a"] == 0 || counts["b"] == 0 {
+		t.Errorf("Expected picks spread over a and b only, got %v", counts)
+	}
+}
+
+func TestPowerOfTwo_SingleBackend(t *testing.T) {
+	lb := newTestBalancer(t, PowerOfTwo, "http://a")
+
+	if host := lb.NextBackend(httptest.NewRequest("GET", "/", nil)).URL.Host; host != "a" {
+		t.Errorf("Expected a, got %s", host)
+	}
+}
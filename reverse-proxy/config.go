@@ -4,16 +4,30 @@ import (
 	"flag"
 	"fmt"
 	"strings"
+	"time"
 )
 
 type Config struct {
 	ProxyPort string
 	Backends  []string
+	Strategy  string
+	HashKey   HashKey
+	Transport TransportConfig
+	Affinity  AffinityConfig
 }
 
 func ParseConfig() (*Config, error) {
 	proxyPort := flag.String("port", "8080", "Port for the proxy server")
-	backends := flag.String("backends", "http://localhost:8081", "Comma-separated list of backend URLs")
+	backends := flag.String("backends", "http://localhost:8081", "Comma-separated list of backend URLs, each with an optional weight (e.g. http://localhost:8081=5)")
+
+	strategy := flag.String("strategy", RoundRobin, "Load balancing strategy: "+strings.Join(Strategies, ", "))
+	hashKey := flag.String("hash-key", HashByIP, "What the hash strategy routes by: ip, header:<name> or cookie:<name>")
+	affinityCookie := flag.String("affinity-cookie", "", "Cookie that pins clients to the backend that first served them (empty disables)")
+	affinityTTL := flag.Duration("affinity-ttl", time.Hour, "How long a client stays pinned to its backend")
+	affinitySecret := flag.String("affinity-secret", "", "Secret for signing affinity cookies (random per process if empty)")
+	maxIdleConns := flag.Int("max-idle-conns", 100, "Idle keep-alive connections kept per backend")
+	idleTimeout := flag.Duration("idle-timeout", 90*time.Second, "How long idle backend connections are kept")
+	dialTimeout := flag.Duration("dial-timeout", 5*time.Second, "Timeout for connecting to a backend")
 
 	flag.Parse()
 
@@ -29,8 +43,25 @@ func ParseConfig() (*Config, error) {
 		return nil, fmt.Errorf("at least one backend is required")
 	}
 
+	key, err := ParseHashKey(*hashKey)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Config{
 		ProxyPort: *proxyPort,
 		Backends:  backendList,
+		Strategy:  *strategy,
+		HashKey:   key,
+		Transport: TransportConfig{
+			MaxIdleConnsPerHost: *maxIdleConns,
+			IdleConnTimeout:     *idleTimeout,
+			DialTimeout:         *dialTimeout,
+		},
+		Affinity: AffinityConfig{
+			Cookie: *affinityCookie,
+			TTL:    *affinityTTL,
+			Secret: *affinitySecret,
+		},
 	}, nil
 }
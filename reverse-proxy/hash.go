@@ -0,0 +1,149 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// DefaultVirtualNodes is how many points each unit of weight gets on the ring
+const DefaultVirtualNodes = 160
+
+// Sources of the key that requests are hashed by
+const (
+	HashByIP     = "ip"
+	HashByHeader = "header"
+	HashByCookie = "cookie"
+)
+
+// HashKey says what part of a request picks its backend
+type HashKey struct {
+	Source string // HashByIP, HashByHeader or HashByCookie
+	Name   string // Header or cookie name
+}
+
+// ParseHashKey parses "ip", "header:<name>" or "cookie:<name>"
+func ParseHashKey(spec string) (HashKey, error) {
+	source, name, _ := strings.Cut(spec, ":")
+
+	switch source {
+	case HashByIP:
+		if name != "" {
+			return HashKey{}, fmt.Errorf("invalid hash key %q, ip takes no name", spec)
+		}
+	case HashByHeader, HashByCookie:
+		if name == "" {
+			return HashKey{}, fmt.Errorf("invalid hash key %q, expected %s:<name>", spec, source)
+		}
+	default:
+		return HashKey{}, fmt.Errorf("invalid hash key %q, expected ip, header:<name> or cookie:<name>", spec)
+	}
+	return HashKey{Source: source, Name: name}, nil
+}
+
+// String returns the key in the form ParseHashKey accepts
+func (k HashKey) String() string {
+	if k.Source == HashByIP || k.Source == "" {
+		return HashByIP
+	}
+	return k.Source + ":" + k.Name
+}
+
+// value extracts the key from r. Requests without the header or cookie fall
+// back to the client IP so they are still sticky.
+func (k HashKey) value(r *http.Request) string {
+	switch k.Source {
+	case HashByHeader:
+		if value := r.Header.Get(k.Name); value != "" {
+			return value
+		}
+	case HashByCookie:
+		if cookie, err := r.Cookie(k.Name); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ringPoint is one virtual node
+type ringPoint struct {
+	hash    uint64
+	backend *Backend
+}
+
+// consistentHash places virtual nodes for every backend on a hash ring and
+// sends each key to the first point at or after its hash. Points are derived
+// from the backend's URL rather than its position, so adding or removing a
+// backend only moves the keys that land on its points, about 1/N of them.
+type consistentHash struct {
+	key    HashKey
+	points []ringPoint // Sorted by hash
+}
+
+func newConsistentHash(backends []*Backend, key HashKey, virtualNodes int) *consistentHash {
+	b := &consistentHash{key: key}
+
+	for _, backend := range backends {
+		for i := range virtualNodes * backend.Weight {
+			point := ringPoint{
+				hash:    hashString(backend.URL.String() + "#" + strconv.Itoa(i)),
+				backend: backend,
+			}
+			b.points = append(b.points, point)
+		}
+	}
+
+	// Break the rare hash collision by URL so the ring doesn't depend on the
+	// order backends were listed in
+	slices.SortFunc(b.points, func(a, b ringPoint) int {
+		if c := cmp.Compare(a.hash, b.hash); c != 0 {
+			return c
+		}
+		return strings.Compare(a.backend.URL.String(), b.backend.URL.String())
+	})
+	return b
+}
+
+func (b *consistentHash) Next(r *http.Request) *Backend {
+	return b.lookup(b.key.value(r))
+}
+
+// lookup returns the backend owning key
+func (b *consistentHash) lookup(key string) *Backend {
+	hash := hashString(key)
+
+	i, _ := slices.BinarySearchFunc(b.points, hash, func(point ringPoint, hash uint64) int {
+		return cmp.Compare(point.hash, hash)
+	})
+	if i == len(b.points) {
+		i = 0 // Wrap around the ring
+	}
+	return b.points[i].backend
+}
+
+// hashString is FNV-1a followed by a finalizer, since FNV alone clusters
+// similar strings like "host#1" and "host#2" on the ring. It's stable across
+// processes, so every proxy instance builds the same ring.
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+
+	// splitmix64 finalizer
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
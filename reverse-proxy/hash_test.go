@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseHashKey(t *testing.T) {
+	tests := []struct {
+		spec string
+		want HashKey
+		err  bool
+	}{
+		{spec: "ip", want: HashKey{Source: HashByIP}},
+		{spec: "header:X-User-ID", want: HashKey{Source: HashByHeader, Name: "X-User-ID"}},
+		{spec: "cookie:session", want: HashKey{Source: HashByCookie, Name: "session"}},
+		{spec: "ip:x", err: true},
+		{spec: "header", err: true},
+		{spec: "cookie:", err: true},
+		{spec: "url", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseHashKey(tt.spec)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: expected %+v, got %+v", tt.spec, tt.want, got)
+		}
+		if got.String() != tt.spec {
+			t.Errorf("%s: expected String to round trip, got %s", tt.spec, got)
+		}
+	}
+}
+
+// newRing builds a consistent hash ring over backends with the given hosts
+func newRing(t *testing.T, names ...string) *consistentHash {
+	t.Helper()
+
+	backendURLs := make([]string, len(names))
+	for i, name := range names {
+		backendURLs[i] = "http://" + name
+	}
+
+	lb, err := NewLoadBalancer(LoadBalancerConfig{Backends: backendURLs, Strategy: ConsistentHash})
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+	return lb.balancer.(*consistentHash)
+}
+
+// owners maps each of n keys to the host of the backend that owns it
+func owners(ring *consistentHash, n int) []string {
+	hosts := make([]string, n)
+	for i := range hosts {
+		hosts[i] = ring.lookup(fmt.Sprintf("user-%d", i)).URL.Host
+	}
+	return hosts
+}
+
+const hashKeys = 100000
+
+func TestConsistentHash_SpreadsKeysEvenly(t *testing.T) {
+	ring := newRing(t, "b0", "b1", "b2", "b3", "b4")
+
+	counts := make(map[string]int)
+	for _, host := range owners(ring, hashKeys) {
+		counts[host]++
+	}
+
+	// With 160 virtual nodes each backend's share stays close to 1/5
+	fair := hashKeys / 5
+	for host, count := range counts {
+		if count < fair*8/10 || count > fair*12/10 {
+			t.Errorf("Expected about %d keys on %s, got %d", fair, host, count)
+		}
+	}
+}
+
+func TestConsistentHash_AddingBackendMovesFewKeys(t *testing.T) {
+	before := owners(newRing(t, "b0", "b1", "b2", "b3"), hashKeys)
+	after := owners(newRing(t, "b0", "b1", "b2", "b3", "b4"), hashKeys)
+
+	moved := 0
+	for i := range before {
+		if before[i] == after[i] {
+			continue
+		}
+		moved++
+
+		// Keys only ever move to the new backend
+		if after[i] != "b4" {
+			t.Fatalf("Key %d moved from %s to %s instead of the new backend", i, before[i], after[i])
+		}
+	}
+
+	// Ideally 1/5 of keys move to the new backend
+	share := float64(moved) / hashKeys
+	t.Logf("Adding a 5th backend moved %.1f%% of keys", share*100)
+	if share < 0.15 || share > 0.25 {
+		t.Errorf("Expected about 20%% of keys to move, got %.1f%%", share*100)
+	}
+}
+
+func TestConsistentHash_RemovingBackendMovesOnlyItsKeys(t *testing.T) {
+	before := owners(newRing(t, "b0", "b1", "b2", "b3", "b4"), hashKeys)
+	after := owners(newRing(t, "b0", "b1", "b3", "b4"), hashKeys)
+
+	moved := 0
+	for i := range before {
+		if before[i] == after[i] {
+			continue
+		}
+		moved++
+
+		// Only keys of the removed backend move
+		if before[i] != "b2" {
+			t.Fatalf("Key %d moved from %s to %s although its backend is still there", i, before[i], after[i])
+		}
+	}
+
+	share := float64(moved) / hashKeys
+	t.Logf("Removing 1 of 5 backends moved %.1f%% of keys", share*100)
+	if share < 0.15 || share > 0.25 {
+		t.Errorf("Expected about 20%% of keys to move, got %.1f%%", share*100)
+	}
+}
+
+func TestConsistentHash_IgnoresBackendOrder(t *testing.T) {
+	first := owners(newRing(t, "b0", "b1", "b2"), 1000)
+	second := owners(newRing(t, "b2", "b0", "b1"), 1000)
+
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Key %d went to %s and %s depending on backend order", i, first[i], second[i])
+		}
+	}
+}
+
+func TestConsistentHash_Weights(t *testing.T) {
+	lb, err := NewLoadBalancer(LoadBalancerConfig{
+		Backends: []string{"http://a=3", "http://b"},
+		Strategy: ConsistentHash,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for _, host := range owners(lb.balancer.(*consistentHash), hashKeys) {
+		counts[host]++
+	}
+	if share := float64(counts["a"]) / hashKeys; share < 0.70 || share > 0.80 {
+		t.Errorf("Expected about 75%% of keys on a, got %.1f%%", share*100)
+	}
+}
+
+func TestConsistentHash_RequestKeys(t *testing.T) {
+	newRequest := func(remoteAddr string) *http.Request {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		return r
+	}
+
+	tests := []struct {
+		name  string
+		key   HashKey
+		setup func(*http.Request)
+		want  string
+	}{
+		{name: "client IP without port", key: HashKey{Source: HashByIP}, want: "10.0.0.1"},
+		{
+			name:  "header",
+			key:   HashKey{Source: HashByHeader, Name: "X-User-ID"},
+			setup: func(r *http.Request) { r.Header.Set("X-User-ID", "alice") },
+			want:  "alice",
+		},
+		{
+			name:  "cookie",
+			key:   HashKey{Source: HashByCookie, Name: "session"},
+			setup: func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "session", Value: "abc"}) },
+			want:  "abc",
+		},
+		{name: "missing header falls back to IP", key: HashKey{Source: HashByHeader, Name: "X-User-ID"}, want: "10.0.0.1"},
+		{name: "missing cookie falls back to IP", key: HashKey{Source: HashByCookie, Name: "session"}, want: "10.0.0.1"},
+	}
+
+	for _, tt := range tests {
+		r := newRequest("10.0.0.1:5555")
+		if tt.setup != nil {
+			tt.setup(r)
+		}
+		if got := tt.key.value(r); got != tt.want {
+			t.Errorf("%s: expected key %q, got %q", tt.name, tt.want, got)
+		}
+	}
+
+	// The same client is sticky across connections from different ports
+	ring := newRing(t, "b0", "b1", "b2", "b3")
+	first := ring.Next(newRequest("10.0.0.1:5555"))
+	for port := range 20 {
+		if got := ring.Next(newRequest(fmt.Sprintf("10.0.0.1:%d", 6000+port))); got != first {
+			t.Fatalf("Expected every request from 10.0.0.1 to go to %s, got %s", first.URL.Host, got.URL.Host)
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"net/http/httputil"
 	"time"
 )
 
@@ -42,35 +41,22 @@ func main() {
 		log.Fatal("Configuration error:", err)
 	}
 
-	lb, err := NewLoadBalancer(config.Backends)
+	lb, err := NewLoadBalancer(LoadBalancerConfig{
+		Backends:  config.Backends,
+		Strategy:  config.Strategy,
+		Transport: config.Transport,
+		HashKey:   config.HashKey,
+		Affinity:  config.Affinity,
+	})
 	if err != nil {
 		log.Fatal("Failed to create load balancer:", err)
 	}
 
-	// Create a handler that picks a backend for each request
-	proxyHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		backend := lb.NextBackend()
-		log.Printf("Forwarding to backend: %s", backend.Host)
-
-		// Create a proxy for this specific backend
-		proxy := httputil.NewSingleHostReverseProxy(backend)
-
-		// Add header modification
-		originalDirector := proxy.Director
-		proxy.Director = func(req *http.Request) {
-			originalDirector(req)
-			modifyRequest(req)
-		}
-
-		// Forward the request
-		proxy.ServeHTTP(w, r)
-	})
-
 	// Wrap the proxy with logging middleware
-	handler := loggingMiddleware(proxyHandler)
+	handler := loggingMiddleware(lb)
 
 	fmt.Printf("Reverse proxy starting on port %s", config.ProxyPort)
-	fmt.Printf("Load balancing across %d backends:\n", len(config.Backends))
+	fmt.Printf("Load balancing across %d backends (%s):\n", len(config.Backends), config.Strategy)
 	for i, backend := range config.Backends {
 		fmt.Printf(" Backend %d: %s\n", i+1, backend)
 	}
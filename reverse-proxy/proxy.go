@@ -2,43 +2,198 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
 	"net/url"
-	"sync"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
+// TransportConfig tunes the connection pool kept for each backend
+type TransportConfig struct {
+	MaxIdleConnsPerHost int           // Idle keep-alive connections kept per backend
+	IdleConnTimeout     time.Duration // How long an idle connection is kept before closing
+	DialTimeout         time.Duration // How long to wait for a new connection to a backend
+}
+
+// Backend is a single upstream server with its own long-lived proxy
+type Backend struct {
+	URL    *url.URL
+	Weight int // Share of requests relative to the other backends
+	Proxy  *httputil.ReverseProxy
+
+	inFlight      atomic.Int64 // Requests currently being proxied to this backend
+	currentWeight int          // Smooth weighted round-robin state, guarded by roundRobin.mu
+}
+
+// InFlight returns the number of requests currently being proxied to b
+func (b *Backend) InFlight() int64 {
+	return b.inFlight.Load()
+}
+
+// lessLoaded reports whether b has fewer in-flight requests than other
+// relative to their weights
+func (b *Backend) lessLoaded(other *Backend) bool {
+	return b.InFlight()*int64(other.Weight) < other.InFlight()*int64(b.Weight)
+}
+
+// LoadBalancerConfig holds configuration for the load balancer
+type LoadBalancerConfig struct {
+	Backends  []string        // Backend URLs, each with an optional "=weight" suffix
+	Strategy  string          // One of Strategies, defaults to RoundRobin
+	Transport TransportConfig // Connection pool for each backend
+
+	// Consistent hashing
+	HashKey      HashKey // What requests are hashed by, defaults to the client IP
+	VirtualNodes int     // Ring points per unit of backend weight, defaults to DefaultVirtualNodes
+
+	// Pins clients to a backend with a cookie, ahead of the strategy
+	Affinity AffinityConfig
+}
+
 // LoadBalancer handles distributing requests across backends
 type LoadBalancer struct {
-	backends []*url.URL
-	current  int
-	mu       sync.Mutex
+	backends []*Backend
+	balancer Balancer
+	affinity *affinity // nil unless cookie affinity is enabled
 }
 
 // NewLoadBalancer creates a new load balancer
-func NewLoadBalancer(backendURLs []string) (*LoadBalancer, error) {
+func NewLoadBalancer(config LoadBalancerConfig) (*LoadBalancer, error) {
+	// Set defaults
+	if config.Strategy == "" {
+		config.Strategy = RoundRobin
+	}
+	if config.HashKey.Source == "" {
+		config.HashKey.Source = HashByIP
+	}
+	if config.VirtualNodes == 0 {
+		config.VirtualNodes = DefaultVirtualNodes
+	}
+	if config.Transport.MaxIdleConnsPerHost == 0 {
+		config.Transport.MaxIdleConnsPerHost = 100
+	}
+	if config.Transport.IdleConnTimeout == 0 {
+		config.Transport.IdleConnTimeout = 90 * time.Second
+	}
+	if config.Transport.DialTimeout == 0 {
+		config.Transport.DialTimeout = 5 * time.Second
+	}
+
 	lb := &LoadBalancer{
-		backends: make([]*url.URL, 0, len(backendURLs)),
-		current:  0,
+		backends: make([]*Backend, 0, len(config.Backends)),
 	}
 
 	// Parse all backend URLs
-	for _, backendURL := range backendURLs {
-		parsedURL, err := url.Parse(backendURL)
+	for _, backendURL := range config.Backends {
+		parsedURL, weight, err := parseBackend(backendURL)
 		if err != nil {
-			return nil, fmt.Errorf("invalid backend URL %s: %v", backendURL, err)
+			return nil, err
+		}
+
+		backend := newBackend(parsedURL, config.Transport)
+		backend.Weight = weight
+		lb.backends = append(lb.backends, backend)
+	}
+
+	balancer, err := NewBalancer(config, lb.backends)
+	if err != nil {
+		return nil, err
+	}
+	lb.balancer = balancer
+
+	if config.Affinity.Cookie != "" {
+		if lb.affinity, err = newAffinity(config.Affinity, lb.backends); err != nil {
+			return nil, err
 		}
-		lb.backends = append(lb.backends, parsedURL)
 	}
 
 	return lb, nil
 }
 
-// NextBackend returns the next backend in round-robin fashion
-func (lb *LoadBalancer) NextBackend() *url.URL {
-	lb.mu.Lock()
-	defer lb.mu.Unlock()
+// parseBackend splits a backend URL with an optional weight suffix, e.g.
+// "http://localhost:8081=5". Backends without a weight have weight 1. Only an
+// integer after the last "=" is a weight, so queries like "?pool=x" stay part
+// of the URL; a query ending in a number needs an explicit weight, e.g.
+// "http://localhost:8081/?id=7=1".
+func parseBackend(spec string) (*url.URL, int, error) {
+	weight := 1
+	if i := strings.LastIndex(spec, "="); i >= 0 {
+		if w, err := strconv.Atoi(spec[i+1:]); err == nil {
+			if w <= 0 {
+				return nil, 0, fmt.Errorf("invalid weight for backend %s", spec)
+			}
+			spec, weight = spec[:i], w
+		}
+	}
+
+	parsedURL, err := url.Parse(spec)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid backend URL %s: %v", spec, err)
+	}
+	return parsedURL, weight, nil
+}
+
+// newBackend builds the proxy and connection pool for one backend, once,
+// so keep-alive connections are reused across requests
+func newBackend(target *url.URL, config TransportConfig) *Backend {
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = newTransport(config)
+
+	// Add header modification
+	originalDirector := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		originalDirector(req)
+		modifyRequest(req)
+	}
+
+	return &Backend{URL: target, Proxy: proxy}
+}
+
+// newTransport is http.DefaultTransport with a pool sized for a proxy, which
+// sends many concurrent requests to the same few hosts
+func newTransport(config TransportConfig) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   config.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = config.IdleConnTimeout
+	return transport
+}
+
+// NextBackend returns the backend chosen by the balancing strategy for r
+func (lb *LoadBalancer) NextBackend(r *http.Request) *Backend {
+	return lb.balancer.Next(r)
+}
+
+// ServeHTTP forwards r to the next backend, counting it as in flight until
+// the backend's response has been copied to the client. With cookie affinity,
+// clients go back to the backend named in their cookie, and get a new cookie
+// when they have none or their backend is gone.
+func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var backend *Backend
+	if lb.affinity != nil {
+		backend = lb.affinity.backend(r)
+	}
+	if backend == nil {
+		backend = lb.NextBackend(r)
+		if lb.affinity != nil {
+			lb.affinity.issue(w, backend)
+		}
+	}
+	log.Printf("Forwarding to backend: %s", backend.URL.Host)
 
-	backend := lb.backends[lb.current]
-	lb.current = (lb.current + 1) % len(lb.backends)
+	backend.inFlight.Add(1)
+	defer backend.inFlight.Add(-1)
 
-	return backend
+	// Forward the request
+	backend.Proxy.ServeHTTP(w, r)
 }
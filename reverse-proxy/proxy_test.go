@@ -1,5 +1,202 @@
 package main
 
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startBackend serves "OK" and counts the connections opened to it
+func startBackend(t testing.TB) (*httptest.Server, *atomic.Int64) {
+	t.Helper()
+
+	var conns atomic.Int64
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	backend.Start()
+	t.Cleanup(backend.Close)
+
+	return backend, &conns
+}
+
+// quietLogs silences the per-request logging for the duration of a test
+func quietLogs(t testing.TB) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func TestLoadBalancer_ReusesBackendConnections(t *testing.T) {
+	quietLogs(t)
+	backend, conns := startBackend(t)
+
+	lb, err := NewLoadBalancer(LoadBalancerConfig{Backends: []string{backend.URL}})
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	// Several rounds of concurrent requests should be served by the first
+	// round's connections
+	const concurrency = 20
+	for range 5 {
+		var wg sync.WaitGroup
+		for range concurrency {
+			wg.Go(func() {
+				rec := httptest.NewRecorder()
+				lb.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+				if rec.Code != http.StatusOK {
+					t.Errorf("Expected 200, got %d", rec.Code)
+				}
+			})
+		}
+		wg.Wait()
+	}
+
+	if opened := conns.Load(); opened > concurrency {
+		t.Errorf("Expected at most %d backend connections, got %d", concurrency, opened)
+	}
+}
+
+func TestNewTransport_KeepsDefaults(t *testing.T) {
+	transport := newTransport(TransportConfig{MaxIdleConnsPerHost: 50, IdleConnTimeout: time.Minute, DialTimeout: time.Second})
+
+	// Outbound proxies from the environment are still honoured, and the
+	// overall idle pool stays bounded
+	if transport.Proxy == nil {
+		t.Error("Expected the proxy from the environment to be used")
+	}
+	if transport.MaxIdleConns != http.DefaultTransport.(*http.Transport).MaxIdleConns {
+		t.Errorf("Expected the default MaxIdleConns, got %d", transport.MaxIdleConns)
+	}
+	if transport.MaxIdleConnsPerHost != 50 || transport.IdleConnTimeout != time.Minute {
+		t.Errorf("Expected the configured pool, got %d idle per host for %s", transport.MaxIdleConnsPerHost, transport.IdleConnTimeout)
+	}
+}
+
+func TestLoadBalancer_ModifiesHeaders(t *testing.T) {
+	quietLogs(t)
+
+	var got http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+	}))
+	defer backend.Close()
+
+	lb, err := NewLoadBalancer(LoadBalancerConfig{Backends: []string{backend.URL}})
+	if err != nil {
+		t.Fatalf("Failed to create load balancer: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Remove-This", "secret")
+	lb.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got.Get("X-Proxy-By") != "GoReverseProxy" {
+		t.Errorf("Expected X-Proxy-By header, got %q", got.Get("X-Proxy-By"))
+	}
+	if got.Get("X-Remove-This") != "" {
+		t.Errorf("Expected X-Remove-This to be removed, got %q", got.Get("X-Remove-This"))
+	}
+}
+
+func TestParseBackend(t *testing.T) {
+	tests := []struct {
+		spec   string
+		host   string
+		query  string
+		weight int
+		err    bool
+	}{
+		{spec: "http://localhost:8081", host: "localhost:8081", weight: 1},
+		{spec: "http://localhost:8081=5", host: "localhost:8081", weight: 5},
+		{spec: "http://localhost:8081/?pool=x", host: "localhost:8081", query: "pool=x", weight: 1},
+		{spec: "http://localhost:8081/?pool=x=3", host: "localhost:8081", query: "pool=x", weight: 3},
+		{spec: "http://localhost:8081/?id=7=1", host: "localhost:8081", query: "id=7", weight: 1},
+		{spec: "http://localhost:8081=0", err: true},
+		{spec: "http://localhost:8081=-2", err: true},
+		{spec: "http://localhost:8081=heavy", err: true},
+	}
+
+	for _, tt := range tests {
+		parsedURL, weight, err := parseBackend(tt.spec)
+		if tt.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.spec, err)
+			continue
+		}
+		if parsedURL.Host != tt.host || parsedURL.RawQuery != tt.query || weight != tt.weight {
+			t.Errorf("%s: expected %s?%s with weight %d, got %s?%s with weight %d", tt.spec, tt.host, tt.query, tt.weight, parsedURL.Host, parsedURL.RawQuery, weight)
+		}
+	}
+}
+
+// BenchmarkProxy compares building a ReverseProxy for every request, as the
+// proxy used to, with the long-lived proxy and pool kept per backend
+func BenchmarkProxy(b *testing.B) {
+	b.Run("per-request", func(b *testing.B) {
+		benchmarkProxy(b, func(lb *LoadBalancer) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				proxy := httputil.NewSingleHostReverseProxy(lb.NextBackend(r).URL)
+				originalDirector := proxy.Director
+				proxy.Director = func(req *http.Request) {
+					originalDirector(req)
+					modifyRequest(req)
+				}
+				proxy.ServeHTTP(w, r)
+			})
+		})
+	})
+	b.Run("shared", func(b *testing.B) {
+		benchmarkProxy(b, func(lb *LoadBalancer) http.Handler {
+			return lb
+		})
+	})
+}
+
+func benchmarkProxy(b *testing.B, handler func(*LoadBalancer) http.Handler) {
+	quietLogs(b)
+	backend, conns := startBackend(b)
+
+	lb, err := NewLoadBalancer(LoadBalancerConfig{Backends: []string{backend.URL}})
+	if err != nil {
+		b.Fatalf("Failed to create load balancer: %v", err)
+	}
+	proxy := handler(lb)
+
+	b.ReportAllocs()
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			rec := httptest.NewRecorder()
+			proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			if rec.Code != http.StatusOK {
+				b.Errorf("Expected 200, got %d", rec.Code)
+				return
+			}
+		}
+	})
+	b.ReportMetric(float64(conns.Load()), "conns")
+}
+
 // import (
 // 	"net/http"
 // 	"net/http/httptest"
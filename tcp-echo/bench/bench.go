@@ -0,0 +1,209 @@
+// Package bench drives load against an echo server and measures how long each
+// echo takes. cmd/echo-bench is a thin command line wrapper around Run.
+package bench
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"tcp-echo/framing"
+)
+
+// Config holds configuration for a benchmark run
+type Config struct {
+	Network     string         // "tcp" (default) or "unix"
+	Addr        string         // Server address
+	Conns       int            // Concurrent connections, defaults to 1
+	Duration    time.Duration  // How long to send for, defaults to 10s
+	Messages    int            // Stop after this many messages in total (0 = until Duration)
+	Rate        float64        // Target messages per second across all connections (0 = as fast as possible)
+	MessageSize int            // Payload size in bytes, defaults to 64
+	Framing     framing.Config // Must match the server
+	Prefix      string         // What the server puts in front of each echo, e.g. "Echo: "
+	DialTimeout time.Duration  // Defaults to 5s
+	ReadTimeout time.Duration  // How long to wait for each echo, defaults to 5s
+}
+
+// worker is one connection's share of the run
+type worker struct {
+	id        int
+	config    Config
+	interval  time.Duration // Time between sends, 0 when unthrottled
+	latencies []time.Duration
+	bytes     int64
+	errors    map[string]int
+}
+
+// Run opens the connections, sends until the duration or message count is
+// reached, and returns the combined result
+func Run(ctx context.Context, config Config) (*Result, error) {
+	// Set defaults
+	if config.Network == "" {
+		config.Network = "tcp"
+	}
+	if config.Conns <= 0 {
+		config.Conns = 1
+	}
+	if config.Duration == 0 {
+		config.Duration = 10 * time.Second
+	}
+	if config.MessageSize <= 0 {
+		config.MessageSize = 64
+	}
+	if config.DialTimeout == 0 {
+		config.DialTimeout = 5 * time.Second
+	}
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = 5 * time.Second
+	}
+	if config.Framing.Mode == framing.Fixed {
+		config.MessageSize = config.Framing.FrameSize
+	}
+	if config.Addr == "" {
+		return nil, fmt.Errorf("address required")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.Duration)
+	defer cancel()
+
+	var budget *messageBudget
+	if config.Messages > 0 {
+		budget = &messageBudget{remaining: config.Messages}
+	}
+
+	workers := make([]*worker, config.Conns)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range workers {
+		w := &worker{id: i, config: config, errors: make(map[string]int)}
+		if config.Rate > 0 {
+			w.interval = time.Duration(float64(time.Second) * float64(config.Conns) / config.Rate)
+		}
+		workers[i] = w
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.run(ctx, budget)
+		}()
+	}
+	wg.Wait()
+
+	return newResult(config, workers, time.Since(start)), nil
+}
+
+// messageBudget shares the Messages limit between workers
+type messageBudget struct {
+	mu        sync.Mutex
+	remaining int
+}
+
+// take claims one message, returning false once the budget is spent
+func (b *messageBudget) take() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.remaining == 0 {
+		return false
+	}
+	b.remaining--
+	return true
+}
+
+// run sends messages on a single connection until ctx is done
+func (w *worker) run(ctx context.Context, budget *messageBudget) {
+	dialer := net.Dialer{Timeout: w.config.DialTimeout}
+	conn, err := dialer.DialContext(ctx, w.config.Network, w.config.Addr)
+	if err != nil {
+		w.errors["dial"]++
+		return
+	}
+	defer conn.Close()
+
+	// Unblock a pending read when the run ends
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	framer, err := framing.New(conn, w.config.Framing)
+	if err != nil {
+		w.errors["framing"]++
+		return
+	}
+
+	// Measuring from the scheduled send time rather than the actual one keeps
+	// a slow server from hiding its stalls (coordinated omission)
+	next := time.Now()
+	for seq := 0; ; seq++ {
+		if w.interval > 0 {
+			if delay := time.Until(next); delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		if ctx.Err() != nil || !budget.take() {
+			return
+		}
+
+		sent := time.Now()
+		if w.interval > 0 {
+			sent = next
+			next = next.Add(w.interval)
+		}
+
+		payload := w.payload(seq)
+		conn.SetDeadline(time.Now().Add(w.config.ReadTimeout))
+		if err := framer.WriteFrame(payload); err != nil {
+			w.recordError(ctx, "write", err)
+			return
+		}
+
+		reply, err := framer.ReadFrame()
+		if err != nil {
+			w.recordError(ctx, "read", err)
+			return
+		}
+
+		if !bytes.Equal(reply, append([]byte(w.config.Prefix), payload...)) {
+			w.errors["mismatch"]++
+			continue
+		}
+
+		w.latencies = append(w.latencies, time.Since(sent))
+		w.bytes += int64(len(payload))
+	}
+}
+
+// payload builds a message unique to this connection and sequence number,
+// padded to MessageSize, so a misrouted or stale echo is caught
+func (w *worker) payload(seq int) []byte {
+	payload := bytes.Repeat([]byte{'x'}, w.config.MessageSize)
+	copy(payload, strconv.Itoa(w.id)+"-"+strconv.Itoa(seq)+"-")
+	return payload
+}
+
+// recordError counts err unless it was caused by the run ending
+func (w *worker) recordError(ctx context.Context, op string, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		op = "timeout"
+	}
+	w.errors[op]++
+}
@@ -0,0 +1,158 @@
+package bench
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"tcp-echo/framing"
+	"tcp-echo/server"
+)
+
+// startEchoServer serves handler on a random local port
+func startEchoServer(t *testing.T, handler server.Handler) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	srv := server.NewServer(server.Config{Handler: handler})
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	return listener.Addr().String()
+}
+
+func TestRun_MessageCount(t *testing.T) {
+	addr := startEchoServer(t, server.NewEchoHandler())
+
+	result, err := Run(context.Background(), Config{
+		Addr:     addr,
+		Conns:    4,
+		Messages: 200,
+		Prefix:   "Echo: ",
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if result.Messages != 200 || result.ErrorCount() != 0 {
+		t.Fatalf("Expected 200 messages and no errors, got %d and %v", result.Messages, result.Errors)
+	}
+	if result.Latency.P50 > result.Latency.P99 || result.Latency.P99 > result.Latency.Max || result.Latency.Min == 0 {
+		t.Errorf("Percentiles out of order: %+v", result.Latency)
+	}
+
+	total := 0
+	for _, b := range result.Histogram {
+		total += b.Count
+	}
+	if total != 200 {
+		t.Errorf("Histogram holds %d samples, expected 200", total)
+	}
+}
+
+func TestRun_BinaryFraming(t *testing.T) {
+	handler := server.NewEchoHandler()
+	handler.Prefix = ""
+	handler.Framing = framing.Config{Mode: framing.LengthPrefix32}
+	addr := startEchoServer(t, handler)
+
+	result, err := Run(context.Background(), Config{
+		Addr:        addr,
+		Messages:    50,
+		MessageSize: 1024,
+		Framing:     framing.Config{Mode: framing.LengthPrefix32},
+	})
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if result.Messages != 50 || result.Bytes != 50*1024 {
+		t.Errorf("Expected 50 messages of 1KiB, got %d messages and %d bytes", result.Messages, result.Bytes)
+	}
+}
+
+func TestRun_DetectsMismatchedEchoes(t *testing.T) {
+	addr := startEchoServer(t, server.NewEchoHandler())
+
+	result, _ := Run(context.Background(), Config{
+		Addr:     addr,
+		Messages: 10,
+		Prefix:   "Wrong: ",
+	})
+	if result.Messages != 0 || result.Errors["mismatch"] != 10 {
+		t.Errorf("Expected 10 mismatches, got %d messages and %v", result.Messages, result.Errors)
+	}
+}
+
+func TestRun_Rate(t *testing.T) {
+	addr := startEchoServer(t, server.NewEchoHandler())
+
+	result, _ := Run(context.Background(), Config{
+		Addr:     addr,
+		Conns:    2,
+		Rate:     100,
+		Duration: 500 * time.Millisecond,
+		Prefix:   "Echo: ",
+	})
+
+	// 100/s for half a second, allowing for scheduling slack
+	if result.Messages < 35 || result.Messages > 60 {
+		t.Errorf("Expected about 50 messages at 100/s, got %d", result.Messages)
+	}
+}
+
+func TestRun_DialErrors(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := listener.Addr().String()
+	listener.Close()
+
+	result, _ := Run(context.Background(), Config{Addr: addr, Conns: 3, Duration: time.Second})
+	if result.Errors["dial"] != 3 {
+		t.Errorf("Expected 3 dial errors, got %v", result.Errors)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := make([]time.Duration, 100)
+	for i := range sorted {
+		sorted[i] = time.Duration(i+1) * time.Millisecond
+	}
+
+	for p, want := range map[float64]time.Duration{50: 50 * time.Millisecond, 90: 90 * time.Millisecond, 99: 99 * time.Millisecond, 100: 100 * time.Millisecond} {
+		if got := percentile(sorted, p); got != want {
+			t.Errorf("p%v = %v, want %v", p, got, want)
+		}
+	}
+}
+
+func TestResult_Output(t *testing.T) {
+	result := newResult(Config{Addr: "localhost:9000", Conns: 1}, []*worker{{
+		latencies: []time.Duration{time.Millisecond, 2 * time.Millisecond},
+		errors:    map[string]int{"timeout": 1},
+	}}, time.Second)
+
+	var text bytes.Buffer
+	result.WriteText(&text)
+	for _, want := range []string{"messages:    2", "p99 2ms", "errors:      1 (timeout=1)"} {
+		if !strings.Contains(text.String(), want) {
+			t.Errorf("Text report missing %q:\n%s", want, text.String())
+		}
+	}
+
+	var buf bytes.Buffer
+	result.WriteJSON(&buf)
+	var decoded Result
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if decoded.Latency.Max != 2*time.Millisecond || decoded.Errors["timeout"] != 1 {
+		t.Errorf("Unexpected decoded result: %+v", decoded)
+	}
+}
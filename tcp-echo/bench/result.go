@@ -0,0 +1,165 @@
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Result summarises a benchmark run
+type Result struct {
+	Addr       string         `json:"addr"`
+	Conns      int            `json:"conns"`
+	Elapsed    time.Duration  `json:"elapsed_ns"`
+	Messages   int            `json:"messages"`
+	Bytes      int64          `json:"bytes"`
+	Throughput float64        `json:"messages_per_second"`
+	Latency    Latency        `json:"latency"`
+	Histogram  []Bucket       `json:"histogram"`
+	Errors     map[string]int `json:"errors"`
+}
+
+// Latency holds percentiles of successful round trips
+type Latency struct {
+	Min  time.Duration `json:"min_ns"`
+	Mean time.Duration `json:"mean_ns"`
+	P50  time.Duration `json:"p50_ns"`
+	P90  time.Duration `json:"p90_ns"`
+	P99  time.Duration `json:"p99_ns"`
+	Max  time.Duration `json:"max_ns"`
+}
+
+// Bucket counts round trips that took at most UpperBound
+type Bucket struct {
+	UpperBound time.Duration `json:"le_ns"`
+	Count      int           `json:"count"`
+}
+
+// ErrorCount returns the total number of errors of any kind
+func (r *Result) ErrorCount() int {
+	total := 0
+	for _, n := range r.Errors {
+		total += n
+	}
+	return total
+}
+
+// newResult merges the workers' samples
+func newResult(config Config, workers []*worker, elapsed time.Duration) *Result {
+	r := &Result{
+		Addr:    config.Addr,
+		Conns:   config.Conns,
+		Elapsed: elapsed,
+		Errors:  make(map[string]int),
+	}
+
+	var latencies []time.Duration
+	for _, w := range workers {
+		latencies = append(latencies, w.latencies...)
+		r.Bytes += w.bytes
+		for op, n := range w.errors {
+			r.Errors[op] += n
+		}
+	}
+
+	r.Messages = len(latencies)
+	if elapsed > 0 {
+		r.Throughput = float64(r.Messages) / elapsed.Seconds()
+	}
+	if len(latencies) == 0 {
+		return r
+	}
+
+	slices.Sort(latencies)
+	var sum time.Duration
+	for _, l := range latencies {
+		sum += l
+	}
+
+	r.Latency = Latency{
+		Min:  latencies[0],
+		Mean: sum / time.Duration(len(latencies)),
+		P50:  percentile(latencies, 50),
+		P90:  percentile(latencies, 90),
+		P99:  percentile(latencies, 99),
+		Max:  latencies[len(latencies)-1],
+	}
+	r.Histogram = histogram(latencies)
+	return r
+}
+
+// percentile returns the nearest-rank percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	rank = max(0, min(rank, len(sorted)-1))
+	return sorted[rank]
+}
+
+// histogram groups sorted latencies into power-of-two buckets starting at
+// 1µs, dropping the empty buckets before the first sample
+func histogram(sorted []time.Duration) []Bucket {
+	var buckets []Bucket
+	bound := time.Microsecond
+	i := 0
+	for i < len(sorted) {
+		count := 0
+		for i < len(sorted) && sorted[i] <= bound {
+			count++
+			i++
+		}
+		if count > 0 || len(buckets) > 0 {
+			buckets = append(buckets, Bucket{UpperBound: bound, Count: count})
+		}
+		bound *= 2
+	}
+	return buckets
+}
+
+// WriteJSON writes the result as indented JSON
+func (r *Result) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteText writes a human readable report
+func (r *Result) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "target:      %s (%d connections)\n", r.Addr, r.Conns)
+	fmt.Fprintf(w, "elapsed:     %s\n", r.Elapsed.Round(time.Millisecond))
+	fmt.Fprintf(w, "messages:    %d (%.0f/s, %.2f MB/s)\n", r.Messages, r.Throughput, float64(r.Bytes)/r.Elapsed.Seconds()/1e6)
+	fmt.Fprintf(w, "latency:     min %s  mean %s  p50 %s  p90 %s  p99 %s  max %s\n",
+		r.Latency.Min, r.Latency.Mean, r.Latency.P50, r.Latency.P90, r.Latency.P99, r.Latency.Max)
+
+	if len(r.Histogram) > 0 {
+		fmt.Fprintln(w, "histogram:")
+		peak := 0
+		for _, b := range r.Histogram {
+			peak = max(peak, b.Count)
+		}
+		for _, b := range r.Histogram {
+			bar := strings.Repeat("#", b.Count*40/peak)
+			fmt.Fprintf(w, "  <= %-10s %8d %s\n", b.UpperBound, b.Count, bar)
+		}
+	}
+
+	if len(r.Errors) == 0 {
+		fmt.Fprintln(w, "errors:      0")
+		return
+	}
+
+	ops := make([]string, 0, len(r.Errors))
+	for op := range r.Errors {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	parts := make([]string, 0, len(ops))
+	for _, op := range ops {
+		parts = append(parts, fmt.Sprintf("%s=%d", op, r.Errors[op]))
+	}
+	fmt.Fprintf(w, "errors:      %d (%s)\n", r.ErrorCount(), strings.Join(parts, " "))
+}
@@ -0,0 +1,213 @@
+// Package chaos injects faults into connections so clients, proxies and health
+// checkers can be tested against misbehaving servers. All randomness comes from
+// a seeded source, so a given seed reproduces the same faults per connection.
+package chaos
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInjectedReset        = errors.New("chaos: injected connection reset")
+	ErrInjectedPartialWrite = errors.New("chaos: injected partial write")
+)
+
+// Injector applies a Config to connections and can be reconfigured at runtime
+type Injector struct {
+	mu     sync.Mutex
+	config Config
+	conns  int64      // Connections wrapped so far, used to derive per-connection seeds
+	rng    *rand.Rand // Shared by datagrams, which have no connection of their own
+}
+
+// NewInjector creates an injector
+func NewInjector(config Config) (*Injector, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &Injector{
+		config: config,
+		rng:    rand.New(rand.NewSource(config.Seed)),
+	}, nil
+}
+
+// Config returns the current configuration
+func (i *Injector) Config() Config {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.config
+}
+
+// SetConfig replaces the configuration and reseeds. Open connections pick up
+// the new rates on their next write; blackholing is decided once per
+// connection.
+func (i *Injector) SetConfig(config Config) error {
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.config = config
+	i.conns = 0
+	i.rng = rand.New(rand.NewSource(config.Seed))
+	return nil
+}
+
+// SetEnabled turns fault injection on or off without changing the rates
+func (i *Injector) SetEnabled(enabled bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.config.Enabled = enabled
+}
+
+// WrapConn returns conn with faults applied to its writes
+func (i *Injector) WrapConn(conn net.Conn) net.Conn {
+	i.mu.Lock()
+	i.conns++
+	seed := i.config.Seed + i.conns
+	config := i.config
+	i.mu.Unlock()
+
+	c := &Conn{Conn: conn, injector: i, seed: seed}
+
+	// The rng is sizeable, so connections only get one once faults may be
+	// injected and cost next to nothing while chaos is off
+	if config.Enabled {
+		c.rng = rand.New(rand.NewSource(seed))
+		c.blackholed = c.rng.Float64() < config.BlackholeRate
+	}
+	return c
+}
+
+// FilterPacket applies faults to a datagram response. It returns nil when the
+// response should be dropped.
+func (i *Injector) FilterPacket(response []byte) []byte {
+	i.mu.Lock()
+	config := i.config
+	if !config.Enabled {
+		i.mu.Unlock()
+		return response
+	}
+
+	drop := i.rng.Float64() < config.BlackholeRate || i.rng.Float64() < config.ResetRate
+	delay := config.Latency.sample(i.rng)
+	if !drop && len(response) > 0 && i.rng.Float64() < config.PartialWriteRate {
+		response = response[:i.rng.Intn(len(response))]
+	}
+	if !drop && i.rng.Float64() < config.CorruptRate {
+		response = corrupt(i.rng, response)
+	}
+	i.mu.Unlock()
+
+	if drop {
+		return nil
+	}
+	time.Sleep(delay)
+	return response
+}
+
+// Conn is a connection with injected faults
+type Conn struct {
+	net.Conn
+	injector   *Injector
+	blackholed bool
+
+	mu   sync.Mutex // Guards rng, which is not safe for concurrent use
+	rng  *rand.Rand // Created from seed on the first write with chaos enabled
+	seed int64
+}
+
+// Write applies latency, resets, partial writes and corruption before writing
+func (c *Conn) Write(p []byte) (int, error) {
+	config := c.injector.Config()
+	if !config.Enabled {
+		return c.Conn.Write(p)
+	}
+
+	// Pretend everything was sent so the handler keeps going
+	if c.blackholed {
+		return len(p), nil
+	}
+
+	c.mu.Lock()
+	if c.rng == nil {
+		c.rng = rand.New(rand.NewSource(c.seed))
+	}
+	delay := config.Latency.sample(c.rng)
+	reset := c.rng.Float64() < config.ResetRate
+	partial := c.rng.Float64() < config.PartialWriteRate
+	corrupted := c.rng.Float64() < config.CorruptRate
+	var cut int
+	if len(p) > 0 {
+		cut = c.rng.Intn(len(p))
+	}
+	data := p
+	if corrupted {
+		data = corrupt(c.rng, p)
+	}
+	c.mu.Unlock()
+
+	time.Sleep(delay)
+
+	if reset {
+		c.reset()
+		return 0, ErrInjectedReset
+	}
+
+	if partial {
+		n, _ := c.Conn.Write(data[:cut])
+		c.Conn.Close()
+		return n, ErrInjectedPartialWrite
+	}
+
+	return c.Conn.Write(data)
+}
+
+// CloseWrite half-closes the underlying connection if it supports it
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// NetConn returns the wrapped connection
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// reset closes the connection with SO_LINGER 0 so the peer gets a RST
+// instead of a FIN
+func (c *Conn) reset() {
+	conn := c.Conn
+	for {
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			tcpConn.SetLinger(0)
+			break
+		}
+
+		// Look through wrappers such as *tls.Conn
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapper.NetConn()
+	}
+	c.Conn.Close()
+}
+
+// corrupt returns a copy of p with one random byte flipped
+func corrupt(rng *rand.Rand, p []byte) []byte {
+	if len(p) == 0 {
+		return p
+	}
+
+	data := append([]byte(nil), p...)
+	data[rng.Intn(len(data))] ^= byte(1 + rng.Intn(255))
+	return data
+}
@@ -0,0 +1,225 @@
+package chaos
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection so resets are real
+func tcpPair(t *testing.T) (server, client net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err = net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return server, client
+}
+
+func TestParseLatency(t *testing.T) {
+	tests := []struct {
+		spec string
+		want LatencyConfig
+	}{
+		{"", LatencyConfig{}},
+		{"fixed:20ms", LatencyConfig{Distribution: LatencyFixed, Fixed: Duration(20 * time.Millisecond)}},
+		{"uniform:10ms-50ms", LatencyConfig{Distribution: LatencyUniform, Min: Duration(10 * time.Millisecond), Max: Duration(50 * time.Millisecond)}},
+		{"normal:50ms,10ms", LatencyConfig{Distribution: LatencyNormal, Mean: Duration(50 * time.Millisecond), StdDev: Duration(10 * time.Millisecond)}},
+		{"exponential:30ms", LatencyConfig{Distribution: LatencyExponential, Mean: Duration(30 * time.Millisecond)}},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseLatency(tt.spec)
+		if err != nil {
+			t.Errorf("ParseLatency(%q) failed: %v", tt.spec, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseLatency(%q) = %+v, want %+v", tt.spec, got, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"pareto:1ms", "uniform:10ms", "fixed:soon"} {
+		if _, err := ParseLatency(spec); err == nil {
+			t.Errorf("Expected ParseLatency(%q) to fail", spec)
+		}
+	}
+}
+
+func TestLatency_SampleStaysInRange(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	uniform := LatencyConfig{Distribution: LatencyUniform, Min: Duration(10 * time.Millisecond), Max: Duration(20 * time.Millisecond)}
+	normal := LatencyConfig{Distribution: LatencyNormal, Mean: Duration(time.Millisecond), StdDev: Duration(10 * time.Millisecond)}
+
+	for range 1000 {
+		if d := uniform.sample(rng); d < 10*time.Millisecond || d > 20*time.Millisecond {
+			t.Fatalf("Uniform sample %v outside [10ms, 20ms]", d)
+		}
+		if d := normal.sample(rng); d < 0 {
+			t.Fatalf("Normal sample %v is negative", d)
+		}
+	}
+}
+
+func TestInjector_Disabled(t *testing.T) {
+	injector, _ := NewInjector(Config{CorruptRate: 1, ResetRate: 1})
+	server, client := tcpPair(t)
+
+	conn := injector.WrapConn(server)
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("Expected untouched data, got %q (%v)", buf, err)
+	}
+
+	// No rng is allocated until faults are turned on
+	if conn.(*Conn).rng != nil {
+		t.Error("Expected no rng while chaos is disabled")
+	}
+	injector.SetEnabled(true)
+	if _, err := conn.Write([]byte("hello")); err != ErrInjectedReset {
+		t.Errorf("Expected faults once enabled, got %v", err)
+	}
+}
+
+func TestInjector_CorruptsDeterministically(t *testing.T) {
+	run := func() []byte {
+		injector, _ := NewInjector(Config{Enabled: true, Seed: 42, CorruptRate: 1})
+		server, client := tcpPair(t)
+
+		payload := []byte("the quick brown fox")
+		injector.WrapConn(server).Write(payload)
+
+		buf := make([]byte, len(payload))
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(buf, payload) {
+			t.Errorf("Expected corrupted data, got %q", buf)
+		}
+		if string(payload) != "the quick brown fox" {
+			t.Error("Caller's buffer was modified")
+		}
+		return buf
+	}
+
+	if first, second := run(), run(); !bytes.Equal(first, second) {
+		t.Errorf("Same seed gave different corruption: %q vs %q", first, second)
+	}
+}
+
+func TestInjector_Reset(t *testing.T) {
+	injector, _ := NewInjector(Config{Enabled: true, ResetRate: 1})
+	server, client := tcpPair(t)
+
+	if _, err := injector.WrapConn(server).Write([]byte("hello")); err != ErrInjectedReset {
+		t.Fatalf("Expected ErrInjectedReset, got %v", err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := client.Read(make([]byte, 1))
+	if err == nil || !strings.Contains(err.Error(), "reset") {
+		t.Errorf("Expected connection reset, got %v", err)
+	}
+}
+
+func TestInjector_PartialWrite(t *testing.T) {
+	injector, _ := NewInjector(Config{Enabled: true, PartialWriteRate: 1})
+	server, client := tcpPair(t)
+
+	payload := []byte("0123456789")
+	n, err := injector.WrapConn(server).Write(payload)
+	if err != ErrInjectedPartialWrite || n >= len(payload) {
+		t.Fatalf("Expected a short write, got n=%d err=%v", n, err)
+	}
+
+	got, _ := io.ReadAll(client)
+	if !bytes.Equal(got, payload[:n]) {
+		t.Errorf("Expected %q, got %q", payload[:n], got)
+	}
+}
+
+func TestInjector_Blackhole(t *testing.T) {
+	injector, _ := NewInjector(Config{Enabled: true, BlackholeRate: 1})
+	server, client := tcpPair(t)
+
+	if n, err := injector.WrapConn(server).Write([]byte("hello")); n != 5 || err != nil {
+		t.Fatalf("Expected write to appear successful, got n=%d err=%v", n, err)
+	}
+
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, _ := client.Read(make([]byte, 5)); n != 0 {
+		t.Errorf("Expected no data from a blackholed connection, got %d bytes", n)
+	}
+}
+
+func TestInjector_Latency(t *testing.T) {
+	injector, _ := NewInjector(Config{
+		Enabled: true,
+		Latency: LatencyConfig{Distribution: LatencyFixed, Fixed: Duration(50 * time.Millisecond)},
+	})
+	server, _ := tcpPair(t)
+
+	start := time.Now()
+	injector.WrapConn(server).Write([]byte("x"))
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected at least 50ms delay, got %v", elapsed)
+	}
+}
+
+func TestInjector_RejectsInvalidRates(t *testing.T) {
+	if _, err := NewInjector(Config{ResetRate: 1.5}); err == nil {
+		t.Error("Expected an error for a rate above 1")
+	}
+}
+
+func TestHandler_TogglesAtRuntime(t *testing.T) {
+	a, _ := NewInjector(Config{})
+	b, _ := NewInjector(Config{})
+	server := httptest.NewServer(Handler(map[string]*Injector{"tcp://:9000": a, "udp://:9000": b}))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/chaos/enable?listener=tcp://:9000", "", nil)
+	if err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Enable failed: %v %v", resp, err)
+	}
+	if !a.Config().Enabled || b.Config().Enabled {
+		t.Errorf("Expected only the tcp listener enabled, got %v and %v", a.Config().Enabled, b.Config().Enabled)
+	}
+
+	body := `{"enabled":true,"seed":7,"reset_rate":0.25,"latency":{"distribution":"fixed","fixed":"15ms"}}`
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/chaos", strings.NewReader(body))
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT failed: %v %v", resp, err)
+	}
+	if config := b.Config(); config.ResetRate != 0.25 || config.Latency.Fixed != Duration(15*time.Millisecond) {
+		t.Errorf("Config not applied: %+v", config)
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, server.URL+"/chaos", strings.NewReader(`{"corrupt_rate":2}`))
+	if resp, _ := http.DefaultClient.Do(req); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid rate, got %d", resp.StatusCode)
+	}
+}
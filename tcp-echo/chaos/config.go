@@ -0,0 +1,145 @@
+package chaos
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration that reads and writes JSON as "50ms"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Latency distributions
+const (
+	LatencyNone        = ""
+	LatencyFixed       = "fixed"
+	LatencyUniform     = "uniform"
+	LatencyNormal      = "normal"
+	LatencyExponential = "exponential"
+)
+
+// LatencyConfig describes the delay added before each write
+type LatencyConfig struct {
+	Distribution string   `json:"distribution"`
+	Fixed        Duration `json:"fixed,omitempty"`  // fixed
+	Min          Duration `json:"min,omitempty"`    // uniform
+	Max          Duration `json:"max,omitempty"`    // uniform
+	Mean         Duration `json:"mean,omitempty"`   // normal, exponential
+	StdDev       Duration `json:"stddev,omitempty"` // normal
+}
+
+// ParseLatency parses "fixed:20ms", "uniform:10ms-50ms", "normal:50ms,10ms"
+// or "exponential:30ms". An empty string disables latency.
+func ParseLatency(spec string) (LatencyConfig, error) {
+	if spec == "" {
+		return LatencyConfig{}, nil
+	}
+
+	distribution, args, _ := strings.Cut(spec, ":")
+	config := LatencyConfig{Distribution: distribution}
+
+	var values []string
+	switch distribution {
+	case LatencyFixed, LatencyExponential:
+		values = []string{args}
+	case LatencyUniform:
+		values = strings.Split(args, "-")
+	case LatencyNormal:
+		values = strings.Split(args, ",")
+	default:
+		return LatencyConfig{}, fmt.Errorf("unknown latency distribution %q", distribution)
+	}
+
+	durations := make([]Duration, 0, len(values))
+	for _, value := range values {
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return LatencyConfig{}, fmt.Errorf("invalid latency %q: %v", spec, err)
+		}
+		durations = append(durations, Duration(d))
+	}
+
+	switch {
+	case distribution == LatencyFixed:
+		config.Fixed = durations[0]
+	case distribution == LatencyExponential:
+		config.Mean = durations[0]
+	case len(durations) != 2:
+		return LatencyConfig{}, fmt.Errorf("%s latency needs two values, got %q", distribution, spec)
+	case distribution == LatencyUniform:
+		config.Min, config.Max = durations[0], durations[1]
+	case distribution == LatencyNormal:
+		config.Mean, config.StdDev = durations[0], durations[1]
+	}
+
+	return config, nil
+}
+
+// sample draws a delay from the distribution, never negative
+func (l LatencyConfig) sample(rng *rand.Rand) time.Duration {
+	var d float64
+	switch l.Distribution {
+	case LatencyFixed:
+		d = float64(l.Fixed)
+	case LatencyUniform:
+		d = float64(l.Min) + rng.Float64()*float64(l.Max-l.Min)
+	case LatencyNormal:
+		d = float64(l.Mean) + rng.NormFloat64()*float64(l.StdDev)
+	case LatencyExponential:
+		d = rng.ExpFloat64() * float64(l.Mean)
+	}
+	return time.Duration(math.Max(d, 0))
+}
+
+// Config holds the faults to inject. Rates are probabilities between 0 and 1.
+type Config struct {
+	Enabled bool          `json:"enabled"`
+	Seed    int64         `json:"seed"`
+	Latency LatencyConfig `json:"latency"`
+
+	ResetRate        float64 `json:"reset_rate"`         // Per write: abort the connection with a TCP RST
+	PartialWriteRate float64 `json:"partial_write_rate"` // Per write: send only part of the data, then close
+	CorruptRate      float64 `json:"corrupt_rate"`       // Per write: flip one random byte
+	BlackholeRate    float64 `json:"blackhole_rate"`     // Per connection: accept but never respond
+}
+
+// Validate checks that every rate is a probability
+func (c Config) Validate() error {
+	rates := map[string]float64{
+		"reset_rate":         c.ResetRate,
+		"partial_write_rate": c.PartialWriteRate,
+		"corrupt_rate":       c.CorruptRate,
+		"blackhole_rate":     c.BlackholeRate,
+	}
+	for name, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("%s must be between 0 and 1, got %v", name, rate)
+		}
+	}
+
+	if c.Latency.Distribution == LatencyUniform && c.Latency.Max < c.Latency.Min {
+		return fmt.Errorf("uniform latency max is below min")
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package chaos
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Handler exposes the injectors of every listener at /chaos:
+//
+//	GET  /chaos                      current config of every listener
+//	PUT  /chaos?listener=<name>      replace the config (all listeners if omitted)
+//	POST /chaos/enable?listener=...  turn injection on
+//	POST /chaos/disable?listener=... turn injection off
+func Handler(injectors map[string]*Injector) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /chaos", func(w http.ResponseWriter, r *http.Request) {
+		configs := make(map[string]Config, len(injectors))
+		for name, injector := range injectors {
+			configs[name] = injector.Config()
+		}
+		writeJSON(w, configs)
+	})
+	mux.HandleFunc("PUT /chaos", func(w http.ResponseWriter, r *http.Request) {
+		var config Config
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			http.Error(w, fmt.Sprintf("invalid config: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		selected, err := selectInjectors(injectors, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		for _, injector := range selected {
+			if err := injector.SetConfig(config); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, config)
+	})
+	for action, enabled := range map[string]bool{"enable": true, "disable": false} {
+		mux.HandleFunc("POST /chaos/"+action, func(w http.ResponseWriter, r *http.Request) {
+			selected, err := selectInjectors(injectors, r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			for _, injector := range selected {
+				injector.SetEnabled(enabled)
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+	return mux
+}
+
+// selectInjectors returns the injector named by the listener query parameter,
+// or all of them when it is empty
+func selectInjectors(injectors map[string]*Injector, r *http.Request) ([]*Injector, error) {
+	name := r.URL.Query().Get("listener")
+	if name == "" {
+		all := make([]*Injector, 0, len(injectors))
+		for _, injector := range injectors {
+			all = append(all, injector)
+		}
+		return all, nil
+	}
+
+	injector, exists := injectors[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown listener %q", name)
+	}
+	return []*Injector{injector}, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
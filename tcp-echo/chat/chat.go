@@ -0,0 +1,309 @@
+// Package chat fans lines from one client out to every other client in the
+// same room. Each client has a bounded outbound queue; a client that reads
+// too slowly to keep up is disconnected rather than stalling the room.
+package chat
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"tcp-echo/framing"
+	"tcp-echo/metrics"
+	"tcp-echo/ratelimit"
+)
+
+// ErrSlowConsumer is returned by ServeConn when a client's queue overflowed
+var ErrSlowConsumer = errors.New("slow consumer, outbound queue full")
+
+// DefaultRoom is where clients start
+const DefaultRoom = "lobby"
+
+// Config holds configuration for the chat hub
+type Config struct {
+	QueueSize   int // Messages buffered per client before it is disconnected, defaults to 64
+	MaxLineSize int // Longest accepted line, defaults to framing.DefaultMaxFrameSize
+}
+
+// Hub tracks rooms and their members. It implements server.Handler.
+type Hub struct {
+	queueSize   int
+	maxLineSize int
+
+	mu    sync.RWMutex
+	rooms map[string]map[*client]struct{}
+}
+
+// NewHub creates a hub with no clients
+func NewHub(config Config) *Hub {
+	h := &Hub{
+		queueSize:   config.QueueSize,
+		maxLineSize: config.MaxLineSize,
+		rooms:       make(map[string]map[*client]struct{}),
+	}
+
+	// Set defaults
+	if h.queueSize <= 0 {
+		h.queueSize = 64
+	}
+	if h.maxLineSize <= 0 {
+		h.maxLineSize = framing.DefaultMaxFrameSize
+	}
+
+	return h
+}
+
+// client is one connection's membership and outbound queue
+type client struct {
+	conn net.Conn
+	name string
+	room string // Guarded by Hub.mu
+
+	out  chan []byte
+	done chan struct{}
+	once sync.Once
+	err  error // Why the client was kicked, set before done is closed
+}
+
+// send queues a message without blocking, kicking the client if its queue is full
+func (c *client) send(msg []byte) {
+	select {
+	case c.out <- msg:
+	case <-c.done:
+	default:
+		c.kick(ErrSlowConsumer)
+	}
+}
+
+// kick disconnects the client; the reader notices and cleans up
+func (c *client) kick(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+// writeLoop drains the outbound queue to the connection
+func (c *client) writeLoop() {
+	for {
+		select {
+		case msg := <-c.out:
+			if _, err := c.conn.Write(msg); err != nil {
+				c.kick(err)
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// ServeConn joins the client to the default room and relays its lines until
+// it disconnects, is kicked or ctx is cancelled
+func (h *Hub) ServeConn(ctx context.Context, conn net.Conn) error {
+	framer, err := framing.New(conn, framing.Config{Mode: framing.Newline, MaxFrameSize: h.maxLineSize})
+	if err != nil {
+		return err
+	}
+
+	// Clients may only listen, so broadcasts they receive keep them from
+	// timing out as idle
+	if activity, ok := conn.(interface{ CountWritesAsActivity() }); ok {
+		activity.CountWritesAsActivity()
+	}
+
+	c := &client{
+		conn: conn,
+		name: conn.RemoteAddr().String(),
+		out:  make(chan []byte, h.queueSize),
+		done: make(chan struct{}),
+	}
+
+	writerDone := make(chan struct{})
+	go func() {
+		defer close(writerDone)
+		c.writeLoop()
+	}()
+	defer func() {
+		h.leave(c)
+		c.kick(nil)
+		<-writerDone
+	}()
+
+	c.send(notice("welcome %s, you are in #%s (/join <room>, /nick <name>, /who, /rooms, /quit)", c.name, DefaultRoom))
+	h.join(c, DefaultRoom)
+
+	limiter := ratelimit.MessagesFromContext(ctx)
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		line, err := framer.ReadFrame()
+		if err != nil {
+			// A kicked client's read fails because we closed it; report why
+			select {
+			case <-c.done:
+				if c.err != nil {
+					return c.err
+				}
+			default:
+			}
+			return err
+		}
+
+		switch err := limiter.Wait(ctx); {
+		case errors.Is(err, ratelimit.ErrDropped):
+			continue
+		case err != nil:
+			return err
+		}
+		metrics.ConnFromContext(ctx).AddFrame()
+
+		text := strings.TrimSuffix(string(line), "\r")
+		if strings.HasPrefix(text, "/") {
+			if quit := h.command(c, text); quit {
+				return nil
+			}
+			continue
+		}
+
+		h.broadcast(c, []byte(fmt.Sprintf("[%s] %s\n", c.name, text)))
+	}
+}
+
+// command handles a /command line. It returns true for /quit.
+func (h *Hub) command(c *client, line string) bool {
+	name, arg, _ := strings.Cut(line, " ")
+	arg = strings.TrimSpace(arg)
+
+	switch name {
+	case "/join":
+		if arg == "" {
+			c.send(notice("usage: /join <room>"))
+			return false
+		}
+		h.join(c, strings.TrimPrefix(arg, "#"))
+	case "/nick":
+		if arg == "" {
+			c.send(notice("usage: /nick <name>"))
+			return false
+		}
+		h.mu.Lock()
+		old := c.name
+		c.name = arg
+		room := c.room
+		h.mu.Unlock()
+		h.announce(room, notice("%s is now known as %s", old, arg))
+	case "/who":
+		c.send(notice("in #%s: %s", h.roomOf(c), strings.Join(h.members(h.roomOf(c)), ", ")))
+	case "/rooms":
+		c.send(notice("rooms: %s", strings.Join(h.Rooms(), ", ")))
+	case "/quit":
+		return true
+	default:
+		c.send(notice("unknown command %s", name))
+	}
+	return false
+}
+
+// join moves c into room, leaving its current room
+func (h *Hub) join(c *client, room string) {
+	h.leave(c)
+
+	h.mu.Lock()
+	members, exists := h.rooms[room]
+	if !exists {
+		members = make(map[*client]struct{})
+		h.rooms[room] = members
+	}
+	members[c] = struct{}{}
+	c.room = room
+	h.mu.Unlock()
+
+	h.announce(room, notice("%s joined #%s", c.name, room))
+}
+
+// leave removes c from its room, deleting the room once it is empty
+func (h *Hub) leave(c *client) {
+	h.mu.Lock()
+	room := c.room
+	members := h.rooms[room]
+	if _, ok := members[c]; !ok {
+		h.mu.Unlock()
+		return
+	}
+	delete(members, c)
+	if len(members) == 0 {
+		delete(h.rooms, room)
+	}
+	c.room = ""
+	h.mu.Unlock()
+
+	h.announce(room, notice("%s left #%s", c.name, room))
+}
+
+// broadcast sends msg to everyone in the sender's room except the sender
+func (h *Hub) broadcast(from *client, msg []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for c := range h.rooms[from.room] {
+		if c != from {
+			c.send(msg)
+		}
+	}
+}
+
+// announce sends msg to everyone in room
+func (h *Hub) announce(room string, msg []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for c := range h.rooms[room] {
+		c.send(msg)
+	}
+}
+
+// roomOf returns the room c is in
+func (h *Hub) roomOf(c *client) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return c.room
+}
+
+// members returns the sorted names of everyone in room
+func (h *Hub) members(room string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	names := make([]string, 0, len(h.rooms[room]))
+	for c := range h.rooms[room] {
+		names = append(names, c.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Rooms returns the sorted names of rooms with at least one member
+func (h *Hub) Rooms() []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	rooms := make([]string, 0, len(h.rooms))
+	for room := range h.rooms {
+		rooms = append(rooms, "#"+room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// notice formats a message from the server itself
+func notice(format string, args ...any) []byte {
+	return []byte("* " + fmt.Sprintf(format, args...) + "\n")
+}
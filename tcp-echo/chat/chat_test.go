@@ -0,0 +1,152 @@
+package chat
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testClient struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	result chan error
+}
+
+// connect attaches a pipe to the hub and skips the welcome and join notices
+func connect(t *testing.T, h *Hub) *testClient {
+	t.Helper()
+
+	client, server := net.Pipe()
+	c := &testClient{conn: client, r: bufio.NewReader(client), result: make(chan error, 1)}
+	go func() {
+		defer server.Close()
+		c.result <- h.ServeConn(context.Background(), server)
+	}()
+	t.Cleanup(func() { client.Close() })
+
+	c.expect(t, "* welcome")
+	c.expect(t, "joined #lobby")
+	return c
+}
+
+func (c *testClient) send(t *testing.T, line string) {
+	t.Helper()
+	if _, err := fmt.Fprintf(c.conn, "%s\n", line); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+}
+
+// expect reads lines until one contains want
+func (c *testClient) expect(t *testing.T, want string) string {
+	t.Helper()
+
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Expected a line containing %q: %v", want, err)
+		}
+		if strings.Contains(line, want) {
+			return line
+		}
+	}
+}
+
+func TestHub_BroadcastsToOthers(t *testing.T) {
+	h := NewHub(Config{})
+	alice := connect(t, h)
+	bob := connect(t, h)
+	alice.expect(t, "joined #lobby")
+
+	alice.send(t, "/nick alice")
+	bob.expect(t, "is now known as alice")
+
+	alice.send(t, "hello")
+	if line := bob.expect(t, "hello"); line != "[alice] hello\n" {
+		t.Errorf("Unexpected broadcast %q", line)
+	}
+
+	// The sender does not get its own message back
+	alice.send(t, "/who")
+	if line := alice.expect(t, "in #lobby"); !strings.Contains(line, "alice") {
+		t.Errorf("Unexpected /who reply %q", line)
+	}
+}
+
+func TestHub_Rooms(t *testing.T) {
+	h := NewHub(Config{})
+	alice := connect(t, h)
+	bob := connect(t, h)
+	carol := connect(t, h)
+
+	alice.send(t, "/join go")
+	alice.expect(t, "joined #go")
+	bob.send(t, "/join #go")
+	alice.expect(t, "joined #go")
+
+	alice.send(t, "gophers only")
+	bob.expect(t, "gophers only")
+
+	bob.send(t, "/rooms")
+	if line := bob.expect(t, "rooms:"); line != "* rooms: #go, #lobby\n" {
+		t.Errorf("Unexpected /rooms reply %q", line)
+	}
+
+	// The lobby doesn't hear the room, so carol's next line is her own /who
+	carol.send(t, "/who")
+	carol.expect(t, "left #lobby")
+	carol.expect(t, "left #lobby")
+	carol.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if line, _ := carol.r.ReadString('\n'); !strings.HasPrefix(line, "* in #lobby") {
+		t.Errorf("Expected only the /who reply, got %q", line)
+	}
+}
+
+func TestHub_DisconnectsSlowConsumer(t *testing.T) {
+	h := NewHub(Config{QueueSize: 2})
+	fast := connect(t, h)
+	slow := connect(t, h)
+	fast.expect(t, "joined #lobby")
+
+	// slow never reads again, so its writer blocks and the queue fills up
+	for i := range 10 {
+		fast.send(t, fmt.Sprintf("message %d", i))
+	}
+
+	select {
+	case err := <-slow.result:
+		if err != ErrSlowConsumer {
+			t.Errorf("Expected ErrSlowConsumer, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Slow consumer was not disconnected")
+	}
+
+	// Everyone else keeps chatting
+	fast.send(t, "/who")
+	if line := fast.expect(t, "in #lobby"); strings.Count(line, ",") != 0 {
+		t.Errorf("Slow consumer still listed: %q", line)
+	}
+}
+
+func TestHub_Quit(t *testing.T) {
+	h := NewHub(Config{})
+	c := connect(t, h)
+	c.send(t, "/quit")
+
+	select {
+	case err := <-c.result:
+		if err != nil {
+			t.Errorf("Expected a clean exit, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Handler did not return after /quit")
+	}
+	if len(h.Rooms()) != 0 {
+		t.Errorf("Expected empty rooms to be removed, got %v", h.Rooms())
+	}
+}
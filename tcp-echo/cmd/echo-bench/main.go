@@ -0,0 +1,91 @@
+// echo-bench is a load generator for tcp-echo. It opens concurrent
+// connections, sends messages at a target rate or as fast as possible,
+// verifies every echo and reports throughput and latency percentiles.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"tcp-echo/bench"
+	"tcp-echo/framing"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:9000", "Server address (a socket path with -network=unix)")
+	network := flag.String("network", "tcp", "Network: tcp or unix")
+	conns := flag.Int("c", 10, "Concurrent connections")
+	duration := flag.Duration("d", 10*time.Second, "How long to run")
+	messages := flag.Int("n", 0, "Stop after this many messages in total (0 = run for -d)")
+	rate := flag.Float64("rate", 0, "Target messages per second across all connections (0 = as fast as possible)")
+	size := flag.Int("size", 64, "Payload size in bytes")
+	framingMode := flag.String("framing", "newline", "Frame format, must match the server: newline, len16, len32 or fixed")
+	prefix := flag.String("prefix", "", "Prefix the server adds to each echo (defaults to \"Echo: \" for newline framing)")
+	timeout := flag.Duration("timeout", 5*time.Second, "How long to wait for each echo")
+	jsonOutput := flag.Bool("json", false, "Print the report as JSON")
+	flag.Parse()
+
+	mode, err := framing.ParseMode(*framingMode)
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
+	// Match the server's defaults: newline echoes are prefixed, binary ones are not
+	expectPrefix := *prefix
+	if !isFlagSet("prefix") && mode == framing.Newline {
+		expectPrefix = "Echo: "
+	}
+
+	config := bench.Config{
+		Network:     *network,
+		Addr:        *addr,
+		Conns:       *conns,
+		Duration:    *duration,
+		Messages:    *messages,
+		Rate:        *rate,
+		MessageSize: *size,
+		Framing: framing.Config{
+			Mode:         mode,
+			MaxFrameSize: max(*size+len(expectPrefix), framing.DefaultMaxFrameSize),
+			FrameSize:    *size,
+		},
+		Prefix:      expectPrefix,
+		ReadTimeout: *timeout,
+	}
+
+	// ^C stops early but still prints the report
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	result, err := bench.Run(ctx, config)
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
+	if *jsonOutput {
+		result.WriteJSON(os.Stdout)
+	} else {
+		result.WriteText(os.Stdout)
+	}
+
+	if result.ErrorCount() > 0 {
+		os.Exit(1)
+	}
+}
+
+// isFlagSet reports whether name was passed on the command line
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
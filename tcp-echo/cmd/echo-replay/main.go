@@ -0,0 +1,85 @@
+// echo-replay re-sends the requests in a recording made with -record to a
+// server and reports every response that differs from the recorded one.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"tcp-echo/record"
+)
+
+func main() {
+	file := flag.String("file", "", "Recording made with -record (jsonl or pcap)")
+	addr := flag.String("addr", "localhost:9000", "Server to replay against (a socket path with -network=unix)")
+	network := flag.String("network", "tcp", "Network: tcp or unix")
+	conn := flag.Uint64("conn", 0, "Only replay this connection id (0 = all)")
+	speed := flag.Float64("speed", 0, "Keep the recorded gaps between requests at this multiple, e.g. 1 for real time (0 = no delays)")
+	timeout := flag.Duration("timeout", 2*time.Second, "How long to wait for each response")
+	list := flag.Bool("list", false, "List the recorded connections and exit")
+	flag.Parse()
+
+	if *file == "" {
+		fmt.Println("error: -file is required")
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	sessions, err := record.ReadFile(*file)
+	if err != nil {
+		fmt.Println("failed to read recording, err:", err)
+		os.Exit(1)
+	}
+
+	if *list {
+		for _, session := range sessions {
+			fmt.Printf("conn %d from %s: %d events\n", session.Conn, session.Remote, len(session.Events))
+		}
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	config := record.ReplayConfig{
+		Network:     *network,
+		Addr:        *addr,
+		Speed:       *speed,
+		ReadTimeout: *timeout,
+	}
+
+	var replayed, failed int
+	for _, session := range sessions {
+		if *conn != 0 && session.Conn != *conn {
+			continue
+		}
+		replayed++
+
+		result, err := record.Replay(ctx, session, config)
+		if err != nil {
+			fmt.Printf("conn %d: failed to replay, err: %v\n", session.Conn, err)
+			failed++
+			continue
+		}
+
+		if len(result.Mismatches) == 0 {
+			fmt.Printf("conn %d: %d exchanges match\n", result.Conn, result.Exchanges)
+			continue
+		}
+
+		failed++
+		fmt.Printf("conn %d: %d of %d exchanges differ\n", result.Conn, len(result.Mismatches), result.Exchanges)
+		for _, mismatch := range result.Mismatches {
+			fmt.Printf("  %s\n", mismatch)
+		}
+	}
+
+	fmt.Printf("replayed %d connections, %d differ\n", replayed, failed)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
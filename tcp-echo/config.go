@@ -0,0 +1,386 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"tcp-echo/chaos"
+	"tcp-echo/framing"
+	"tcp-echo/l4proxy"
+	"tcp-echo/proxyproto"
+	"tcp-echo/ratelimit"
+	"tcp-echo/record"
+	"tcp-echo/server"
+)
+
+// Listener is a network/address pair to serve on
+type Listener struct {
+	Network string
+	Addr    string
+	Socket  server.SocketOptions // From the query string, e.g. tcp://:9000?nodelay=false
+}
+
+func (l Listener) String() string {
+	return l.Network + "://" + l.Addr
+}
+
+// IsStream reports whether the listener accepts connections rather than datagrams
+func (l Listener) IsStream() bool {
+	return !strings.HasPrefix(l.Network, "udp")
+}
+
+// listenFlags collects repeated -listen flags
+type listenFlags []string
+
+func (f *listenFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *listenFlags) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// Handler modes selected with -mode
+const (
+	ModeEcho = "echo"
+	ModeRESP = "resp"
+	ModeChat = "chat"
+)
+
+type Config struct {
+	Mode          string
+	ChatQueue     int
+	Listeners     []Listener
+	DrainTimeout  time.Duration
+	IdleTimeout   time.Duration
+	WriteTimeout  time.Duration
+	Framing       framing.Mode
+	MaxFrameSize  int
+	FrameSize     int
+	MaxConns      int
+	MaxConnsPerIP int
+	Admission     server.AdmissionPolicy
+	SocketMode    os.FileMode
+	MaxDatagram   int
+
+	ConnRate          int
+	ConnRateWindow    time.Duration
+	ConnRateAlgorithm string
+	MessageRate       ratelimit.MessageConfig
+
+	Upstreams   []string
+	Balance     l4proxy.Strategy
+	DialTimeout time.Duration
+
+	ProxyProtocol   bool
+	TrustedProxies  []*net.IPNet
+	SendProxyHeader bool
+	EchoClientAddr  bool
+
+	StatsAddr  string
+	LogPayload bool
+
+	Sniff        bool
+	SniffTimeout time.Duration
+
+	Reactor      bool
+	ReactorLoops int
+
+	Chaos chaos.Config
+
+	Record       string
+	RecordFormat record.Format
+
+	TLSCert       string
+	TLSKey        string
+	TLSClientCA   string
+	TLSMinVersion uint16
+	GenCert       bool
+}
+
+func ParseConfig() (*Config, error) {
+	var listens listenFlags
+	flag.Var(&listens, "listen", "Listener as network://address[?options], repeatable (tcp://:9000, udp://:9000, unix:///tmp/echo.sock, tcp://[::]:9000?v6only=true&keepalive=30s)")
+	mode := flag.String("mode", ModeEcho, "What to serve: echo, resp (Redis-compatible key/value store) or chat (broadcast rooms)")
+	chatQueue := flag.Int("chat-queue", 64, "In chat mode, messages queued per client before a slow reader is disconnected")
+	port := flag.String("port", "", "TCP port to listen on, shorthand for -listen=tcp://:<port>")
+	drainTimeout := flag.Duration("drain-timeout", 10*time.Second, "How long to wait for open connections on shutdown")
+	idleTimeout := flag.Duration("idle-timeout", 5*time.Minute, "Close connections idle for this long (0 disables)")
+	writeTimeout := flag.Duration("write-timeout", 10*time.Second, "Deadline for each write to a client (0 disables)")
+	framingMode := flag.String("framing", "newline", "Frame format: newline, len16, len32 or fixed")
+	maxFrameSize := flag.Int("max-frame", 64*1024, "Maximum frame payload in bytes")
+	flag.IntVar(maxFrameSize, "max-line", 64*1024, "Deprecated: use -max-frame")
+	frameSize := flag.Int("frame-size", 0, "Frame size in bytes for -framing=fixed")
+	maxConns := flag.Int("max-conns", 0, "Maximum concurrent connections across all listeners (0 = unlimited)")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 0, "Maximum concurrent connections per source IP across all listeners (0 = unlimited)")
+	admission := flag.String("admission", "reject", "What to do over -max-conns: reject or queue")
+	connRate := flag.Int("conn-rate", 0, "New connections allowed per source IP per -conn-rate-window (0 = unlimited)")
+	connRateWindow := flag.Duration("conn-rate-window", time.Minute, "Window for -conn-rate")
+	connRateAlgorithm := flag.String("conn-rate-algorithm", ratelimit.SlidingWindow, "Algorithm for -conn-rate: fixed, sliding or token")
+	msgRate := flag.Int("msg-rate", 0, "Messages per second each connection may send (0 = unlimited)")
+	msgBurst := flag.Int("msg-burst", 0, "Messages allowed back to back under -msg-rate (default: the rate)")
+	msgRateAction := flag.String("msg-rate-action", "delay", "What to do with messages over -msg-rate: delay, drop or disconnect")
+	socketMode := flag.String("socket-mode", "0666", "Permissions for unix socket files (octal)")
+	maxDatagram := flag.Int("max-datagram", server.DefaultMaxDatagramSize, "Largest UDP datagram in bytes")
+	upstreams := flag.String("upstreams", "", "Comma-separated upstream host:port list, enables L4 proxy mode")
+	balance := flag.String("balance", "round-robin", "Upstream selection: round-robin or least-conn")
+	dialTimeout := flag.Duration("dial-timeout", 2*time.Second, "Skip upstreams that don't accept within this time")
+	proxyProtocol := flag.Bool("proxy-protocol", false, "Read PROXY protocol v1/v2 headers from trusted proxies")
+	trustedProxies := flag.String("trusted-proxies", "127.0.0.1,::1", "Comma-separated IPs/CIDRs allowed to send PROXY headers")
+	sendProxyHeader := flag.Bool("send-proxy-header", false, "In L4 proxy mode, send a PROXY v1 header to upstreams")
+	echoClientAddr := flag.Bool("echo-client-addr", false, "Prefix echoed frames with the client address")
+	statsAddr := flag.String("stats-addr", "", "Serve /metrics (Prometheus), /stats (JSON) and /chaos on this address, e.g. :9100")
+	sniffProtocols := flag.Bool("sniff", false, "Also serve HTTP (/health, /metrics, /stats, /chaos) and WebSocket echo (/ws) on stream listeners")
+	sniffTimeout := flag.Duration("sniff-timeout", time.Second, "With -sniff, treat clients silent for this long as raw TCP")
+	logPayload := flag.Bool("log-payload", false, "Log every request and response payload")
+	reactorMode := flag.Bool("reactor", false, "Serve newline echo from epoll event loops instead of a goroutine per connection (Linux, tcp only)")
+	reactorLoops := flag.Int("reactor-loops", 0, "Event loops per listener with -reactor (0 = one per CPU)")
+	chaosEnabled := flag.Bool("chaos", false, "Inject faults into responses (configure with -chaos-* flags or PUT /chaos on -stats-addr)")
+	chaosSeed := flag.Int64("chaos-seed", 1, "Seed for fault injection, the same seed reproduces the same faults")
+	chaosLatency := flag.String("chaos-latency", "", "Latency per write: fixed:20ms, uniform:10ms-50ms, normal:50ms,10ms or exponential:30ms")
+	chaosReset := flag.Float64("chaos-reset", 0, "Probability per write of resetting the connection")
+	chaosPartial := flag.Float64("chaos-partial", 0, "Probability per write of sending part of the data and closing")
+	chaosCorrupt := flag.Float64("chaos-corrupt", 0, "Probability per write of flipping a byte")
+	chaosBlackhole := flag.Float64("chaos-blackhole", 0, "Probability per connection of never responding")
+	recordPath := flag.String("record", "", "Record every connection's traffic to this file for echo-replay")
+	recordFormat := flag.String("record-format", "jsonl", "Recording format: jsonl or pcap")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file, enables TLS")
+	tlsKey := flag.String("tls-key", "", "PEM private key file")
+	tlsClientCA := flag.String("tls-client-ca", "", "PEM CA file, requires client certificates (mTLS)")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	genCert := flag.Bool("gen-cert", false, "Write a self-signed pair to -tls-cert/-tls-key and exit")
+
+	flag.Parse()
+
+	// Keep supporting the original `go run . <port>` form
+	if *port == "" && flag.NArg() > 0 {
+		*port = flag.Arg(0)
+	}
+	if *port != "" {
+		listens = append(listens, "tcp://:"+*port)
+	}
+
+	config := &Config{
+		Mode:            *mode,
+		Record:          *recordPath,
+		ChatQueue:       *chatQueue,
+		DrainTimeout:    *drainTimeout,
+		IdleTimeout:     *idleTimeout,
+		WriteTimeout:    *writeTimeout,
+		MaxFrameSize:    *maxFrameSize,
+		FrameSize:       *frameSize,
+		MaxConns:        *maxConns,
+		MaxConnsPerIP:   *maxConnsPerIP,
+		MaxDatagram:     *maxDatagram,
+		Balance:         l4proxy.Strategy(*balance),
+		DialTimeout:     *dialTimeout,
+		ProxyProtocol:   *proxyProtocol,
+		SendProxyHeader: *sendProxyHeader,
+		EchoClientAddr:  *echoClientAddr,
+		StatsAddr:       *statsAddr,
+		LogPayload:      *logPayload,
+		Sniff:           *sniffProtocols,
+		SniffTimeout:    *sniffTimeout,
+		Reactor:         *reactorMode,
+		ReactorLoops:    *reactorLoops,
+		TLSCert:         *tlsCert,
+		TLSKey:          *tlsKey,
+		TLSClientCA:     *tlsClientCA,
+		GenCert:         *genCert,
+		Chaos: chaos.Config{
+			Enabled:          *chaosEnabled,
+			Seed:             *chaosSeed,
+			ResetRate:        *chaosReset,
+			PartialWriteRate: *chaosPartial,
+			CorruptRate:      *chaosCorrupt,
+			BlackholeRate:    *chaosBlackhole,
+		},
+
+		ConnRate:          *connRate,
+		ConnRateWindow:    *connRateWindow,
+		ConnRateAlgorithm: *connRateAlgorithm,
+		MessageRate: ratelimit.MessageConfig{
+			Rate:  *msgRate,
+			Burst: *msgBurst,
+		},
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return nil, fmt.Errorf("tls-cert and tls-key must be set together")
+	}
+
+	if *genCert {
+		if *tlsCert == "" {
+			return nil, fmt.Errorf("gen-cert needs -tls-cert and -tls-key")
+		}
+		return config, nil
+	}
+
+	if len(listens) == 0 {
+		return nil, fmt.Errorf("a port or at least one -listen is required")
+	}
+
+	for _, listen := range listens {
+		listener, err := parseListener(listen)
+		if err != nil {
+			return nil, err
+		}
+		config.Listeners = append(config.Listeners, listener)
+	}
+
+	if *upstreams != "" {
+		for _, upstream := range strings.Split(*upstreams, ",") {
+			config.Upstreams = append(config.Upstreams, strings.TrimSpace(upstream))
+		}
+	}
+
+	switch config.Mode {
+	case ModeEcho, ModeRESP, ModeChat:
+	default:
+		return nil, fmt.Errorf("unknown mode %q", config.Mode)
+	}
+
+	if config.Mode != ModeEcho && len(config.Upstreams) > 0 {
+		return nil, fmt.Errorf("upstreams can't be combined with -mode=%s", config.Mode)
+	}
+
+	var err error
+	if config.Framing, err = framing.ParseMode(*framingMode); err != nil {
+		return nil, err
+	}
+
+	if config.Admission, err = server.ParseAdmissionPolicy(*admission); err != nil {
+		return nil, err
+	}
+
+	if config.MessageRate.Action, err = ratelimit.ParseAction(*msgRateAction); err != nil {
+		return nil, err
+	}
+
+	if config.ConnRate > 0 && config.ProxyProtocol {
+		return nil, fmt.Errorf("conn-rate keys on the connecting address, which is the load balancer with -proxy-protocol")
+	}
+
+	if config.MessageRate.Rate > 0 && (config.Mode == ModeRESP || len(config.Upstreams) > 0) {
+		return nil, fmt.Errorf("msg-rate only applies to echo and chat")
+	}
+
+	if config.TLSMinVersion, err = server.ParseTLSVersion(*tlsMinVersion); err != nil {
+		return nil, err
+	}
+
+	if config.TrustedProxies, err = proxyproto.ParseTrusted(*trustedProxies); err != nil {
+		return nil, err
+	}
+
+	if config.RecordFormat, err = record.ParseFormat(*recordFormat); err != nil {
+		return nil, err
+	}
+
+	if config.Chaos.Latency, err = chaos.ParseLatency(*chaosLatency); err != nil {
+		return nil, err
+	}
+
+	if err := config.Chaos.Validate(); err != nil {
+		return nil, err
+	}
+
+	if config.Reactor {
+		if err := config.checkReactor(); err != nil {
+			return nil, err
+		}
+	}
+
+	permissions, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket-mode %q: %v", *socketMode, err)
+	}
+	config.SocketMode = os.FileMode(permissions)
+
+	if *maxFrameSize <= 0 {
+		return nil, fmt.Errorf("max-frame must be positive")
+	}
+
+	if config.Framing == framing.Fixed && *frameSize <= 0 {
+		return nil, fmt.Errorf("frame-size must be positive for fixed framing")
+	}
+
+	return config, nil
+}
+
+// checkReactor rejects options the event loops don't implement
+func (c *Config) checkReactor() error {
+	for _, listener := range c.Listeners {
+		if !strings.HasPrefix(listener.Network, "tcp") {
+			return fmt.Errorf("reactor only serves tcp listeners, not %s", listener)
+		}
+		if listener.Socket != (server.SocketOptions{}) {
+			return fmt.Errorf("socket options on %s can't be combined with -reactor", listener)
+		}
+	}
+
+	unsupported := []struct {
+		flag string
+		set  bool
+	}{
+		{"-mode=" + c.Mode, c.Mode != ModeEcho},
+		{"-upstreams", len(c.Upstreams) > 0},
+		{"-framing=" + c.Framing.String(), c.Framing != framing.Newline},
+		{"-max-conns", c.MaxConns > 0},
+		{"-max-conns-per-ip", c.MaxConnsPerIP > 0},
+		{"-conn-rate", c.ConnRate > 0},
+		{"-msg-rate", c.MessageRate.Rate > 0},
+		{"-proxy-protocol", c.ProxyProtocol},
+		{"-echo-client-addr", c.EchoClientAddr},
+		{"-log-payload", c.LogPayload},
+		{"-sniff", c.Sniff},
+		{"-chaos", c.Chaos.Enabled},
+		{"-record", c.Record != ""},
+		{"-tls-cert", c.TLSCert != ""},
+	}
+	for _, option := range unsupported {
+		if option.set {
+			return fmt.Errorf("%s can't be combined with -reactor", option.flag)
+		}
+	}
+	return nil
+}
+
+// parseListener parses network://address[?options], defaulting to tcp without
+// a scheme
+func parseListener(value string) (Listener, error) {
+	network, addr, found := strings.Cut(value, "://")
+	if !found {
+		network, addr = "tcp", value
+	}
+	addr, query, hasOptions := strings.Cut(addr, "?")
+
+	switch network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6", "unix":
+	default:
+		return Listener{}, fmt.Errorf("unsupported network %q in %q", network, value)
+	}
+
+	if addr == "" {
+		return Listener{}, fmt.Errorf("missing address in %q", value)
+	}
+	listener := Listener{Network: network, Addr: addr}
+
+	if hasOptions {
+		if !strings.HasPrefix(network, "tcp") {
+			return Listener{}, fmt.Errorf("socket options only apply to tcp listeners, not %q", value)
+		}
+
+		var err error
+		if listener.Socket, err = server.ParseSocketOptions(query); err != nil {
+			return Listener{}, err
+		}
+	}
+	return listener, nil
+}
@@ -0,0 +1,259 @@
+// Package framing splits a byte stream into messages. The same Framer is used
+// by the server to read requests and by clients to read responses.
+package framing
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultMaxFrameSize is used when Config.MaxFrameSize is zero
+const DefaultMaxFrameSize = 64 * 1024
+
+// MaxLength16 is the largest payload a LengthPrefix16 header can describe
+const MaxLength16 = 0xFFFF
+
+var (
+	ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+	ErrFrameSize     = errors.New("frame does not match fixed frame size")
+)
+
+// Mode selects how frames are delimited on the wire
+type Mode int
+
+const (
+	Newline        Mode = iota // Payload followed by '\n'
+	LengthPrefix16             // 2-byte big-endian length, then payload
+	LengthPrefix32             // 4-byte big-endian length, then payload
+	Fixed                      // Every frame is exactly FrameSize bytes
+)
+
+func (m Mode) String() string {
+	switch m {
+	case Newline:
+		return "newline"
+	case LengthPrefix16:
+		return "len16"
+	case LengthPrefix32:
+		return "len32"
+	case Fixed:
+		return "fixed"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseMode parses "newline", "len16", "len32" or "fixed"
+func ParseMode(s string) (Mode, error) {
+	for _, mode := range []Mode{Newline, LengthPrefix16, LengthPrefix32, Fixed} {
+		if mode.String() == s {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown framing mode %q", s)
+}
+
+// Config holds framing configuration
+type Config struct {
+	Mode         Mode
+	MaxFrameSize int // Largest accepted payload for Newline and LengthPrefix modes
+	FrameSize    int // Payload size for Fixed mode
+}
+
+// Framer reads and writes whole frames on a stream
+type Framer interface {
+	// ReadFrame returns the next payload without its delimiter or header
+	ReadFrame() ([]byte, error)
+	// WriteFrame writes payload as a single frame
+	WriteFrame(payload []byte) error
+}
+
+// FrameTracker is implemented by streams that want to know whether a frame
+// has been partly received, e.g. so a draining server only interrupts clients
+// that are between frames. New calls TrackFrames once, and FrameDone is called
+// each time a frame has been read with nothing of the next one buffered.
+type FrameTracker interface {
+	TrackFrames()
+	FrameDone()
+}
+
+// New creates a Framer for rw. Reads are buffered, so rw must not be read
+// from directly once it is wrapped.
+func New(rw io.ReadWriter, config Config) (Framer, error) {
+	maxSize := config.MaxFrameSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxFrameSize
+	}
+	reader := &frameReader{Reader: bufio.NewReader(rw)}
+
+	var framer Framer
+	switch config.Mode {
+	case Newline:
+		framer = &lineFramer{reader: reader, writer: rw, maxSize: maxSize}
+	case LengthPrefix16:
+		maxSize = min(maxSize, MaxLength16)
+		framer = &lengthFramer{reader: reader, writer: rw, maxSize: maxSize, headerSize: 2}
+	case LengthPrefix32:
+		framer = &lengthFramer{reader: reader, writer: rw, maxSize: maxSize, headerSize: 4}
+	case Fixed:
+		if config.FrameSize <= 0 {
+			return nil, fmt.Errorf("fixed framing needs a positive frame size")
+		}
+		framer = &fixedFramer{reader: reader, writer: rw, size: config.FrameSize}
+	default:
+		return nil, fmt.Errorf("unknown framing mode %d", config.Mode)
+	}
+
+	if tracker, ok := rw.(FrameTracker); ok {
+		tracker.TrackFrames()
+		reader.tracker = tracker
+	}
+	return framer, nil
+}
+
+// frameReader is the buffered reader shared by the framers, telling the
+// stream's FrameTracker, if any, when a frame is complete
+type frameReader struct {
+	*bufio.Reader
+	tracker FrameTracker
+}
+
+// frameDone is called after each frame is read
+func (r *frameReader) frameDone() {
+	if r.tracker != nil && r.Buffered() == 0 {
+		r.tracker.FrameDone()
+	}
+}
+
+// lineFramer implements newline-delimited frames
+type lineFramer struct {
+	reader  *frameReader
+	writer  io.Writer
+	maxSize int
+}
+
+// ReadFrame reads up to the next '\n' or EOF, failing with ErrFrameTooLarge
+// instead of buffering more than maxSize bytes
+func (f *lineFramer) ReadFrame() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := f.reader.ReadSlice('\n')
+		if len(line)+len(chunk) > f.maxSize+1 {
+			return nil, ErrFrameTooLarge
+		}
+		line = append(line, chunk...)
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		// A final line without '\n' from a client that half-closed is
+		// still a frame, EOF comes with the next read
+		if err == io.EOF && len(line) > 0 {
+			f.reader.frameDone()
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		f.reader.frameDone()
+		return line[:len(line)-1], nil
+	}
+}
+
+func (f *lineFramer) WriteFrame(payload []byte) error {
+	if len(payload) > f.maxSize {
+		return ErrFrameTooLarge
+	}
+
+	frame := make([]byte, 0, len(payload)+1)
+	frame = append(frame, payload...)
+	frame = append(frame, '\n')
+	_, err := f.writer.Write(frame)
+	return err
+}
+
+// lengthFramer implements big-endian length-prefixed frames
+type lengthFramer struct {
+	reader     *frameReader
+	writer     io.Writer
+	maxSize    int
+	headerSize int
+}
+
+func (f *lengthFramer) ReadFrame() ([]byte, error) {
+	header := make([]byte, f.headerSize)
+	if _, err := io.ReadFull(f.reader, header); err != nil {
+		return nil, err
+	}
+
+	var size uint64
+	if f.headerSize == 2 {
+		size = uint64(binary.BigEndian.Uint16(header))
+	} else {
+		size = uint64(binary.BigEndian.Uint32(header))
+	}
+
+	// Check before allocating so a bogus header can't force a huge buffer
+	if size > uint64(f.maxSize) {
+		return nil, ErrFrameTooLarge
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(f.reader, payload); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	f.reader.frameDone()
+	return payload, nil
+}
+
+func (f *lengthFramer) WriteFrame(payload []byte) error {
+	if len(payload) > f.maxSize {
+		return ErrFrameTooLarge
+	}
+
+	frame := make([]byte, f.headerSize, f.headerSize+len(payload))
+	if f.headerSize == 2 {
+		binary.BigEndian.PutUint16(frame, uint16(len(payload)))
+	} else {
+		binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	}
+	frame = append(frame, payload...)
+
+	_, err := f.writer.Write(frame)
+	return err
+}
+
+// fixedFramer implements frames of a constant size
+type fixedFramer struct {
+	reader *frameReader
+	writer io.Writer
+	size   int
+}
+
+func (f *fixedFramer) ReadFrame() ([]byte, error) {
+	payload := make([]byte, f.size)
+	if _, err := io.ReadFull(f.reader, payload); err != nil {
+		return nil, err
+	}
+	f.reader.frameDone()
+	return payload, nil
+}
+
+func (f *fixedFramer) WriteFrame(payload []byte) error {
+	if len(payload) != f.size {
+		return ErrFrameSize
+	}
+	_, err := f.writer.Write(payload)
+	return err
+}
+
+// unexpectedEOF reports a stream that ended mid-frame as io.ErrUnexpectedEOF
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
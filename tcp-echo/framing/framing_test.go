@@ -0,0 +1,124 @@
+package framing
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFramer_RoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		payload []byte
+	}{
+		{"newline", Config{Mode: Newline}, []byte("hello")},
+		{"len16", Config{Mode: LengthPrefix16}, []byte("binary\n\x00\xff")},
+		{"len32", Config{Mode: LengthPrefix32}, []byte("binary\n\x00\xff")},
+		{"len16 empty", Config{Mode: LengthPrefix16}, []byte{}},
+		{"fixed", Config{Mode: Fixed, FrameSize: 4}, []byte{1, 2, '\n', 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			framer, err := New(&buf, tt.config)
+			if err != nil {
+				t.Fatalf("New failed: %v", err)
+			}
+
+			// Two frames back to back must come out separately
+			for i := 0; i < 2; i++ {
+				if err := framer.WriteFrame(tt.payload); err != nil {
+					t.Fatalf("WriteFrame failed: %v", err)
+				}
+			}
+
+			for i := 0; i < 2; i++ {
+				got, err := framer.ReadFrame()
+				if err != nil {
+					t.Fatalf("ReadFrame %d failed: %v", i, err)
+				}
+				if !bytes.Equal(got, tt.payload) {
+					t.Errorf("Frame %d: expected %q, got %q", i, tt.payload, got)
+				}
+			}
+
+			if _, err := framer.ReadFrame(); err != io.EOF {
+				t.Errorf("Expected io.EOF after last frame, got %v", err)
+			}
+		})
+	}
+}
+
+func TestFramer_LengthPrefixWireFormat(t *testing.T) {
+	var buf bytes.Buffer
+	framer, _ := New(&buf, Config{Mode: LengthPrefix16})
+	framer.WriteFrame([]byte("abc"))
+
+	if want := []byte{0x00, 0x03, 'a', 'b', 'c'}; !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("Expected % x, got % x", want, buf.Bytes())
+	}
+}
+
+func TestFramer_RejectsOversizedFrames(t *testing.T) {
+	// Header claims 1 GiB, which must be rejected before allocating
+	buf := bytes.NewBuffer([]byte{0x40, 0x00, 0x00, 0x00})
+	framer, _ := New(buf, Config{Mode: LengthPrefix32, MaxFrameSize: 1024})
+	if _, err := framer.ReadFrame(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Expected ErrFrameTooLarge for length prefix, got %v", err)
+	}
+
+	buf = bytes.NewBufferString("0123456789\n")
+	framer, _ = New(buf, Config{Mode: Newline, MaxFrameSize: 4})
+	if _, err := framer.ReadFrame(); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("Expected ErrFrameTooLarge for newline, got %v", err)
+	}
+}
+
+func TestFramer_TruncatedFrame(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{0x00, 0x05, 'a', 'b'})
+	framer, _ := New(buf, Config{Mode: LengthPrefix16})
+	if _, err := framer.ReadFrame(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestFramer_FixedSizeMismatch(t *testing.T) {
+	framer, _ := New(&bytes.Buffer{}, Config{Mode: Fixed, FrameSize: 4})
+	if err := framer.WriteFrame([]byte("toolong")); !errors.Is(err, ErrFrameSize) {
+		t.Errorf("Expected ErrFrameSize, got %v", err)
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	for _, mode := range []Mode{Newline, LengthPrefix16, LengthPrefix32, Fixed} {
+		got, err := ParseMode(mode.String())
+		if err != nil || got != mode {
+			t.Errorf("ParseMode(%q) = %v, %v", mode.String(), got, err)
+		}
+	}
+
+	if _, err := ParseMode("bogus"); err == nil {
+		t.Error("Expected error for unknown mode")
+	}
+}
+
+func TestFramer_NewlineFinalLineWithoutNewline(t *testing.T) {
+	framer, _ := New(bytes.NewBufferString("one\ntwo"), Config{Mode: Newline})
+
+	for _, want := range []string{"one", "two"} {
+		got, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("ReadFrame failed: %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	}
+
+	if _, err := framer.ReadFrame(); err != io.EOF {
+		t.Errorf("Expected io.EOF after the last line, got %v", err)
+	}
+}
@@ -0,0 +1,7 @@
+module tcp-echo
+
+go 1.25.4
+
+require rate-limiter v0.0.0
+
+replace rate-limiter => ../rate-limiter
@@ -0,0 +1,100 @@
+package l4proxy
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upstream is a backend TCP address the proxy forwards connections to
+type Upstream struct {
+	Addr      string
+	active    atomic.Int64 // Connections currently forwarded or being dialed
+	downUntil atomic.Int64 // Unix nanoseconds until which a failed upstream is skipped
+}
+
+// ActiveConns returns the number of connections currently forwarded
+func (u *Upstream) ActiveConns() int64 {
+	return u.active.Load()
+}
+
+// Down reports whether a recent dial to u failed
+func (u *Upstream) Down() bool {
+	return time.Now().UnixNano() < u.downUntil.Load()
+}
+
+// Balancer picks the upstream for a new connection
+type Balancer interface {
+	// Next returns an upstream not in tried, or nil if all have been tried
+	Next(tried map[*Upstream]bool) *Upstream
+}
+
+// Strategy names a balancing algorithm
+type Strategy string
+
+const (
+	RoundRobin       Strategy = "round-robin"
+	LeastConnections Strategy = "least-conn"
+)
+
+// NewBalancer creates a balancer for the given strategy
+func NewBalancer(strategy Strategy, upstreams []*Upstream) (Balancer, error) {
+	switch strategy {
+	case RoundRobin, "":
+		return &roundRobin{upstreams: upstreams}, nil
+	case LeastConnections:
+		return &leastConnections{upstreams: upstreams}, nil
+	default:
+		return nil, fmt.Errorf("unknown balancing strategy %q", strategy)
+	}
+}
+
+// roundRobin cycles through upstreams in order
+type roundRobin struct {
+	upstreams []*Upstream
+	current   int
+	mu        sync.Mutex
+}
+
+func (rr *roundRobin) Next(tried map[*Upstream]bool) *Upstream {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	for i := 0; i < len(rr.upstreams); i++ {
+		upstream := rr.upstreams[rr.current]
+		rr.current = (rr.current + 1) % len(rr.upstreams)
+
+		if !tried[upstream] {
+			return upstream
+		}
+	}
+	return nil
+}
+
+// leastConnections picks the upstream with the fewest active connections,
+// rotating the starting point so ties are spread evenly
+type leastConnections struct {
+	upstreams []*Upstream
+	current   int
+	mu        sync.Mutex
+}
+
+func (lc *leastConnections) Next(tried map[*Upstream]bool) *Upstream {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	var best *Upstream
+	for i := 0; i < len(lc.upstreams); i++ {
+		upstream := lc.upstreams[(lc.current+i)%len(lc.upstreams)]
+		if tried[upstream] {
+			continue
+		}
+		if best == nil || upstream.ActiveConns() < best.ActiveConns() {
+			best = upstream
+		}
+	}
+
+	lc.current = (lc.current + 1) % len(lc.upstreams)
+	return best
+}
@@ -0,0 +1,172 @@
+// Package l4proxy forwards TCP connections to a set of upstream addresses.
+// Proxy implements server.Handler, so it plugs into the same accept loop,
+// limits and shutdown handling as the echo server.
+package l4proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"tcp-echo/proxyproto"
+)
+
+// ErrNoUpstream is returned when every upstream failed to accept a connection
+var ErrNoUpstream = errors.New("no upstream reachable")
+
+// Config holds configuration for the proxy
+type Config struct {
+	Upstreams       []string      // host:port addresses
+	Strategy        Strategy      // Defaults to RoundRobin
+	DialTimeout     time.Duration // Upstreams that don't answer in time are skipped
+	RetryAfter      time.Duration // How long an upstream is skipped after a failed dial, defaults to 5s
+	SendProxyHeader bool          // Send a PROXY v1 header so upstreams see the client address
+}
+
+// Proxy forwards each client connection to one upstream
+type Proxy struct {
+	upstreams       []*Upstream
+	balancer        Balancer
+	dialTimeout     time.Duration
+	retryAfter      time.Duration
+	sendProxyHeader bool
+}
+
+// NewProxy creates a new L4 proxy
+func NewProxy(config Config) (*Proxy, error) {
+	if len(config.Upstreams) == 0 {
+		return nil, fmt.Errorf("at least one upstream required")
+	}
+
+	upstreams := make([]*Upstream, 0, len(config.Upstreams))
+	for _, addr := range config.Upstreams {
+		upstreams = append(upstreams, &Upstream{Addr: addr})
+	}
+
+	balancer, err := NewBalancer(config.Strategy, upstreams)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		upstreams:       upstreams,
+		balancer:        balancer,
+		dialTimeout:     config.DialTimeout,
+		retryAfter:      config.RetryAfter,
+		sendProxyHeader: config.SendProxyHeader,
+	}
+
+	// Set defaults
+	if p.dialTimeout == 0 {
+		p.dialTimeout = 2 * time.Second
+	}
+	if p.retryAfter == 0 {
+		p.retryAfter = 5 * time.Second
+	}
+
+	return p, nil
+}
+
+// Upstreams returns the configured upstreams
+func (p *Proxy) Upstreams() []*Upstream {
+	return p.upstreams
+}
+
+// ServeConn dials an upstream and copies data both ways until both sides
+// have finished sending
+func (p *Proxy) ServeConn(ctx context.Context, conn net.Conn) error {
+	upstream, upstreamConn, err := p.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer upstreamConn.Close()
+	defer upstream.active.Add(-1)
+
+	// A client that only downloads sends nothing, so data flowing to it
+	// must also keep the connection from timing out as idle
+	if activity, ok := conn.(interface{ CountWritesAsActivity() }); ok {
+		activity.CountWritesAsActivity()
+	}
+
+	log.Printf("proxying %s -> %s", conn.RemoteAddr(), upstream.Addr)
+
+	if p.sendProxyHeader {
+		if err := proxyproto.WriteV1Header(upstreamConn, conn.RemoteAddr(), conn.LocalAddr()); err != nil {
+			return err
+		}
+	}
+
+	errs := make(chan error, 2)
+	go func() { errs <- pipe(upstreamConn, conn) }()
+	go func() { errs <- pipe(conn, upstreamConn) }()
+
+	// A clean EOF only half-closes, so wait for both directions. On an error
+	// tear down both sides, otherwise the other copy could block forever.
+	err = <-errs
+	if err != nil {
+		conn.Close()
+		upstreamConn.Close()
+	}
+	if err2 := <-errs; err == nil {
+		err = err2
+	}
+	return err
+}
+
+// dial tries upstreams in balancer order until one accepts the connection.
+// Upstreams that recently failed are only tried once every other one has
+// failed too. The returned upstream counts the connection as active.
+func (p *Proxy) dial(ctx context.Context) (*Upstream, net.Conn, error) {
+	tried := make(map[*Upstream]bool, len(p.upstreams))
+	dialer := net.Dialer{Timeout: p.dialTimeout}
+
+	var down []*Upstream
+	for {
+		upstream := p.balancer.Next(tried)
+		if upstream != nil {
+			tried[upstream] = true
+			if upstream.Down() {
+				down = append(down, upstream)
+				continue
+			}
+		} else if len(down) > 0 {
+			upstream, down = down[0], down[1:]
+		} else {
+			return nil, nil, ErrNoUpstream
+		}
+
+		// Counted before dialing so a burst of connections is spread out
+		// instead of all seeing the same idlest upstream
+		upstream.active.Add(1)
+		conn, err := dialer.DialContext(ctx, "tcp", upstream.Addr)
+		if err == nil {
+			upstream.downUntil.Store(0)
+			return upstream, conn, nil
+		}
+		upstream.active.Add(-1)
+		upstream.downUntil.Store(time.Now().Add(p.retryAfter).UnixNano())
+		log.Printf("upstream %s unreachable, skipping for %s: %v", upstream.Addr, p.retryAfter, err)
+	}
+}
+
+// closeWriter is implemented by connections that support TCP half-close
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe copies src to dst, then half-closes dst so the peer sees EOF while
+// the other direction keeps flowing
+func pipe(dst, src net.Conn) error {
+	_, err := io.Copy(dst, src)
+
+	if cw, ok := dst.(closeWriter); ok {
+		cw.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	return err
+}
@@ -0,0 +1,219 @@
+package l4proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"tcp-echo/server"
+)
+
+// startUpstream serves handler on a random local port
+func startUpstream(t *testing.T, handler server.Handler) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	srv := server.NewServer(server.Config{Handler: handler})
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	return listener.Addr().String()
+}
+
+// namedUpstream replies with its name and closes
+func namedUpstream(t *testing.T, name string) string {
+	return startUpstream(t, server.HandlerFunc(func(ctx context.Context, conn net.Conn) error {
+		_, err := conn.Write([]byte(name))
+		return err
+	}))
+}
+
+// startProxy serves a proxy for upstreams and returns its address
+func startProxy(t *testing.T, config Config) string {
+	t.Helper()
+
+	proxy, err := NewProxy(config)
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	return startUpstream(t, proxy)
+}
+
+func readAll(t *testing.T, addr string, request string) string {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	if request != "" {
+		conn.Write([]byte(request))
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	return string(data)
+}
+
+func TestProxy_RoundRobin(t *testing.T) {
+	addr := startProxy(t, Config{
+		Upstreams: []string{namedUpstream(t, "a"), namedUpstream(t, "b")},
+	})
+
+	var got []string
+	for i := 0; i < 4; i++ {
+		got = append(got, readAll(t, addr, ""))
+	}
+
+	expected := []string{"a", "b", "a", "b"}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Connection %d: expected upstream %s, got %q", i, expected[i], got[i])
+		}
+	}
+}
+
+func TestProxy_SkipsUnreachableUpstream(t *testing.T) {
+	// Grab a free port and close it so nothing is listening there
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	addr := startProxy(t, Config{
+		Upstreams:   []string{deadAddr, namedUpstream(t, "alive")},
+		DialTimeout: 200 * time.Millisecond,
+	})
+
+	for i := 0; i < 2; i++ {
+		if got := readAll(t, addr, ""); got != "alive" {
+			t.Errorf("Expected reachable upstream, got %q", got)
+		}
+	}
+}
+
+func TestProxy_BacksOffFailedUpstream(t *testing.T) {
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	proxy, err := NewProxy(Config{
+		Upstreams:  []string{deadAddr, namedUpstream(t, "alive")},
+		RetryAfter: time.Minute,
+	})
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	addr := startUpstream(t, proxy)
+
+	readAll(t, addr, "")
+	deadUpstream := proxy.Upstreams()[0]
+	if !deadUpstream.Down() {
+		t.Fatal("Expected the unreachable upstream to be marked down")
+	}
+	if active := deadUpstream.ActiveConns(); active != 0 {
+		t.Errorf("Expected the failed dial not to count as active, got %d", active)
+	}
+
+	// Round-robin would pick the dead upstream again, but it's skipped
+	// while backing off and the live one serves every connection
+	for i := 0; i < 3; i++ {
+		if got := readAll(t, addr, ""); got != "alive" {
+			t.Errorf("Expected reachable upstream, got %q", got)
+		}
+	}
+
+	// With nothing else left, a down upstream is still tried
+	proxy, _ = NewProxy(Config{Upstreams: []string{namedUpstream(t, "only")}})
+	proxy.Upstreams()[0].downUntil.Store(time.Now().Add(time.Minute).UnixNano())
+	if got := readAll(t, startUpstream(t, proxy), ""); got != "only" {
+		t.Errorf("Expected the down upstream to be tried as a last resort, got %q", got)
+	}
+	if proxy.Upstreams()[0].Down() {
+		t.Error("Expected a successful dial to clear the backoff")
+	}
+}
+
+func TestProxy_DownloadOutlastsIdleTimeout(t *testing.T) {
+	// The upstream streams for longer than the idle timeout while the
+	// client sends nothing
+	slow := startUpstream(t, server.HandlerFunc(func(ctx context.Context, conn net.Conn) error {
+		for i := 0; i < 8; i++ {
+			if _, err := conn.Write([]byte("x")); err != nil {
+				return err
+			}
+			time.Sleep(40 * time.Millisecond)
+		}
+		return nil
+	}))
+
+	proxy, err := NewProxy(Config{Upstreams: []string{slow}})
+	if err != nil {
+		t.Fatalf("NewProxy failed: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	srv := server.NewServer(server.Config{Handler: proxy, IdleTimeout: 100 * time.Millisecond})
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if data, _ := io.ReadAll(conn); string(data) != "xxxxxxxx" {
+		t.Errorf("Expected the whole download, got %q", data)
+	}
+}
+
+func TestProxy_HalfClose(t *testing.T) {
+	echo := startUpstream(t, server.NewEchoHandler())
+	addr := startProxy(t, Config{Upstreams: []string{echo}})
+
+	// The client stops writing before reading; echoes must still arrive
+	got := readAll(t, addr, "one\ntwo\n")
+	if want := "Echo: one\nEcho: two\n"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestLeastConnections_PicksIdlestUpstream(t *testing.T) {
+	upstreams := []*Upstream{{Addr: "a"}, {Addr: "b"}, {Addr: "c"}}
+	upstreams[0].active.Store(3)
+	upstreams[1].active.Store(1)
+	upstreams[2].active.Store(2)
+
+	balancer, _ := NewBalancer(LeastConnections, upstreams)
+
+	if got := balancer.Next(nil); got != upstreams[1] {
+		t.Errorf("Expected b, got %s", got.Addr)
+	}
+
+	// Skips upstreams that were already tried
+	tried := map[*Upstream]bool{upstreams[1]: true}
+	if got := balancer.Next(tried); got != upstreams[2] {
+		t.Errorf("Expected c, got %s", got.Addr)
+	}
+}
+
+func TestNewBalancer_UnknownStrategy(t *testing.T) {
+	if _, err := NewBalancer("random", nil); err == nil {
+		t.Error("Expected error for unknown strategy")
+	}
+}
@@ -1,63 +1,437 @@
 package main
 
 import (
-	"bufio"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
+	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"tcp-echo/chaos"
+	"tcp-echo/chat"
+	"tcp-echo/framing"
+	"tcp-echo/l4proxy"
+	"tcp-echo/metrics"
+	"tcp-echo/proxyproto"
+	"tcp-echo/ratelimit"
+	"tcp-echo/reactor"
+	"tcp-echo/record"
+	"tcp-echo/resp"
+	"tcp-echo/server"
+	"tcp-echo/sniff"
+	"tcp-echo/upgrade"
+	"tcp-echo/websocket"
+
+	"rate-limiter/ratelimiter"
 )
 
+// statsSocket names the stats listener when handing sockets to a new process
+const statsSocket = "stats"
+
+// service is a listener served by either server.Server or, with -reactor,
+// reactor.Server
+type service interface {
+	ListenAndServe() error
+	Addr() net.Addr
+	File() (*os.File, error)
+	Shutdown() server.ShutdownSummary
+	Stats() server.Stats
+}
+
 func main() {
-	// go run main.go <port>
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: go run main.go <port>")
+	// go run . <port>
+	config, err := ParseConfig()
+	if err != nil {
+		fmt.Println("error:", err)
+		fmt.Println("Usage: go run . [flags] <port>")
+		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
-	port := fmt.Sprintf(":%s", os.Args[1])
+	if config.GenCert {
+		if err := server.WriteSelfSignedCert(config.TLSCert, config.TLSKey, "localhost", "127.0.0.1", "::1"); err != nil {
+			fmt.Println("failed to generate certificate, err:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("wrote self-signed certificate to %s and key to %s\n", config.TLSCert, config.TLSKey)
+		return
+	}
 
-	listener, err := net.Listen("tcp", port)
+	// Sockets passed down by the previous process during an upgrade
+	inherited, err := upgrade.Inherit()
 	if err != nil {
-		fmt.Println("failed to create listener, err:", err)
+		fmt.Println("failed to inherit sockets, err:", err)
 		os.Exit(1)
 	}
-	defer listener.Close()
-	fmt.Printf("listening on %s\n", listener.Addr())
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			fmt.Println("failed to accept connection, err:", err)
+	var tlsConfig *server.TLSConfig
+	if config.TLSCert != "" {
+		tlsConfig = &server.TLSConfig{
+			CertFile:     config.TLSCert,
+			KeyFile:      config.TLSKey,
+			ClientCAFile: config.TLSClientCA,
+			MinVersion:   config.TLSMinVersion,
+		}
+	}
+
+	handler, err := newHandler(config)
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+
+	// One recorder for all listeners keeps connection ids unique in the file
+	var recorder *record.Recorder
+	if config.Record != "" {
+		// The previous process is still writing to the file while it drains
+		path := config.Record
+		if inherited.HasParent() {
+			path = fmt.Sprintf("%s.%d", path, os.Getpid())
+		}
+		if recorder, err = record.Create(path, config.RecordFormat); err != nil {
+			fmt.Println("failed to create recording, err:", err)
+			os.Exit(1)
+		}
+		defer recorder.Close()
+	}
+
+	registry := metrics.NewRegistry()
+	injectors := make(map[string]*chaos.Injector, len(config.Listeners))
+
+	// Served on the listeners themselves with -sniff, so it leaves out chaos
+	// control, which only -stats-addr exposes
+	httpHandler := newHTTPHandler(registry, config.MaxFrameSize)
+
+	var sniffHandler *sniff.Handler
+	if config.Sniff {
+		sniffHandler = sniff.NewHandler(sniff.Config{
+			Raw:         handler,
+			HTTP:        httpHandler,
+			PeekTimeout: config.SniffTimeout,
+		})
+		defer sniffHandler.Close()
+	}
+
+	// One limiter for all listeners so a client can't multiply its rate by
+	// connecting to each of them
+	var connRate ratelimiter.RateLimiter
+	if config.ConnRate > 0 {
+		if connRate, err = ratelimit.NewLimiter(config.ConnRateAlgorithm, config.ConnRate, config.ConnRateWindow); err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+	}
+
+	// Connection caps are shared the same way, so they hold across listeners
+	limits := server.NewConnLimits(config.MaxConns, config.MaxConnsPerIP)
+
+	var messageRate *ratelimit.MessageConfig
+	if config.MessageRate.Rate > 0 {
+		messageRate = &config.MessageRate
+	}
+
+	servers := make([]service, 0, len(config.Listeners))
+	for _, listener := range config.Listeners {
+		if config.Reactor {
+			inheritedListener, err := inherited.Listener(listener.String())
+			if err != nil {
+				fmt.Println("failed to use inherited socket, err:", err)
+				os.Exit(1)
+			}
+
+			servers = append(servers, reactor.NewServer(reactor.Config{
+				Network:      listener.Network,
+				Addr:         listener.Addr,
+				Prefix:       "Echo: ",
+				MaxLineSize:  config.MaxFrameSize,
+				Loops:        config.ReactorLoops,
+				DrainTimeout: config.DrainTimeout,
+				IdleTimeout:  config.IdleTimeout,
+				Metrics:      registry.Listener(listener.String()),
+				Listener:     inheritedListener,
+			}))
 			continue
 		}
 
-		go handleConnection(conn)
+		serverConfig := server.Config{
+			Network:      listener.Network,
+			Addr:         listener.Addr,
+			Handler:      handler,
+			DrainTimeout: config.DrainTimeout,
+			IdleTimeout:  config.IdleTimeout,
+			WriteTimeout: config.WriteTimeout,
+
+			Limits:      limits,
+			Admission:   config.Admission,
+			ConnRate:    connRate,
+			MessageRate: messageRate,
+
+			SocketMode:      config.SocketMode,
+			MaxDatagramSize: config.MaxDatagram,
+			Socket:          listener.Socket,
+
+			Metrics:  registry.Listener(listener.String()),
+			Recorder: recorder,
+		}
+
+		// Each listener gets its own injector so faults can be toggled per listener
+		injector, err := chaos.NewInjector(config.Chaos)
+		if err != nil {
+			fmt.Println("error:", err)
+			os.Exit(1)
+		}
+		injectors[listener.String()] = injector
+		serverConfig.Chaos = injector
+
+		if listener.IsStream() {
+			serverConfig.Listener, err = inherited.Listener(listener.String())
+		} else {
+			serverConfig.PacketConn, err = inherited.PacketConn(listener.String())
+		}
+		if err != nil {
+			fmt.Println("failed to use inherited socket, err:", err)
+			os.Exit(1)
+		}
+
+		// TLS and PROXY headers only make sense for stream listeners
+		if listener.IsStream() {
+			serverConfig.TLS = tlsConfig
+			if config.ProxyProtocol {
+				serverConfig.ProxyProtocol = &proxyproto.Config{Trusted: config.TrustedProxies}
+			}
+			if sniffHandler != nil {
+				serverConfig.Handler = sniffHandler
+			}
+		}
+
+		servers = append(servers, server.NewServer(serverConfig))
 	}
-}
 
-func handleConnection(conn net.Conn) {
-	defer conn.Close()
+	serveErr := make(chan error, len(servers)+1)
+	for i, srv := range servers {
+		go func(srv service, listener Listener) {
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, server.ErrServerClosed) {
+				serveErr <- fmt.Errorf("%s: %w", listener, err)
+			}
+		}(srv, config.Listeners[i])
+	}
 
-	reader := bufio.NewReader(conn)
-	for {
-		bytes, err := reader.ReadBytes(byte('\n'))
+	var statsListener net.Listener
+	if config.StatsAddr != "" {
+		if statsListener, err = inherited.Listener(statsSocket); err == nil && statsListener == nil {
+			statsListener, err = net.Listen("tcp", config.StatsAddr)
+		}
 		if err != nil {
-			if err != io.EOF {
-				fmt.Println("failed to read data, err:", err)
+			fmt.Println("failed to listen for stats, err:", err)
+			os.Exit(1)
+		}
+
+		statsServer := &http.Server{Handler: newStatsHandler(httpHandler, injectors)}
+		defer statsServer.Close()
+
+		go func() {
+			log.Printf("stats listening on %s", statsListener.Addr())
+			if err := statsServer.Serve(statsListener); err != nil && err != http.ErrServerClosed {
+				serveErr <- fmt.Errorf("stats: %w", err)
+			}
+		}()
+	}
+
+	// Let the previous process know it can stop accepting and drain
+	if inherited.HasParent() {
+		waitListening(servers)
+		if err := inherited.Ready(); err != nil {
+			fmt.Println("failed to signal readiness, err:", err)
+		}
+	}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	// SIGHUP reloads certificates without dropping connections
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+
+	// SIGUSR2 starts a new copy of the binary and hands it the sockets
+	upgradeChan := make(chan os.Signal, 1)
+	signal.Notify(upgradeChan, syscall.SIGUSR2)
+
+	for {
+		select {
+		case err := <-serveErr:
+			fmt.Println("server stopped, err:", err)
+			shutdown(servers)
+			os.Exit(1)
+		case <-hupChan:
+			var reloadErr error
+			for _, srv := range servers {
+				srv, ok := srv.(*server.Server)
+				if !ok {
+					continue
+				}
+				if err := srv.ReloadTLS(); err != nil && !errors.Is(err, server.ErrTLSDisabled) {
+					fmt.Println("failed to reload certificates, err:", err)
+					reloadErr = err
+				}
 			}
+			if reloadErr == nil {
+				fmt.Println("reloaded TLS certificates")
+			}
+		case <-upgradeChan:
+			process, err := handOff(servers, config.Listeners, statsListener)
+			if err != nil {
+				fmt.Println("upgrade failed, still serving, err:", err)
+				continue
+			}
+			fmt.Printf("upgraded to pid %d, draining connections (timeout %s)\n", process.Pid, config.DrainTimeout)
+			shutdown(servers)
+			return
+		case sig := <-sigChan:
+			fmt.Printf("received %s, draining connections (timeout %s)\n", sig, config.DrainTimeout)
+			shutdown(servers)
 			return
 		}
+	}
+}
 
-		fmt.Printf("request: %s", bytes)
+// newHandler builds the handler for -mode, or an L4 proxy when upstreams are set
+func newHandler(config *Config) (server.Handler, error) {
+	switch config.Mode {
+	case ModeRESP:
+		handler := resp.NewHandler()
+		handler.MaxBulkSize = config.MaxFrameSize
+		return handler, nil
+	case ModeChat:
+		return chat.NewHub(chat.Config{
+			QueueSize:   config.ChatQueue,
+			MaxLineSize: config.MaxFrameSize,
+		}), nil
+	}
 
-		line := fmt.Sprintf("Echo: %s", bytes)
-		fmt.Printf("response: %s", line)
+	if len(config.Upstreams) > 0 {
+		return l4proxy.NewProxy(l4proxy.Config{
+			Upstreams:   config.Upstreams,
+			Strategy:    config.Balance,
+			DialTimeout: config.DialTimeout,
 
-		_, err = conn.Write([]byte(line))
+			SendProxyHeader: config.SendProxyHeader,
+		})
+	}
+
+	handler := server.NewEchoHandler()
+	handler.Framing = framing.Config{
+		Mode:         config.Framing,
+		MaxFrameSize: config.MaxFrameSize,
+		FrameSize:    config.FrameSize,
+	}
+
+	handler.ShowClientAddr = config.EchoClientAddr
+	handler.LogPayload = config.LogPayload
+
+	// Binary protocols expect their message back unchanged
+	if config.Framing != framing.Newline {
+		handler.Prefix = ""
+	}
+	return handler, nil
+}
+
+// handOff starts a new process with every listening socket and waits until it
+// is serving
+func handOff(servers []service, listeners []Listener, statsListener net.Listener) (*os.Process, error) {
+	files := make(map[string]*os.File, len(servers)+1)
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	for i, srv := range servers {
+		file, err := srv.File()
 		if err != nil {
-			fmt.Println("failed to write data, err:", err)
-			return
+			return nil, fmt.Errorf("%s: %w", listeners[i], err)
+		}
+		files[listeners[i].String()] = file
+	}
+
+	if statsListener != nil {
+		file, err := statsListener.(*net.TCPListener).File()
+		if err != nil {
+			return nil, fmt.Errorf("stats: %w", err)
+		}
+		files[statsSocket] = file
+	}
+
+	return upgrade.Start(files, upgrade.Config{})
+}
+
+// waitListening gives servers that had to open a new socket a moment to do so
+func waitListening(servers []service) {
+	deadline := time.Now().Add(5 * time.Second)
+	for _, srv := range servers {
+		for srv.Addr() == nil && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
 		}
 	}
 }
+
+// newHTTPHandler serves health checks, metrics and a WebSocket echo
+func newHTTPHandler(registry *metrics.Registry, maxMessageSize int) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", registry.Handler())
+	mux.Handle("/ws", &websocket.EchoHandler{MaxMessageSize: maxMessageSize})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	return mux
+}
+
+// newStatsHandler adds chaos control to httpHandler for -stats-addr
+func newStatsHandler(httpHandler http.Handler, injectors map[string]*chaos.Injector) http.Handler {
+	chaosHandler := chaos.Handler(injectors)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", httpHandler)
+	mux.Handle("/chaos", chaosHandler)
+	mux.Handle("/chaos/", chaosHandler)
+	return mux
+}
+
+// shutdown drains every server in parallel and prints a combined summary
+func shutdown(servers []service) {
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		total server.ShutdownSummary
+	)
+
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv service) {
+			defer wg.Done()
+			summary := srv.Shutdown()
+
+			mu.Lock()
+			total.Drained += summary.Drained
+			total.Killed += summary.Killed
+			mu.Unlock()
+		}(srv)
+	}
+	wg.Wait()
+
+	fmt.Printf("shutdown complete: %d drained, %d killed\n", total.Drained, total.Killed)
+
+	var rejected, rejectedPerIP, rateLimited uint64
+	for _, srv := range servers {
+		stats := srv.Stats()
+		rejected += stats.Rejected
+		rejectedPerIP += stats.RejectedPerIP
+		rateLimited += stats.RateLimited
+	}
+	fmt.Printf("rejected connections: %d over max-conns, %d over max-conns-per-ip, %d over conn-rate\n", rejected, rejectedPerIP, rateLimited)
+}
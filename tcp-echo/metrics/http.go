@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Registry holds the metrics of every listener in the process
+type Registry struct {
+	mu        sync.Mutex
+	listeners map[string]*Metrics
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		listeners: make(map[string]*Metrics),
+	}
+}
+
+// Listener returns the metrics for name, creating them on first use
+func (r *Registry) Listener(name string) *Metrics {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, exists := r.listeners[name]
+	if !exists {
+		m = New()
+		r.listeners[name] = m
+	}
+	return m
+}
+
+// Snapshot returns a snapshot of every listener keyed by name
+func (r *Registry) Snapshot() map[string]Snapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	snapshots := make(map[string]Snapshot, len(r.listeners))
+	for name, m := range r.listeners {
+		snapshots[name] = m.Snapshot()
+	}
+	return snapshots
+}
+
+// Handler serves /metrics in Prometheus text format and /stats as JSON
+func (r *Registry) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WritePrometheus(w)
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Snapshot())
+	})
+	return mux
+}
+
+// WritePrometheus writes every listener's counters in Prometheus text format
+func (r *Registry) WritePrometheus(w io.Writer) {
+	snapshots := r.Snapshot()
+
+	names := make([]string, 0, len(snapshots))
+	for name := range snapshots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	simple := []struct {
+		name, help, kind string
+		value            func(Snapshot) float64
+	}{
+		{"tcp_echo_connections_accepted_total", "Connections accepted.", "counter",
+			func(s Snapshot) float64 { return float64(s.Accepted) }},
+		{"tcp_echo_connections_active", "Connections currently open.", "gauge",
+			func(s Snapshot) float64 { return float64(s.Active) }},
+		{"tcp_echo_connections_closed_total", "Connections closed.", "counter",
+			func(s Snapshot) float64 { return float64(s.Closed) }},
+		{"tcp_echo_bytes_in_total", "Bytes read from clients.", "counter",
+			func(s Snapshot) float64 { return float64(s.BytesIn) }},
+		{"tcp_echo_bytes_out_total", "Bytes written to clients.", "counter",
+			func(s Snapshot) float64 { return float64(s.BytesOut) }},
+		{"tcp_echo_frames_total", "Frames processed.", "counter",
+			func(s Snapshot) float64 { return float64(s.Frames) }},
+	}
+
+	for _, metric := range simple {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.kind)
+		for _, name := range names {
+			fmt.Fprintf(w, "%s{listener=%q} %v\n", metric.name, name, metric.value(snapshots[name]))
+		}
+	}
+
+	labelled := []struct {
+		name, help string
+		values     func(Snapshot) map[string]uint64
+	}{
+		{"tcp_echo_connections_closed_by_reason_total", "Connections closed, by reason.",
+			func(s Snapshot) map[string]uint64 { return s.CloseReasons }},
+		{"tcp_echo_connections_rejected_total", "Connections rejected by admission control, by reason.",
+			func(s Snapshot) map[string]uint64 { return s.Rejected }},
+	}
+
+	for _, metric := range labelled {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", metric.name, metric.help, metric.name)
+		for _, name := range names {
+			values := metric.values(snapshots[name])
+
+			reasons := make([]string, 0, len(values))
+			for reason := range values {
+				reasons = append(reasons, reason)
+			}
+			sort.Strings(reasons)
+
+			for _, reason := range reasons {
+				fmt.Fprintf(w, "%s{listener=%q,reason=%q} %d\n", metric.name, name, reason, values[reason])
+			}
+		}
+	}
+}
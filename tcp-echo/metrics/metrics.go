@@ -0,0 +1,196 @@
+// Package metrics counts connections, bytes and frames per listener and
+// exposes them over HTTP in Prometheus text format and JSON.
+package metrics
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics aggregates counters for a single listener
+type Metrics struct {
+	accepted atomic.Uint64
+	closed   atomic.Uint64
+	active   atomic.Int64
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+	frames   atomic.Uint64
+	nextID   atomic.Uint64
+
+	mu           sync.Mutex
+	conns        map[uint64]*Conn
+	closeReasons map[string]uint64
+	rejected     map[string]uint64
+}
+
+// New creates an empty set of counters
+func New() *Metrics {
+	return &Metrics{
+		conns:        make(map[uint64]*Conn),
+		closeReasons: make(map[string]uint64),
+		rejected:     make(map[string]uint64),
+	}
+}
+
+// Open records an accepted connection and returns its per-connection counters
+func (m *Metrics) Open(remoteAddr string) *Conn {
+	c := &Conn{
+		ID:         m.nextID.Add(1),
+		RemoteAddr: remoteAddr,
+		Started:    time.Now(),
+		metrics:    m,
+	}
+
+	m.accepted.Add(1)
+	m.active.Add(1)
+
+	m.mu.Lock()
+	m.conns[c.ID] = c
+	m.mu.Unlock()
+
+	return c
+}
+
+// Close records that c ended for the given reason
+func (m *Metrics) Close(c *Conn, reason string) {
+	m.closed.Add(1)
+	m.active.Add(-1)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.conns, c.ID)
+	m.closeReasons[reason]++
+}
+
+// Reject records a connection turned away before being served
+func (m *Metrics) Reject(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rejected[reason]++
+}
+
+// RecordPacket records a datagram exchange, which has no connection
+func (m *Metrics) RecordPacket(bytesIn, bytesOut int) {
+	m.bytesIn.Add(uint64(bytesIn))
+	m.bytesOut.Add(uint64(bytesOut))
+	m.frames.Add(1)
+}
+
+// Snapshot is a point-in-time copy of a listener's counters
+type Snapshot struct {
+	Accepted     uint64            `json:"connections_accepted"`
+	Active       int64             `json:"connections_active"`
+	Closed       uint64            `json:"connections_closed"`
+	BytesIn      uint64            `json:"bytes_in"`
+	BytesOut     uint64            `json:"bytes_out"`
+	Frames       uint64            `json:"frames"`
+	CloseReasons map[string]uint64 `json:"close_reasons"`
+	Rejected     map[string]uint64 `json:"rejected"`
+	Conns        []ConnSnapshot    `json:"connections"`
+}
+
+// Snapshot copies the current counters, with open connections sorted by ID
+func (m *Metrics) Snapshot() Snapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshot := Snapshot{
+		Accepted:     m.accepted.Load(),
+		Active:       m.active.Load(),
+		Closed:       m.closed.Load(),
+		BytesIn:      m.bytesIn.Load(),
+		BytesOut:     m.bytesOut.Load(),
+		Frames:       m.frames.Load(),
+		CloseReasons: make(map[string]uint64, len(m.closeReasons)),
+		Rejected:     make(map[string]uint64, len(m.rejected)),
+		Conns:        make([]ConnSnapshot, 0, len(m.conns)),
+	}
+
+	for reason, count := range m.closeReasons {
+		snapshot.CloseReasons[reason] = count
+	}
+	for reason, count := range m.rejected {
+		snapshot.Rejected[reason] = count
+	}
+	for _, c := range m.conns {
+		snapshot.Conns = append(snapshot.Conns, c.Snapshot())
+	}
+	sort.Slice(snapshot.Conns, func(i, j int) bool {
+		return snapshot.Conns[i].ID < snapshot.Conns[j].ID
+	})
+
+	return snapshot
+}
+
+// Conn holds counters for a single connection. Every update is also added
+// to the listener totals.
+type Conn struct {
+	ID         uint64
+	RemoteAddr string
+	Started    time.Time
+
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+	frames   atomic.Uint64
+	metrics  *Metrics
+}
+
+// AddBytesIn records bytes read from the client
+func (c *Conn) AddBytesIn(n int) {
+	c.bytesIn.Add(uint64(n))
+	c.metrics.bytesIn.Add(uint64(n))
+}
+
+// AddBytesOut records bytes written to the client
+func (c *Conn) AddBytesOut(n int) {
+	c.bytesOut.Add(uint64(n))
+	c.metrics.bytesOut.Add(uint64(n))
+}
+
+// AddFrame records one processed frame. It is safe to call on a nil Conn so
+// handlers don't need to check whether metrics are enabled.
+func (c *Conn) AddFrame() {
+	if c == nil {
+		return
+	}
+	c.frames.Add(1)
+	c.metrics.frames.Add(1)
+}
+
+// ConnSnapshot is a point-in-time copy of a connection's counters
+type ConnSnapshot struct {
+	ID         uint64    `json:"id"`
+	RemoteAddr string    `json:"remote_addr"`
+	Started    time.Time `json:"started"`
+	BytesIn    uint64    `json:"bytes_in"`
+	BytesOut   uint64    `json:"bytes_out"`
+	Frames     uint64    `json:"frames"`
+}
+
+// Snapshot copies the connection's counters
+func (c *Conn) Snapshot() ConnSnapshot {
+	return ConnSnapshot{
+		ID:         c.ID,
+		RemoteAddr: c.RemoteAddr,
+		Started:    c.Started,
+		BytesIn:    c.bytesIn.Load(),
+		BytesOut:   c.bytesOut.Load(),
+		Frames:     c.frames.Load(),
+	}
+}
+
+type connKey struct{}
+
+// WithConn returns a context carrying the connection's counters
+func WithConn(ctx context.Context, c *Conn) context.Context {
+	return context.WithValue(ctx, connKey{}, c)
+}
+
+// ConnFromContext returns the counters stored by WithConn, or nil
+func ConnFromContext(ctx context.Context) *Conn {
+	c, _ := ctx.Value(connKey{}).(*Conn)
+	return c
+}
@@ -0,0 +1,89 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics_ConnectionLifecycle(t *testing.T) {
+	m := New()
+
+	c := m.Open("127.0.0.1:5000")
+	c.AddBytesIn(10)
+	c.AddBytesOut(16)
+	c.AddFrame()
+
+	snapshot := m.Snapshot()
+	if snapshot.Accepted != 1 || snapshot.Active != 1 {
+		t.Errorf("Expected 1 accepted and 1 active, got %+v", snapshot)
+	}
+	if len(snapshot.Conns) != 1 || snapshot.Conns[0].BytesIn != 10 || snapshot.Conns[0].Frames != 1 {
+		t.Errorf("Unexpected per-connection counters: %+v", snapshot.Conns)
+	}
+
+	m.Close(c, "idle_timeout")
+
+	snapshot = m.Snapshot()
+	if snapshot.Active != 0 || snapshot.Closed != 1 {
+		t.Errorf("Expected 0 active and 1 closed, got %+v", snapshot)
+	}
+	if snapshot.BytesIn != 10 || snapshot.BytesOut != 16 || snapshot.Frames != 1 {
+		t.Errorf("Listener totals lost after close: %+v", snapshot)
+	}
+	if snapshot.CloseReasons["idle_timeout"] != 1 {
+		t.Errorf("Expected idle_timeout close reason, got %v", snapshot.CloseReasons)
+	}
+	if len(snapshot.Conns) != 0 {
+		t.Errorf("Closed connection still listed: %+v", snapshot.Conns)
+	}
+}
+
+func TestConnFromContext(t *testing.T) {
+	if ConnFromContext(context.Background()) != nil {
+		t.Error("Expected nil without a connection")
+	}
+
+	// AddFrame must be safe to call when metrics are not wired up
+	ConnFromContext(context.Background()).AddFrame()
+
+	c := New().Open("client")
+	if ConnFromContext(WithConn(context.Background(), c)) != c {
+		t.Error("Expected the stored connection back")
+	}
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	registry := NewRegistry()
+	m := registry.Listener("tcp://:9000")
+	m.Open("client").AddFrame()
+	m.Reject("max_conns")
+
+	rec := httptest.NewRecorder()
+	registry.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := rec.Body.String()
+	for _, line := range []string{
+		`tcp_echo_connections_active{listener="tcp://:9000"} 1`,
+		`tcp_echo_frames_total{listener="tcp://:9000"} 1`,
+		`tcp_echo_connections_rejected_total{listener="tcp://:9000",reason="max_conns"} 1`,
+		`# TYPE tcp_echo_connections_accepted_total counter`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected %q in Prometheus output:\n%s", line, body)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	registry.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+
+	var stats map[string]Snapshot
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatalf("Invalid JSON: %v", err)
+	}
+	if stats["tcp://:9000"].Accepted != 1 {
+		t.Errorf("Expected 1 accepted connection in JSON, got %+v", stats)
+	}
+}
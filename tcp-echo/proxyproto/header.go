@@ -0,0 +1,181 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+
+	// v1Prefix starts every human-readable (v1) header
+	v1Prefix = []byte("PROXY ")
+	// v2Signature starts every binary (v2) header
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// v1MaxLength is the longest possible v1 header including CRLF
+const v1MaxLength = 107
+
+// readHeader consumes a PROXY header from reader if one is present and
+// returns the source address it carries. It returns a nil address when the
+// stream has no header or the header does not carry a usable address
+// (v1 UNKNOWN, v2 LOCAL or an unsupported family).
+func readHeader(reader *bufio.Reader) (net.Addr, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch first[0] {
+	case v1Prefix[0]:
+		if ok, err := hasPrefix(reader, v1Prefix); !ok {
+			return nil, err
+		}
+		return readV1(reader)
+	case v2Signature[0]:
+		if ok, err := hasPrefix(reader, v2Signature); !ok {
+			return nil, err
+		}
+		return readV2(reader)
+	default:
+		return nil, nil
+	}
+}
+
+// hasPrefix reports whether the stream starts with prefix. Bytes are compared
+// as they arrive and it gives up as soon as they differ, so clients that send
+// a few bytes such as "PING\n" and wait for a reply are never stalled. A stream
+// that ends before the whole prefix arrived has no header.
+func hasPrefix(reader *bufio.Reader, prefix []byte) (bool, error) {
+	var err error
+	for {
+		// Compare what has arrived so far before waiting for more
+		peek, _ := reader.Peek(min(reader.Buffered(), len(prefix)))
+		if !bytes.HasPrefix(prefix, peek) {
+			return false, nil
+		}
+		if len(peek) == len(prefix) {
+			return true, nil
+		}
+
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		_, err = reader.Peek(len(peek) + 1)
+	}
+}
+
+// readV1 parses "PROXY TCP4 <src> <dst> <sport> <dport>\r\n"
+func readV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("%w: v1 header not terminated", ErrInvalidHeader)
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("%w: malformed v1 header %q", ErrInvalidHeader, line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("%w: bad v1 source address", ErrInvalidHeader)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readV2 parses the binary header: signature, version/command, family,
+// length and the address block, skipping any TLVs
+func readV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	version, command := header[12]>>4, header[12]&0x0F
+	if version != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidHeader, version)
+	}
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+
+	// LOCAL: health checks from the proxy itself, keep the real address
+	if command == 0x0 {
+		return nil, nil
+	}
+	if command != 0x1 {
+		return nil, fmt.Errorf("%w: unsupported command %d", ErrInvalidHeader, command)
+	}
+
+	family, transport := header[13]>>4, header[13]&0x0F
+	var ipLength int
+	switch family {
+	case 0x1: // AF_INET
+		ipLength = net.IPv4len
+	case 0x2: // AF_INET6
+		ipLength = net.IPv6len
+	default:
+		return nil, nil
+	}
+
+	// src addr, dst addr, src port, dst port
+	if len(body) < 2*ipLength+4 {
+		return nil, fmt.Errorf("%w: v2 address block too short", ErrInvalidHeader)
+	}
+	ip := net.IP(append([]byte(nil), body[:ipLength]...))
+	port := int(binary.BigEndian.Uint16(body[2*ipLength:]))
+
+	if transport == 0x2 {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// WriteV1Header writes a v1 header announcing a connection from src to dst.
+// Addresses that are not TCP are announced as UNKNOWN.
+func WriteV1Header(w io.Writer, src, dst net.Addr) error {
+	srcAddr, srcOK := src.(*net.TCPAddr)
+	dstAddr, dstOK := dst.(*net.TCPAddr)
+	if !srcOK || !dstOK {
+		_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+		return err
+	}
+
+	family := "TCP4"
+	if srcAddr.IP.To4() == nil {
+		family = "TCP6"
+	}
+
+	_, err := fmt.Fprintf(w, "PROXY %s %s %s %d %d\r\n",
+		family, srcAddr.IP, dstAddr.IP, srcAddr.Port, dstAddr.Port)
+	return err
+}
@@ -0,0 +1,181 @@
+// Package proxyproto parses HAProxy PROXY protocol v1 and v2 headers so that
+// connections relayed by a load balancer report the original client address.
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config holds configuration for PROXY protocol parsing
+type Config struct {
+	// Trusted lists the networks allowed to send PROXY headers. Headers from
+	// any other source are not parsed, so clients can't spoof their address.
+	Trusted []*net.IPNet
+	// HeaderTimeout bounds how long a trusted source may take to send the
+	// first byte before the connection is treated as having no header
+	HeaderTimeout time.Duration
+}
+
+// ParseTrusted parses a comma-separated list of CIDRs or bare IPs
+func ParseTrusted(list string) ([]*net.IPNet, error) {
+	var trusted []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %v", entry, err)
+		}
+		trusted = append(trusted, network)
+	}
+	return trusted, nil
+}
+
+// Listener wraps a net.Listener and returns connections that read a PROXY
+// header from trusted sources
+type Listener struct {
+	net.Listener
+	trusted       []*net.IPNet
+	headerTimeout time.Duration
+}
+
+// NewListener wraps listener with PROXY protocol support
+func NewListener(listener net.Listener, config Config) *Listener {
+	l := &Listener{
+		Listener:      listener,
+		trusted:       config.Trusted,
+		headerTimeout: config.HeaderTimeout,
+	}
+
+	// Set defaults
+	if l.headerTimeout == 0 {
+		l.headerTimeout = 5 * time.Second
+	}
+
+	return l
+}
+
+// Accept returns the next connection. The header is parsed lazily on the
+// first Read or RemoteAddr call, so a slow client never blocks Accept.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{
+		Conn:          conn,
+		reader:        bufio.NewReader(conn),
+		trusted:       l.isTrusted(conn.RemoteAddr()),
+		headerTimeout: l.headerTimeout,
+	}, nil
+}
+
+// isTrusted reports whether addr may send PROXY headers
+func (l *Listener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, network := range l.trusted {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Conn is a connection whose RemoteAddr reports the address from the PROXY
+// header when one was sent by a trusted source
+type Conn struct {
+	net.Conn
+	reader        *bufio.Reader
+	trusted       bool
+	headerTimeout time.Duration
+
+	once       sync.Once
+	sourceAddr net.Addr
+	headerErr  error
+}
+
+// Read reads application data following the header
+func (c *Conn) Read(p []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+	return c.reader.Read(p)
+}
+
+// RemoteAddr returns the client address from the PROXY header, falling back
+// to the address of the connecting peer
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.sourceAddr != nil {
+		return c.sourceAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// CloseWrite half-closes the underlying connection if it supports it
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// NetConn returns the wrapped connection
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// readHeader parses the PROXY header once for trusted sources
+func (c *Conn) readHeader() {
+	if !c.trusted {
+		return
+	}
+
+	c.Conn.SetReadDeadline(time.Now().Add(c.headerTimeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	addr, err := readHeader(c.reader)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() && c.reader.Buffered() == 0 {
+			// Nothing sent yet, so there is no header to wait for. The reader
+			// holds on to the timeout error, so start over with a fresh one.
+			c.reader = bufio.NewReader(c.Conn)
+			return
+		}
+		if errors.Is(err, io.EOF) {
+			c.headerErr = err
+			return
+		}
+
+		log.Printf("failed to read PROXY header from %s: %v", c.Conn.RemoteAddr(), err)
+		c.headerErr = err
+		return
+	}
+	c.sourceAddr = addr
+}
@@ -0,0 +1,215 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func v2Header(command, family byte, addresses []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadHeader(t *testing.T) {
+	ipv4 := []byte{203, 0, 113, 7, 10, 0, 0, 1, 0x0F, 0xA0, 0x23, 0x28} // 203.0.113.7:4000 -> 10.0.0.1:9000
+	ipv6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x00, 0x50, 0x00, 0x51)
+
+	tests := []struct {
+		name     string
+		input    []byte
+		expected string // Expected source address, "" for none
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 4000 9000\r\n"), "203.0.113.7:4000"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 80 81\r\n"), "[2001:db8::1]:80"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v2 tcp4", v2Header(0x1, 0x11, ipv4), "203.0.113.7:4000"},
+		{"v2 tcp6", v2Header(0x1, 0x21, ipv6), "[2001:db8::1]:80"},
+		{"v2 local", v2Header(0x0, 0x00, nil), ""},
+		{"v2 with tlv", v2Header(0x1, 0x11, append(ipv4, 0x04, 0x00, 0x01, 0xFF)), "203.0.113.7:4000"},
+		{"no header", []byte("hello\n"), ""},
+		{"starts like v1", []byte("PING\n"), ""},
+		{"starts like v2", []byte("\r\n\r\nhi"), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Whether the input arrives at once or a byte at a time
+			for _, oneByte := range []bool{false, true} {
+				// Application data after the header must be left untouched
+				var input io.Reader = bytes.NewReader(append(tt.input, "payload"...))
+				if oneByte {
+					input = iotest.OneByteReader(input)
+				}
+				reader := bufio.NewReader(input)
+
+				addr, err := readHeader(reader)
+				if err != nil {
+					t.Fatalf("readHeader failed: %v", err)
+				}
+
+				got := ""
+				if addr != nil {
+					got = addr.String()
+				}
+				if got != tt.expected {
+					t.Errorf("Expected source %q, got %q", tt.expected, got)
+				}
+
+				rest, _ := io.ReadAll(reader)
+				if !strings.HasSuffix(string(rest), "payload") {
+					t.Errorf("Application data was consumed, left %q", rest)
+				}
+			}
+		})
+	}
+}
+
+func TestReadHeader_Malformed(t *testing.T) {
+	for _, input := range []string{
+		"PROXY TCP4 not-an-ip 10.0.0.1 1 2\r\n",
+		"PROXY TCP4 1.2.3.4 10.0.0.1 1\r\n",
+		"PROXY TCP4 1.2.3.4 10.0.0.1 1 2\n",
+	} {
+		if _, err := readHeader(bufio.NewReader(strings.NewReader(input))); err == nil {
+			t.Errorf("Expected error for %q", input)
+		}
+	}
+}
+
+func TestWriteV1Header_RoundTrip(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("198.51.100.2"), Port: 5555}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 9000}
+
+	var buf bytes.Buffer
+	if err := WriteV1Header(&buf, src, dst); err != nil {
+		t.Fatalf("WriteV1Header failed: %v", err)
+	}
+
+	addr, err := readHeader(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("readHeader failed: %v", err)
+	}
+	if addr.String() != src.String() {
+		t.Errorf("Expected %s, got %s", src, addr)
+	}
+}
+
+// acceptOne wraps a local listener and returns the accepted conn for a client
+// that sends data
+func acceptOne(t *testing.T, config Config, data string) (net.Conn, net.Conn) {
+	t.Helper()
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	listener := NewListener(raw, config)
+	t.Cleanup(func() { listener.Close() })
+
+	client, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	client.Write([]byte(data))
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Accept failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return client, conn
+}
+
+func TestListener_TrustedSource(t *testing.T) {
+	trusted, _ := ParseTrusted("127.0.0.1")
+	_, conn := acceptOne(t, Config{Trusted: trusted}, "PROXY TCP4 203.0.113.7 10.0.0.1 4000 9000\r\nhi")
+
+	if got := conn.RemoteAddr().String(); got != "203.0.113.7:4000" {
+		t.Errorf("Expected header address, got %s", got)
+	}
+
+	buf := make([]byte, 2)
+	io.ReadFull(conn, buf)
+	if string(buf) != "hi" {
+		t.Errorf("Expected payload after header, got %q", buf)
+	}
+}
+
+func TestListener_UntrustedSourceIsNotParsed(t *testing.T) {
+	trusted, _ := ParseTrusted("192.0.2.0/24")
+	header := "PROXY TCP4 203.0.113.7 10.0.0.1 4000 9000\r\n"
+	_, conn := acceptOne(t, Config{Trusted: trusted}, header)
+
+	if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != "127.0.0.1" {
+		t.Errorf("Untrusted header was honoured, got %s", conn.RemoteAddr())
+	}
+
+	// The spoofed header is passed through as ordinary data
+	buf := make([]byte, len(header))
+	io.ReadFull(conn, buf)
+	if string(buf) != header {
+		t.Errorf("Expected header bytes as data, got %q", buf)
+	}
+}
+
+func TestListener_TrustedSourceWithoutHeader(t *testing.T) {
+	trusted, _ := ParseTrusted("127.0.0.1")
+	client, conn := acceptOne(t, Config{Trusted: trusted, HeaderTimeout: 50 * time.Millisecond}, "")
+
+	// Nothing sent before the timeout, so the peer address is used
+	if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != "127.0.0.1" {
+		t.Errorf("Expected peer address, got %s", conn.RemoteAddr())
+	}
+
+	client.Write([]byte("late"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "late" {
+		t.Errorf("Expected data after timeout, got %q, %v", buf, err)
+	}
+}
+
+func TestListener_TrustedSourceShortPayload(t *testing.T) {
+	trusted, _ := ParseTrusted("127.0.0.1")
+
+	// Short messages that start like "PROXY " but diverge from it
+	for _, data := range []string{"P\n", "PING\n", "PROX\n"} {
+		_, conn := acceptOne(t, Config{Trusted: trusted, HeaderTimeout: 2 * time.Second}, data)
+
+		start := time.Now()
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != data {
+			t.Errorf("Expected %q as data, got %q, %v", data, buf, err)
+		}
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("%q waited %s for the header timeout", data, elapsed)
+		}
+	}
+}
+
+func TestParseTrusted(t *testing.T) {
+	trusted, err := ParseTrusted("10.0.0.0/8, 127.0.0.1, ::1")
+	if err != nil {
+		t.Fatalf("ParseTrusted failed: %v", err)
+	}
+	if len(trusted) != 3 {
+		t.Fatalf("Expected 3 networks, got %d", len(trusted))
+	}
+	if !trusted[0].Contains(net.ParseIP("10.1.2.3")) || !trusted[2].Contains(net.ParseIP("::1")) {
+		t.Error("Parsed networks don't contain expected addresses")
+	}
+
+	if _, err := ParseTrusted("not-an-ip"); err == nil {
+		t.Error("Expected error for invalid entry")
+	}
+}
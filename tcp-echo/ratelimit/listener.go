@@ -0,0 +1,80 @@
+package ratelimit
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"rate-limiter/ratelimiter"
+)
+
+// rejectWriteTimeout bounds the courtesy error line so a rejected client
+// can't stall Accept
+const rejectWriteTimeout = 100 * time.Millisecond
+
+// ListenerConfig holds configuration for a rate limited listener
+type ListenerConfig struct {
+	Limiter  ratelimiter.RateLimiter // Allows or refuses each new connection, keyed by source IP
+	OnReject func(ip string)         // Called for every refused connection, e.g. to count it
+
+	// Close refused connections without the error line, for listeners that
+	// will speak TLS, where a plaintext line would only confuse the handshake
+	Silent bool
+}
+
+// Listener refuses connections from source IPs that connect faster than its
+// limiter allows. It keys on the connecting address, so behind a PROXY
+// protocol load balancer every client shares the balancer's limit.
+type Listener struct {
+	net.Listener
+	limiter  ratelimiter.RateLimiter
+	onReject func(ip string)
+	silent   bool
+}
+
+// NewListener wraps listener with a per-IP connection rate limit
+func NewListener(listener net.Listener, config ListenerConfig) *Listener {
+	return &Listener{
+		Listener: listener,
+		limiter:  config.Limiter,
+		onReject: config.OnReject,
+		silent:   config.Silent,
+	}
+}
+
+// Accept returns the next connection whose source IP is within its limit.
+// Refused connections get an error line, unless the listener is silent, and
+// are closed.
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := remoteIP(conn)
+		if l.limiter.Allow(ip) {
+			return conn, nil
+		}
+
+		if l.onReject != nil {
+			l.onReject(ip)
+		}
+		if !l.silent {
+			conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+			fmt.Fprintf(conn, "ERR %v\n", ErrRateLimited)
+		}
+		conn.Close()
+	}
+}
+
+// remoteIP returns the host part of the connection's remote address
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,222 @@
+// Package ratelimit protects servers with the algorithms from
+// rate-limiter/ratelimiter: a listener that limits how often each source IP
+// may connect, and a per-connection limit on messages.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"rate-limiter/ratelimiter"
+)
+
+var (
+	// ErrRateLimited is returned by Messages.Wait when the connection should
+	// be closed for sending too fast
+	ErrRateLimited = errors.New("rate limit exceeded")
+
+	// ErrDropped is returned by Messages.Wait when the message should be
+	// ignored and the connection kept open
+	ErrDropped = errors.New("message dropped by rate limit")
+)
+
+// Algorithms accepted by NewLimiter
+const (
+	FixedWindow   = "fixed"
+	SlidingWindow = "sliding"
+	TokenBucket   = "token"
+)
+
+// NewLimiter creates a limiter allowing limit events per window for each
+// identifier, using one of the FixedWindow, SlidingWindow or TokenBucket
+// algorithms. Identifiers are forgotten once they have been idle for a window.
+func NewLimiter(algorithm string, limit int, window time.Duration) (ratelimiter.RateLimiter, error) {
+	if limit <= 0 || window <= 0 {
+		return nil, fmt.Errorf("rate limit needs a positive limit and window, got %d per %s", limit, window)
+	}
+
+	var newLimiter func() ratelimiter.RateLimiter
+	switch algorithm {
+	case FixedWindow:
+		newLimiter = func() ratelimiter.RateLimiter { return ratelimiter.NewFixedWindow(limit, window) }
+	case SlidingWindow:
+		newLimiter = func() ratelimiter.RateLimiter { return ratelimiter.NewSlidingWindow(limit, window) }
+	case TokenBucket:
+		newLimiter = func() ratelimiter.RateLimiter { return ratelimiter.NewTokenBucket(limit, limit, window) }
+	default:
+		return nil, fmt.Errorf("unknown rate limit algorithm %q", algorithm)
+	}
+
+	return &expiringLimiter{
+		newLimiter: newLimiter,
+		window:     window,
+		limiters:   make(map[string]*idleLimiter),
+		lastSweep:  time.Now(),
+	}, nil
+}
+
+// expiringLimiter gives each identifier its own limiter and drops it once the
+// identifier has been idle for a window. The ratelimiter algorithms keep every
+// identifier they have seen, which grows without bound for source IPs. After a
+// window without events each algorithm is back to its initial state, so
+// dropping the identifier doesn't change any decision.
+type expiringLimiter struct {
+	newLimiter func() ratelimiter.RateLimiter
+	window     time.Duration
+
+	mu        sync.Mutex
+	limiters  map[string]*idleLimiter
+	lastSweep time.Time
+}
+
+type idleLimiter struct {
+	ratelimiter.RateLimiter
+	lastSeen time.Time
+}
+
+// Allow reports whether identifier may have another event
+func (l *expiringLimiter) Allow(identifier string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	// Sweep at most once a window so Allow stays cheap
+	if now.Sub(l.lastSweep) > l.window {
+		for id, limiter := range l.limiters {
+			if now.Sub(limiter.lastSeen) > l.window {
+				delete(l.limiters, id)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	limiter, exists := l.limiters[identifier]
+	if !exists {
+		limiter = &idleLimiter{RateLimiter: l.newLimiter()}
+		l.limiters[identifier] = limiter
+	}
+	limiter.lastSeen = now
+	return limiter.Allow(identifier)
+}
+
+// size returns the number of identifiers being tracked
+func (l *expiringLimiter) size() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.limiters)
+}
+
+// Action is what happens to a message over the limit
+type Action int
+
+const (
+	Delay      Action = iota // Hold the message until the limit allows it
+	Drop                     // Ignore the message and keep the connection
+	Disconnect               // Close the connection
+)
+
+func (a Action) String() string {
+	switch a {
+	case Delay:
+		return "delay"
+	case Drop:
+		return "drop"
+	case Disconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseAction parses "delay", "drop" or "disconnect"
+func ParseAction(s string) (Action, error) {
+	for _, action := range []Action{Delay, Drop, Disconnect} {
+		if action.String() == s {
+			return action, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown rate limit action %q", s)
+}
+
+// MessageConfig limits the messages each connection may send
+type MessageConfig struct {
+	Rate   int    // Messages per second
+	Burst  int    // Messages allowed back to back, defaults to Rate
+	Action Action // What happens to messages over the limit
+}
+
+// Messages limits one connection's messages with a token bucket
+type Messages struct {
+	limiter ratelimiter.RateLimiter
+	action  Action
+	retry   time.Duration // How often Delay checks for a free token
+}
+
+// NewMessages creates a limiter for a single connection
+func NewMessages(config MessageConfig) *Messages {
+	burst := config.Burst
+
+	// Set defaults
+	if burst <= 0 {
+		burst = config.Rate
+	}
+
+	// Each connection gets its own bucket so nothing outlives the connection
+	return &Messages{
+		limiter: ratelimiter.NewTokenBucket(burst, config.Rate, time.Second),
+		action:  config.Action,
+		retry:   max(time.Second/time.Duration(max(config.Rate, 1)), time.Millisecond),
+	}
+}
+
+// Wait decides what to do with the next message. It returns nil once the
+// message may be processed, ErrDropped if it should be skipped or
+// ErrRateLimited if the connection should be closed. It is safe to call on a
+// nil Messages, which allows everything.
+func (m *Messages) Wait(ctx context.Context) error {
+	if m == nil || m.limiter.Allow("") {
+		return nil
+	}
+
+	switch m.action {
+	case Drop:
+		return ErrDropped
+	case Disconnect:
+		return ErrRateLimited
+	}
+
+	timer := time.NewTimer(m.retry)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			// The server is draining, let the message through so the
+			// connection can finish
+			return nil
+		case <-timer.C:
+		}
+
+		if m.limiter.Allow("") {
+			return nil
+		}
+		timer.Reset(m.retry)
+	}
+}
+
+type messagesKey struct{}
+
+// WithMessages returns a context carrying the connection's message limiter
+func WithMessages(ctx context.Context, m *Messages) context.Context {
+	return context.WithValue(ctx, messagesKey{}, m)
+}
+
+// MessagesFromContext returns the connection's message limiter, or nil if
+// messages aren't limited
+func MessagesFromContext(ctx context.Context) *Messages {
+	m, _ := ctx.Value(messagesKey{}).(*Messages)
+	return m
+}
@@ -0,0 +1,200 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewLimiter(t *testing.T) {
+	for _, algorithm := range []string{FixedWindow, SlidingWindow, TokenBucket} {
+		t.Run(algorithm, func(t *testing.T) {
+			limiter, err := NewLimiter(algorithm, 2, time.Minute)
+			if err != nil {
+				t.Fatalf("NewLimiter failed: %v", err)
+			}
+
+			if !limiter.Allow("10.0.0.1") || !limiter.Allow("10.0.0.1") {
+				t.Fatal("Expected the first two events to be allowed")
+			}
+			if limiter.Allow("10.0.0.1") {
+				t.Error("Expected the third event to be refused")
+			}
+			if !limiter.Allow("10.0.0.2") {
+				t.Error("Expected another identifier to have its own limit")
+			}
+		})
+	}
+
+	if _, err := NewLimiter("leaky", 1, time.Second); err == nil {
+		t.Error("Expected an error for an unknown algorithm")
+	}
+	if _, err := NewLimiter(FixedWindow, 0, time.Second); err == nil {
+		t.Error("Expected an error for a zero limit")
+	}
+}
+
+func TestNewLimiter_ForgetsIdleIdentifiers(t *testing.T) {
+	for _, algorithm := range []string{FixedWindow, SlidingWindow, TokenBucket} {
+		t.Run(algorithm, func(t *testing.T) {
+			limiter, _ := NewLimiter(algorithm, 1, 50*time.Millisecond)
+
+			for i := range 100 {
+				limiter.Allow(fmt.Sprintf("10.0.0.%d", i))
+			}
+			if limiter.Allow("10.0.0.1") {
+				t.Fatal("Expected a second event within the window to be refused")
+			}
+
+			// A window later only the newest identifier is tracked, and the
+			// forgotten ones start over with their full limit
+			time.Sleep(60 * time.Millisecond)
+			if !limiter.Allow("10.0.0.1") {
+				t.Error("Expected an idle identifier to be allowed again")
+			}
+			if size := limiter.(*expiringLimiter).size(); size != 1 {
+				t.Errorf("Expected idle identifiers to be dropped, still tracking %d", size)
+			}
+		})
+	}
+}
+
+func TestMessages_Actions(t *testing.T) {
+	tests := []struct {
+		action Action
+		want   error
+	}{
+		{Drop, ErrDropped},
+		{Disconnect, ErrRateLimited},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.action.String(), func(t *testing.T) {
+			messages := NewMessages(MessageConfig{Rate: 1, Action: tt.action})
+
+			if err := messages.Wait(context.Background()); err != nil {
+				t.Fatalf("Expected the first message to pass, got %v", err)
+			}
+			if err := messages.Wait(context.Background()); !errors.Is(err, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestMessages_Delay(t *testing.T) {
+	messages := NewMessages(MessageConfig{Rate: 20, Burst: 1, Action: Delay})
+	messages.Wait(context.Background())
+
+	// The next token comes 50ms later
+	start := time.Now()
+	if err := messages.Wait(context.Background()); err != nil {
+		t.Fatalf("Wait failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("Expected the message to be held back, waited %s", elapsed)
+	}
+
+	// Cancellation lets the message through instead of blocking a drain
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := NewMessages(MessageConfig{Rate: 1}).Wait(ctx); err != nil {
+		t.Errorf("Expected nil after cancellation, got %v", err)
+	}
+}
+
+func TestMessages_NilAllowsEverything(t *testing.T) {
+	ctx := context.Background()
+	if err := MessagesFromContext(ctx).Wait(ctx); err != nil {
+		t.Errorf("Expected a nil limiter to allow messages, got %v", err)
+	}
+}
+
+func TestListener_RefusesFastIPs(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	limiter, _ := NewLimiter(FixedWindow, 2, time.Minute)
+
+	rejected := make(chan string, 1)
+	listener := NewListener(inner, ListenerConfig{
+		Limiter:  limiter,
+		OnReject: func(ip string) { rejected <- ip },
+	})
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("welcome\n"))
+		}
+	}()
+
+	for i, want := range []string{"welcome\n", "welcome\n", "ERR rate limit exceeded\n"} {
+		conn, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		defer conn.Close()
+
+		got, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			t.Fatalf("Read %d failed: %v", i, err)
+		}
+		if got != want {
+			t.Errorf("Connection %d: expected %q, got %q", i, want, got)
+		}
+	}
+
+	if ip := <-rejected; ip != "127.0.0.1" {
+		t.Errorf("Expected 127.0.0.1 to be rejected, got %q", ip)
+	}
+}
+
+func TestListener_SilentClosesWithoutErrorLine(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	limiter, _ := NewLimiter(FixedWindow, 1, time.Minute)
+
+	listener := NewListener(inner, ListenerConfig{Limiter: limiter, Silent: true})
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	first, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer first.Close()
+
+	refused, err := net.Dial("tcp", inner.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer refused.Close()
+
+	// Under TLS the client expects a handshake, so nothing is written
+	refused.SetReadDeadline(time.Now().Add(time.Second))
+	if data, err := io.ReadAll(refused); err != nil || len(data) != 0 {
+		t.Errorf("Expected the connection to be closed without data, got %q, %v", data, err)
+	}
+}
@@ -0,0 +1,180 @@
+// Package reactor serves the newline echo protocol from a few epoll event
+// loops instead of a goroutine per connection. Read buffers are pooled and
+// only borrowed while a connection has data, so an idle client costs a small
+// struct rather than a goroutine stack and a bufio.Reader. It is only
+// available on Linux.
+package reactor
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tcp-echo/framing"
+	"tcp-echo/metrics"
+	"tcp-echo/server"
+)
+
+// ErrUnsupported is returned by Serve on platforms without epoll
+var ErrUnsupported = errors.New("reactor mode is only supported on linux")
+
+// DefaultBufferSize is used when Config.BufferSize is zero
+const DefaultBufferSize = 16 * 1024
+
+// Config holds configuration for the reactor
+type Config struct {
+	Network      string        // "tcp" (default), "tcp4" or "tcp6"
+	Addr         string        // Address to listen on, e.g. ":9000"
+	Prefix       string        // Prepended to every echoed line
+	MaxLineSize  int           // Longest accepted line, defaults to framing.DefaultMaxFrameSize
+	BufferSize   int           // Size of each pooled read buffer
+	Loops        int           // Number of event loops, defaults to GOMAXPROCS
+	DrainTimeout time.Duration // How long Shutdown waits for pending echoes to be written
+	IdleTimeout  time.Duration // Close connections with no traffic for this long (0 = never)
+
+	Metrics *metrics.Metrics // Counters for this listener, created if nil
+
+	// Already open listener for ListenAndServe to use instead of listening
+	// on Addr, e.g. one inherited from the previous process during an upgrade
+	Listener net.Listener
+}
+
+// Server accepts connections and echoes lines from its event loops
+type Server struct {
+	network      string
+	addr         string
+	prefix       []byte
+	maxLineSize  int
+	bufferSize   int
+	numLoops     int
+	drainTimeout time.Duration
+	idleTimeout  time.Duration
+	metrics      *metrics.Metrics
+
+	inheritedListener net.Listener
+
+	buffers   sync.Pool // *[]byte of bufferSize
+	active    atomic.Int64
+	state     atomic.Int32
+	acceptors atomic.Int32 // Loops still accepting on the listener
+	open      atomic.Int64 // Connections open when Shutdown started
+	killed    atomic.Int64 // Connections force-closed after the drain timeout
+	done      chan struct{}
+
+	mu       sync.Mutex
+	listener net.Listener
+	loops    []*loop
+	closed   bool
+}
+
+// Server states, only ever moving forward
+const (
+	stateRunning int32 = iota
+	stateDraining
+	stateClosed
+)
+
+// NewServer creates a new reactor server
+func NewServer(config Config) *Server {
+	s := &Server{
+		network:      config.Network,
+		addr:         config.Addr,
+		prefix:       []byte(config.Prefix),
+		maxLineSize:  config.MaxLineSize,
+		bufferSize:   config.BufferSize,
+		numLoops:     config.Loops,
+		drainTimeout: config.DrainTimeout,
+		idleTimeout:  config.IdleTimeout,
+		metrics:      config.Metrics,
+
+		inheritedListener: config.Listener,
+
+		done: make(chan struct{}),
+	}
+
+	// Set defaults
+	if s.network == "" {
+		s.network = "tcp"
+	}
+	if s.maxLineSize == 0 {
+		s.maxLineSize = framing.DefaultMaxFrameSize
+	}
+	if s.bufferSize == 0 {
+		s.bufferSize = DefaultBufferSize
+	}
+	if s.numLoops == 0 {
+		s.numLoops = runtime.GOMAXPROCS(0)
+	}
+	if s.drainTimeout == 0 {
+		s.drainTimeout = 10 * time.Second
+	}
+	if s.metrics == nil {
+		s.metrics = metrics.New()
+	}
+
+	s.buffers.New = func() any {
+		buf := make([]byte, s.bufferSize)
+		return &buf
+	}
+	return s
+}
+
+// ListenAndServe listens on the configured address and serves connections
+func (s *Server) ListenAndServe() error {
+	listener := s.inheritedListener
+	if listener == nil {
+		var err error
+		if listener, err = net.Listen(s.network, s.addr); err != nil {
+			return err
+		}
+	}
+	log.Printf("listening on %s/%s (reactor, %d loops)", s.network, listener.Addr(), s.numLoops)
+
+	return s.Serve(listener)
+}
+
+// Addr returns the listener address, or nil if the server is not serving yet
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// File returns a duplicate of the listening socket so it can be passed to a
+// new process
+func (s *Server) File() (*os.File, error) {
+	s.mu.Lock()
+	listener := s.listener
+	s.mu.Unlock()
+
+	if listener == nil {
+		return nil, server.ErrNotListening
+	}
+
+	filer, ok := listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("%T can't be passed to another process", listener)
+	}
+	return filer.File()
+}
+
+// Metrics returns the server's counters
+func (s *Server) Metrics() *metrics.Metrics {
+	return s.metrics
+}
+
+// Stats returns a snapshot of the connection counters. The reactor has no
+// connection limits, so nothing is ever rejected.
+func (s *Server) Stats() server.Stats {
+	return server.Stats{Active: int(s.active.Load())}
+}
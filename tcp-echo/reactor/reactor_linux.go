@@ -0,0 +1,628 @@
+//go:build linux
+
+package reactor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"tcp-echo/metrics"
+	"tcp-echo/server"
+)
+
+const (
+	epollExclusive = 1 << 28 // EPOLLEXCLUSIVE, missing from package syscall
+
+	readEvents  = syscall.EPOLLIN | syscall.EPOLLRDHUP
+	writeEvents = syscall.EPOLLOUT
+
+	maxEvents   = 128 // Events handled per epoll_wait
+	acceptBatch = 64  // Connections accepted per wakeup, so one loop can't hog the backlog
+)
+
+// loop is one epoll instance and the connections it owns. Only the loop's
+// own goroutine touches its connections, so they need no locking.
+type loop struct {
+	srv    *Server
+	epfd   int
+	poller *os.File        // epfd, registered with the Go runtime's poller
+	raw    syscall.RawConn // Waits on poller without holding a thread
+	lfd    int
+	wakeR  int
+	wakeW  int
+	conns  map[int]*conn
+	now    int64 // Time of the last wakeup in UnixNano
+
+	accepting bool
+	draining  bool
+}
+
+// conn is everything an open connection costs while idle
+type conn struct {
+	fd         int
+	lastActive int64
+	partial    []byte // Start of a line still waiting for its '\n'
+	pending    []byte // Echoes the client isn't ready to receive yet
+	closing    bool   // Close once pending is written
+	stats      *metrics.Conn
+}
+
+// Serve accepts connections on listener until the server is closed. The
+// listener stays open for Addr and File; the loops accept on a duplicate of
+// its socket.
+func (s *Server) Serve(listener net.Listener) error {
+	lfd, err := dupSocket(listener)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	loops := make([]*loop, 0, s.numLoops)
+	for range s.numLoops {
+		l, err := newLoop(s, lfd)
+		if err != nil {
+			for _, l := range loops {
+				l.close()
+			}
+			syscall.Close(lfd)
+			listener.Close()
+			return err
+		}
+		loops = append(loops, l)
+	}
+	s.acceptors.Store(int32(len(loops)))
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		for _, l := range loops {
+			l.close()
+		}
+		syscall.Close(lfd)
+		listener.Close()
+		return server.ErrServerClosed
+	}
+	s.listener = listener
+	s.loops = loops
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, l := range loops {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.run()
+		}()
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	for _, l := range loops {
+		l.close()
+	}
+	s.loops = nil
+	s.mu.Unlock()
+
+	close(s.done)
+	return server.ErrServerClosed
+}
+
+// Close stops accepting and immediately closes all open connections
+func (s *Server) Close() error {
+	serving, err := s.stop(stateClosed)
+	if serving {
+		<-s.done
+	}
+	return err
+}
+
+// Shutdown stops accepting new connections, closes idle ones and lets the
+// rest finish writing their pending echoes. Connections still open after the
+// drain timeout are force-closed.
+func (s *Server) Shutdown() server.ShutdownSummary {
+	if serving, _ := s.stop(stateDraining); !serving {
+		return server.ShutdownSummary{}
+	}
+
+	select {
+	case <-s.done:
+	case <-time.After(s.drainTimeout):
+		s.stop(stateClosed)
+		<-s.done
+	}
+
+	open, killed := int(s.open.Load()), int(s.killed.Load())
+	return server.ShutdownSummary{Drained: open - killed, Killed: killed}
+}
+
+// stop moves the server to state and wakes the loops to act on it. It
+// reports whether Serve is running and needs to be waited for.
+func (s *Server) stop(state int32) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	for {
+		// Never move backwards, e.g. Shutdown after Close
+		old := s.state.Load()
+		if old >= state || s.state.CompareAndSwap(old, state) {
+			break
+		}
+	}
+
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for _, l := range s.loops {
+		l.wake()
+	}
+	return s.listener != nil, err
+}
+
+// dupSocket duplicates listener's socket for the event loops. The duplicate
+// shares the listener's non-blocking mode.
+func dupSocket(listener net.Listener) (int, error) {
+	conn, ok := listener.(syscall.Conn)
+	if !ok {
+		return -1, fmt.Errorf("%T has no socket to poll", listener)
+	}
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	fd, dupErr := -1, error(nil)
+	err = raw.Control(func(socket uintptr) {
+		r, _, errno := syscall.Syscall(syscall.SYS_FCNTL, socket, syscall.F_DUPFD_CLOEXEC, 0)
+		if errno != 0 {
+			dupErr = errno
+			return
+		}
+		fd = int(r)
+	})
+	if err != nil {
+		return -1, err
+	}
+	return fd, dupErr
+}
+
+// newLoop creates an epoll instance watching the listener and a wakeup pipe
+func newLoop(s *Server, lfd int) (*loop, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	// A non-blocking descriptor makes os.NewFile register it with the runtime
+	if err := syscall.SetNonblock(epfd, true); err != nil {
+		syscall.Close(epfd)
+		return nil, err
+	}
+	poller := os.NewFile(uintptr(epfd), "epoll")
+	raw, err := poller.SyscallConn()
+	if err != nil {
+		poller.Close()
+		return nil, err
+	}
+
+	var wake [2]int
+	if err := syscall.Pipe2(wake[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC); err != nil {
+		poller.Close()
+		return nil, err
+	}
+
+	l := &loop{
+		srv:       s,
+		epfd:      epfd,
+		poller:    poller,
+		raw:       raw,
+		lfd:       lfd,
+		wakeR:     wake[0],
+		wakeW:     wake[1],
+		conns:     make(map[int]*conn),
+		accepting: true,
+	}
+
+	// Exclusive wakeups spread new connections across the loops instead of
+	// waking all of them for every connection
+	err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, lfd, &syscall.EpollEvent{Events: syscall.EPOLLIN | epollExclusive, Fd: int32(lfd)})
+	if err == nil {
+		err = syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, l.wakeR, &syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(l.wakeR)})
+	}
+	if err != nil {
+		l.close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// run handles events until the server is closed, or is draining and every
+// connection is gone
+func (l *loop) run() {
+	defer l.stopAccepting()
+
+	// Idle connections are looked for at least this often
+	var timeout time.Duration
+	if l.srv.idleTimeout > 0 {
+		timeout = min(l.srv.idleTimeout, time.Second)
+	}
+	nextSweep := time.Now().Add(l.srv.idleTimeout).UnixNano()
+
+	events := make([]syscall.EpollEvent, maxEvents)
+	for {
+		n, err := l.wait(events, timeout)
+		if err != nil && err != syscall.EINTR {
+			log.Printf("event loop stopped, err: %v", err)
+			l.closeAll("error")
+			return
+		}
+		l.now = time.Now().UnixNano()
+
+		for _, event := range events[:max(n, 0)] {
+			switch fd := int(event.Fd); fd {
+			case l.lfd:
+				l.accept()
+			case l.wakeR:
+				l.drainWakeups()
+			default:
+				c := l.conns[fd]
+				if c == nil {
+					continue
+				}
+				if event.Events&writeEvents != 0 {
+					l.flush(c)
+				}
+				// Errors and hangups are picked up by the read
+				if event.Events&^writeEvents != 0 && l.conns[fd] == c {
+					l.read(c)
+				}
+			}
+		}
+
+		switch l.srv.state.Load() {
+		case stateDraining:
+			l.drain()
+		case stateClosed:
+			l.srv.killed.Add(int64(len(l.conns)))
+			l.closeAll("killed")
+			return
+		}
+		if l.draining && len(l.conns) == 0 {
+			return
+		}
+
+		if l.srv.idleTimeout > 0 && l.now >= nextSweep {
+			l.sweep()
+			nextSweep = l.now + timeout.Nanoseconds()
+		}
+	}
+}
+
+// wait returns the next batch of events, or none once timeout passes. The
+// waiting itself is left to the runtime: a goroutine blocked in epoll_wait
+// keeps its thread's scheduler slot until sysmon takes it back, which stalls
+// other goroutines when there are few CPUs.
+func (l *loop) wait(events []syscall.EpollEvent, timeout time.Duration) (int, error) {
+	if timeout > 0 {
+		l.poller.SetReadDeadline(time.Now().Add(timeout))
+	}
+
+	var (
+		n       int
+		waitErr error
+	)
+	err := l.raw.Read(func(fd uintptr) bool {
+		n, waitErr = syscall.EpollWait(int(fd), events, 0)
+		return n > 0 || waitErr != nil
+	})
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return n, waitErr
+}
+
+// accept takes new connections off the listener's backlog
+func (l *loop) accept() {
+	if !l.accepting {
+		return
+	}
+
+	for range acceptBatch {
+		fd, sa, err := syscall.Accept4(l.lfd, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+		if err != nil {
+			// Another loop got there first, or the client already gave up
+			if err == syscall.EAGAIN || err == syscall.ECONNABORTED {
+				return
+			}
+			log.Printf("failed to accept connection, err: %v", err)
+			return
+		}
+
+		// Match net.TCPConn, which disables Nagle by default
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_NODELAY, 1)
+
+		if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: readEvents, Fd: int32(fd)}); err != nil {
+			log.Printf("failed to watch connection, err: %v", err)
+			syscall.Close(fd)
+			continue
+		}
+
+		l.conns[fd] = &conn{
+			fd:         fd,
+			lastActive: l.now,
+			stats:      l.srv.metrics.Open(sockaddrString(sa)),
+		}
+		l.srv.active.Add(1)
+	}
+}
+
+// read echoes the complete lines in whatever the client has sent
+func (l *loop) read(c *conn) {
+	buf := l.srv.buffers.Get().(*[]byte)
+	defer l.srv.buffers.Put(buf)
+
+	n, err := syscall.Read(c.fd, *buf)
+	switch {
+	case err == syscall.EAGAIN:
+		return
+	case err != nil:
+		l.closeConn(c, closeReason(err))
+		return
+	case n == 0:
+		// The client is done sending. Like the line framer, a final line
+		// without '\n' is still echoed, then everything owed is delivered
+		// before closing.
+		if len(c.partial) > 0 {
+			l.echo(c, []byte{'\n'})
+			if l.conns[c.fd] != c {
+				return
+			}
+		}
+		c.closing = true
+		if len(c.pending) == 0 {
+			l.closeConn(c, l.closedReason())
+		}
+		return
+	}
+
+	c.lastActive = l.now
+	c.stats.AddBytesIn(n)
+	l.echo(c, (*buf)[:n])
+
+	// A line that was partly received when draining started is now complete
+	if l.draining && l.conns[c.fd] == c && len(c.partial) == 0 && !c.closing {
+		c.closing = true
+		if len(c.pending) == 0 {
+			l.closeConn(c, "drained")
+		}
+	}
+}
+
+// echo writes back every complete line in data and keeps the remainder
+func (l *loop) echo(c *conn, data []byte) {
+	if len(c.partial) > 0 {
+		data = append(c.partial, data...)
+		c.partial = nil
+	}
+
+	out := l.srv.buffers.Get().(*[]byte)
+	response := (*out)[:0]
+	defer func() {
+		// Don't let one huge burst pin a large buffer in the pool
+		if cap(response) <= 4*l.srv.bufferSize {
+			*out = response[:cap(response)]
+		}
+		l.srv.buffers.Put(out)
+	}()
+
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		if i > l.srv.maxLineSize {
+			l.closeConn(c, "frame_too_large")
+			return
+		}
+
+		response = append(response, l.srv.prefix...)
+		response = append(response, data[:i+1]...)
+		c.stats.AddFrame()
+		data = data[i+1:]
+	}
+
+	if len(data) > l.srv.maxLineSize {
+		l.closeConn(c, "frame_too_large")
+		return
+	}
+	if len(data) > 0 {
+		c.partial = append([]byte(nil), data...)
+	}
+
+	l.write(c, response)
+}
+
+// write sends data now if the socket allows, queueing the rest and pausing
+// reads until the client catches up
+func (l *loop) write(c *conn, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	if len(c.pending) > 0 {
+		c.pending = append(c.pending, data...)
+		return
+	}
+
+	n, err := syscall.Write(c.fd, data)
+	if err != nil && err != syscall.EAGAIN {
+		l.closeConn(c, closeReason(err))
+		return
+	}
+	n = max(n, 0)
+	if n > 0 {
+		c.lastActive = l.now
+		c.stats.AddBytesOut(n)
+	}
+
+	if n < len(data) {
+		c.pending = append([]byte(nil), data[n:]...)
+		l.watch(c, writeEvents)
+	}
+}
+
+// flush writes pending echoes once the socket is writable again
+func (l *loop) flush(c *conn) {
+	n, err := syscall.Write(c.fd, c.pending)
+	if err == syscall.EAGAIN {
+		return
+	}
+	if err != nil {
+		l.closeConn(c, closeReason(err))
+		return
+	}
+
+	c.lastActive = l.now
+	c.stats.AddBytesOut(n)
+	if c.pending = c.pending[n:]; len(c.pending) > 0 {
+		return
+	}
+	c.pending = nil
+
+	if c.closing {
+		l.closeConn(c, l.closedReason())
+		return
+	}
+	l.watch(c, readEvents)
+}
+
+// watch changes which events the loop waits for on c
+func (l *loop) watch(c *conn, events uint32) {
+	if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_MOD, c.fd, &syscall.EpollEvent{Events: events, Fd: int32(c.fd)}); err != nil {
+		l.closeConn(c, "error")
+	}
+}
+
+// drain stops accepting and closes every connection that owes nothing.
+// Connections in the middle of a line keep reading until it is complete,
+// like server.Server's.
+func (l *loop) drain() {
+	if l.draining {
+		return
+	}
+	l.draining = true
+	l.stopAccepting()
+
+	l.srv.open.Add(int64(len(l.conns)))
+	for _, c := range l.conns {
+		switch {
+		case len(c.partial) > 0:
+			// read closes it once the '\n' arrives
+		case len(c.pending) == 0:
+			l.closeConn(c, "drained")
+		default:
+			c.closing = true
+		}
+	}
+}
+
+// sweep closes connections that have been idle for too long
+func (l *loop) sweep() {
+	idle := l.srv.idleTimeout.Nanoseconds()
+	for _, c := range l.conns {
+		if l.now-c.lastActive >= idle {
+			l.closeConn(c, "idle_timeout")
+		}
+	}
+}
+
+// closedReason labels a connection closed after delivering its echoes
+func (l *loop) closedReason() string {
+	if l.draining {
+		return "drained"
+	}
+	return "client_closed"
+}
+
+func (l *loop) closeConn(c *conn, reason string) {
+	delete(l.conns, c.fd)
+	l.srv.active.Add(-1)
+	l.srv.metrics.Close(c.stats, reason)
+
+	// Closing the socket also removes it from the epoll set
+	syscall.Close(c.fd)
+}
+
+func (l *loop) closeAll(reason string) {
+	for _, c := range l.conns {
+		l.closeConn(c, reason)
+	}
+}
+
+// stopAccepting removes the listener from this loop. The last loop to do so
+// closes the socket, so new clients are refused rather than left waiting in
+// the backlog.
+func (l *loop) stopAccepting() {
+	if !l.accepting {
+		return
+	}
+	l.accepting = false
+	syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, l.lfd, nil)
+
+	if l.srv.acceptors.Add(-1) == 0 {
+		syscall.Close(l.lfd)
+	}
+}
+
+// wake interrupts epoll_wait so the loop notices a state change
+func (l *loop) wake() {
+	syscall.Write(l.wakeW, []byte{0})
+}
+
+func (l *loop) drainWakeups() {
+	var buf [64]byte
+	for {
+		if n, _ := syscall.Read(l.wakeR, buf[:]); n <= 0 {
+			return
+		}
+	}
+}
+
+// close releases the loop's epoll instance and wakeup pipe
+func (l *loop) close() {
+	l.poller.Close()
+	syscall.Close(l.wakeR)
+	syscall.Close(l.wakeW)
+}
+
+// closeReason maps a socket error to a short metrics label
+func closeReason(err error) string {
+	switch err {
+	case syscall.ECONNRESET, syscall.EPIPE:
+		return "reset"
+	default:
+		return "error"
+	}
+}
+
+func sockaddrString(sa syscall.Sockaddr) string {
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		return (&net.TCPAddr{IP: sa.Addr[:], Port: sa.Port}).String()
+	case *syscall.SockaddrInet6:
+		return (&net.TCPAddr{IP: sa.Addr[:], Port: sa.Port}).String()
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package reactor
+
+import (
+	"net"
+
+	"tcp-echo/server"
+)
+
+// loop only exists on linux
+type loop struct{}
+
+// Serve fails with ErrUnsupported, there is no epoll on this platform
+func (s *Server) Serve(listener net.Listener) error {
+	listener.Close()
+	return ErrUnsupported
+}
+
+// Close is a no-op, the server never serves on this platform
+func (s *Server) Close() error {
+	return nil
+}
+
+// Shutdown is a no-op, the server never serves on this platform
+func (s *Server) Shutdown() server.ShutdownSummary {
+	return server.ShutdownSummary{}
+}
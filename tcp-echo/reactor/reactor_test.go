@@ -0,0 +1,291 @@
+//go:build linux
+
+package reactor
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"tcp-echo/server"
+)
+
+// startReactor serves config on a random local port
+func startReactor(t testing.TB, config Config) (*Server, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	srv := NewServer(config)
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	return srv, listener.Addr().String()
+}
+
+func dial(t testing.TB, addr string) *net.TCPConn {
+	t.Helper()
+
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn.(*net.TCPConn)
+}
+
+func TestServer_EchoesLines(t *testing.T) {
+	_, addr := startReactor(t, Config{Prefix: "Echo: ", Loops: 2})
+	conn := dial(t, addr)
+	reader := bufio.NewReader(conn)
+
+	// Pipelined lines, and one split across writes
+	conn.Write([]byte("one\ntwo\nthr"))
+	time.Sleep(10 * time.Millisecond)
+	conn.Write([]byte("ee\n"))
+
+	for _, want := range []string{"Echo: one\n", "Echo: two\n", "Echo: three\n"} {
+		got, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	}
+}
+
+func TestServer_HalfCloseDeliversEchoes(t *testing.T) {
+	_, addr := startReactor(t, Config{Prefix: "> "})
+	conn := dial(t, addr)
+
+	conn.Write([]byte("a\nb\npartial"))
+	conn.CloseWrite()
+
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if string(got) != "> a\n> b\n> partial\n" {
+		t.Errorf("Expected every echo before EOF, got %q", got)
+	}
+}
+
+func TestServer_SlowReaderGetsEverything(t *testing.T) {
+	_, addr := startReactor(t, Config{Prefix: "Echo: "})
+	conn := dial(t, addr)
+
+	// Far more than the socket buffers hold, so echoes have to be queued
+	// while the client isn't reading
+	line := strings.Repeat("x", 1000) + "\n"
+	const lines = 4000
+	go func() {
+		for range lines {
+			if _, err := conn.Write([]byte(line)); err != nil {
+				return
+			}
+		}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	reader := bufio.NewReader(conn)
+	for i := range lines {
+		got, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Read %d failed: %v", i, err)
+		}
+		if got != "Echo: "+line {
+			t.Fatalf("Unexpected echo %d: %q", i, got)
+		}
+	}
+}
+
+func TestServer_RejectsLongLines(t *testing.T) {
+	srv, addr := startReactor(t, Config{MaxLineSize: 8})
+	conn := dial(t, addr)
+
+	conn.Write([]byte("this line is far too long"))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected the connection to be closed")
+	}
+
+	if reasons := srv.Metrics().Snapshot().CloseReasons; reasons["frame_too_large"] != 1 {
+		t.Errorf("Expected frame_too_large close reason, got %v", reasons)
+	}
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	srv, addr := startReactor(t, Config{IdleTimeout: 50 * time.Millisecond})
+	conn := dial(t, addr)
+
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected the idle connection to be closed")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Idle connection took %s to close", elapsed)
+	}
+	if reasons := srv.Metrics().Snapshot().CloseReasons; reasons["idle_timeout"] != 1 {
+		t.Errorf("Expected idle_timeout close reason, got %v", reasons)
+	}
+}
+
+func TestServer_ShutdownDrains(t *testing.T) {
+	srv, addr := startReactor(t, Config{Prefix: "Echo: ", DrainTimeout: time.Second})
+
+	conns := []*net.TCPConn{dial(t, addr), dial(t, addr)}
+	for _, conn := range conns {
+		conn.Write([]byte("hi\n"))
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+
+	summary := srv.Shutdown()
+	if summary.Drained != 2 || summary.Killed != 0 {
+		t.Errorf("Expected 2 drained and 0 killed, got %+v", summary)
+	}
+	for _, conn := range conns {
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("Expected EOF after shutdown, got %v", err)
+		}
+	}
+
+	// The socket is closed, so new clients are refused
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("Expected new connections to be refused")
+	}
+}
+
+// idleConns is how many connections the memory benchmarks hold open
+const idleConns = 2000
+
+// BenchmarkIdleMemory compares the memory held per idle connection by the
+// reactor and by the goroutine-per-connection server. Client sockets live in
+// the same process and are counted for both.
+func TestServer_ShutdownFinishesPartialLine(t *testing.T) {
+	srv, addr := startReactor(t, Config{Prefix: "Echo: ", DrainTimeout: time.Second})
+
+	conn := dial(t, addr)
+	conn.Write([]byte("hel"))
+	time.Sleep(50 * time.Millisecond) // Let the loop read the partial line
+
+	shutdown := make(chan server.ShutdownSummary, 1)
+	go func() { shutdown <- srv.Shutdown() }()
+
+	// The rest of the line arrives after draining started
+	time.Sleep(50 * time.Millisecond)
+	conn.Write([]byte("lo\n"))
+
+	r := bufio.NewReader(conn)
+	if line, err := r.ReadString('\n'); err != nil || line != "Echo: hello\n" {
+		t.Errorf("Expected the partial line to be echoed, got %q, %v", line, err)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("Expected EOF once the line was echoed, got %v", err)
+	}
+
+	if summary := <-shutdown; summary.Drained != 1 || summary.Killed != 0 {
+		t.Errorf("Expected 1 drained and 0 killed, got %+v", summary)
+	}
+}
+
+func BenchmarkIdleMemory(b *testing.B) {
+	b.Run("reactor", func(b *testing.B) {
+		_, addr := startReactor(b, Config{Prefix: "Echo: "})
+		benchmarkIdleMemory(b, addr)
+	})
+	b.Run("goroutines", func(b *testing.B) {
+		benchmarkIdleMemory(b, startGoroutineServer(b))
+	})
+}
+
+func benchmarkIdleMemory(b *testing.B, addr string) {
+	for range b.N {
+		before := memoryInUse()
+
+		conns := make([]net.Conn, 0, idleConns)
+		for range idleConns {
+			conn := dial(b, addr)
+			conns = append(conns, conn)
+		}
+
+		// One echo each makes sure the server has fully set up every
+		// connection before measuring
+		reply := make([]byte, 64)
+		for _, conn := range conns {
+			conn.Write([]byte("x\n"))
+			if _, err := conn.Read(reply); err != nil {
+				b.Fatalf("Read failed: %v", err)
+			}
+		}
+
+		b.ReportMetric(float64(memoryInUse()-before)/idleConns, "bytes/conn")
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+}
+
+// BenchmarkEchoLatency measures the round trip of one line on each of many
+// concurrent connections
+func BenchmarkEchoLatency(b *testing.B) {
+	b.Run("reactor", func(b *testing.B) {
+		_, addr := startReactor(b, Config{Prefix: "Echo: "})
+		benchmarkEchoLatency(b, addr)
+	})
+	b.Run("goroutines", func(b *testing.B) {
+		benchmarkEchoLatency(b, startGoroutineServer(b))
+	})
+}
+
+func benchmarkEchoLatency(b *testing.B, addr string) {
+	b.RunParallel(func(pb *testing.PB) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Errorf("Dial failed: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		for pb.Next() {
+			conn.Write([]byte("hello\n"))
+			if _, err := reader.ReadString('\n'); err != nil {
+				b.Errorf("Read failed: %v", err)
+				return
+			}
+		}
+	})
+}
+
+func startGoroutineServer(b *testing.B) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("Listen failed: %v", err)
+	}
+
+	srv := server.NewServer(server.Config{})
+	go srv.Serve(listener)
+	b.Cleanup(func() { srv.Close() })
+
+	return listener.Addr().String()
+}
+
+// memoryInUse is heap plus goroutine stacks after a collection
+func memoryInUse() int64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return int64(stats.HeapInuse + stats.StackInuse)
+}
@@ -0,0 +1,37 @@
+package record
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+)
+
+// jsonEncoder writes one JSON object per line
+type jsonEncoder struct {
+	encoder *json.Encoder
+}
+
+func newJSONEncoder(w io.Writer) *jsonEncoder {
+	return &jsonEncoder{encoder: json.NewEncoder(w)}
+}
+
+func (e *jsonEncoder) encode(event Event) error {
+	return e.encoder.Encode(event)
+}
+
+// readJSONLines decodes events written by jsonEncoder
+func readJSONLines(r *bufio.Reader) ([]Event, error) {
+	var events []Event
+	decoder := json.NewDecoder(r)
+	for {
+		var event Event
+		err := decoder.Decode(&event)
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+}
@@ -0,0 +1,312 @@
+package record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// pcap constants. Packets are written as raw IP (LINKTYPE_RAW) with
+// synthesized TCP headers so Wireshark's "Follow TCP Stream" works.
+const (
+	pcapMagicNanos  = 0xa1b23c4d
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapLinkRaw     = 101
+	pcapSnapLen     = 262144
+
+	// maxSegment keeps every synthesized packet under the IP length limit
+	maxSegment = 65000
+
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// endpoint is one side of a synthesized TCP connection
+type endpoint struct {
+	ip   net.IP
+	port uint16
+	seq  uint32
+}
+
+type pcapConn struct {
+	client, server *endpoint
+}
+
+// pcapEncoder writes events as TCP segments in a pcap file
+type pcapEncoder struct {
+	w     io.Writer
+	conns map[uint64]*pcapConn
+}
+
+func newPcapEncoder(w io.Writer) (*pcapEncoder, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagicNanos)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkRaw)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &pcapEncoder{w: w, conns: make(map[uint64]*pcapConn)}, nil
+}
+
+func (e *pcapEncoder) encode(event Event) error {
+	if event.Dir == Open {
+		conn := &pcapConn{
+			client: parseEndpoint(event.Remote, "127.0.0.2", uint16(10000+event.Conn%50000)),
+			server: parseEndpoint(event.Local, "127.0.0.1", 9),
+		}
+		e.conns[event.Conn] = conn
+
+		// A handshake lets tools recognise the start of the stream
+		if err := e.segment(event.Time, conn.client, conn.server, tcpSYN, nil); err != nil {
+			return err
+		}
+		if err := e.segment(event.Time, conn.server, conn.client, tcpSYN|tcpACK, nil); err != nil {
+			return err
+		}
+		return e.segment(event.Time, conn.client, conn.server, tcpACK, nil)
+	}
+
+	conn, ok := e.conns[event.Conn]
+	if !ok {
+		return nil
+	}
+
+	switch event.Dir {
+	case In, Out:
+		src, dst := conn.client, conn.server
+		if event.Dir == Out {
+			src, dst = dst, src
+		}
+		data := event.Data
+		for len(data) > 0 {
+			n := min(len(data), maxSegment)
+			if err := e.segment(event.Time, src, dst, tcpPSH|tcpACK, data[:n]); err != nil {
+				return err
+			}
+			data = data[n:]
+		}
+	case Close:
+		delete(e.conns, event.Conn)
+		return e.segment(event.Time, conn.server, conn.client, tcpFIN|tcpACK, nil)
+	}
+	return nil
+}
+
+// segment writes one packet from src to dst and advances src's sequence number
+func (e *pcapEncoder) segment(t time.Time, src, dst *endpoint, flags byte, payload []byte) error {
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.port)
+	binary.BigEndian.PutUint16(tcp[2:], dst.port)
+	binary.BigEndian.PutUint32(tcp[4:], src.seq)
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], dst.seq)
+	}
+	tcp[12] = 5 << 4 // Header length in 32-bit words
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	tcp = append(tcp, payload...)
+
+	src.seq += uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		src.seq++
+	}
+
+	packet := ipPacket(src.ip, dst.ip, tcp)
+
+	record := make([]byte, 16, 16+len(packet))
+	binary.LittleEndian.PutUint32(record[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(t.Nanosecond()))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	record = append(record, packet...)
+
+	_, err := e.w.Write(record)
+	return err
+}
+
+// ipPacket wraps a TCP segment in an IPv4 header, or IPv6 if either address
+// is IPv6. TCP checksums are left zero; Wireshark doesn't verify them by default.
+func ipPacket(src, dst net.IP, tcp []byte) []byte {
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		header := make([]byte, 20, 20+len(tcp))
+		header[0] = 4<<4 | 5
+		binary.BigEndian.PutUint16(header[2:], uint16(20+len(tcp)))
+		header[8] = 64 // TTL
+		header[9] = 6  // TCP
+		copy(header[12:], src4)
+		copy(header[16:], dst4)
+		binary.BigEndian.PutUint16(header[10:], ipChecksum(header))
+		return append(header, tcp...)
+	}
+
+	header := make([]byte, 40, 40+len(tcp))
+	header[0] = 6 << 4
+	binary.BigEndian.PutUint16(header[4:], uint16(len(tcp)))
+	header[6] = 6 // TCP
+	header[7] = 64
+	copy(header[8:], src.To16())
+	copy(header[24:], dst.To16())
+	return append(header, tcp...)
+}
+
+func ipChecksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// parseEndpoint splits a host:port address, falling back to a placeholder
+// for addresses without an IP such as unix sockets
+func parseEndpoint(addr, fallbackIP string, fallbackPort uint16) *endpoint {
+	host, port, err := net.SplitHostPort(addr)
+	if err == nil {
+		ip := net.ParseIP(host)
+		p, err := strconv.ParseUint(port, 10, 16)
+		if ip != nil && err == nil {
+			return &endpoint{ip: ip, port: uint16(p)}
+		}
+	}
+	return &endpoint{ip: net.ParseIP(fallbackIP), port: fallbackPort}
+}
+
+// readPcap turns a pcap file written by pcapEncoder back into events.
+// Connections start at a SYN; the side that sent it is the client.
+func readPcap(r *bufio.Reader) ([]Event, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	var nanos bool
+	switch binary.LittleEndian.Uint32(header) {
+	case pcapMagicNanos:
+		nanos = true
+	case pcapMagicMicros:
+	default:
+		return nil, errors.New("not a little-endian pcap file")
+	}
+	if link := binary.LittleEndian.Uint32(header[20:]); link != pcapLinkRaw {
+		return nil, fmt.Errorf("unsupported pcap link type %d", link)
+	}
+
+	// Record lengths are checked against this before allocating, so a
+	// corrupt file can't make us allocate gigabytes
+	snapLen := binary.LittleEndian.Uint32(header[16:])
+	if snapLen == 0 || snapLen > pcapSnapLen {
+		snapLen = pcapSnapLen
+	}
+
+	var (
+		events []Event
+		ids    = make(map[string]uint64) // Flow key to connection id
+		nextID uint64
+		record = make([]byte, 16)
+	)
+	for {
+		if _, err := io.ReadFull(r, record); err != nil {
+			if err == io.EOF {
+				return events, nil
+			}
+			return nil, err
+		}
+
+		fraction := time.Duration(binary.LittleEndian.Uint32(record[4:]))
+		if !nanos {
+			fraction *= time.Microsecond
+		}
+		t := time.Unix(int64(binary.LittleEndian.Uint32(record[0:])), int64(fraction))
+
+		length := binary.LittleEndian.Uint32(record[8:])
+		if length > snapLen {
+			return nil, fmt.Errorf("pcap record of %d bytes exceeds the snapshot length of %d", length, snapLen)
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(r, packet); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		src, dst, flags, payload, err := parseSegment(packet)
+		if err != nil {
+			continue
+		}
+
+		flow := src + ">" + dst
+		reverse := dst + ">" + src
+		if flags&tcpSYN != 0 && flags&tcpACK == 0 {
+			nextID++
+			ids[flow] = nextID
+			events = append(events, Event{Time: t, Conn: nextID, Dir: Open, Remote: src, Local: dst})
+			continue
+		}
+
+		dir := In
+		id, ok := ids[flow]
+		if !ok {
+			if id, ok = ids[reverse]; !ok {
+				continue
+			}
+			dir = Out
+		}
+
+		if len(payload) > 0 {
+			events = append(events, Event{Time: t, Conn: id, Dir: dir, Data: payload})
+		}
+		if flags&tcpFIN != 0 {
+			events = append(events, Event{Time: t, Conn: id, Dir: Close})
+			delete(ids, flow)
+			delete(ids, reverse)
+		}
+	}
+}
+
+// parseSegment extracts the addresses, TCP flags and payload of a raw IP packet
+func parseSegment(packet []byte) (src, dst string, flags byte, payload []byte, err error) {
+	if len(packet) < 1 {
+		return "", "", 0, nil, errors.New("empty packet")
+	}
+
+	var srcIP, dstIP net.IP
+	var tcp []byte
+	switch packet[0] >> 4 {
+	case 4:
+		headerLen := int(packet[0]&0x0f) * 4
+		if len(packet) < headerLen+20 || packet[9] != 6 {
+			return "", "", 0, nil, errors.New("not a TCP packet")
+		}
+		srcIP, dstIP = net.IP(packet[12:16]), net.IP(packet[16:20])
+		tcp = packet[headerLen:]
+	case 6:
+		if len(packet) < 60 || packet[6] != 6 {
+			return "", "", 0, nil, errors.New("not a TCP packet")
+		}
+		srcIP, dstIP = net.IP(packet[8:24]), net.IP(packet[24:40])
+		tcp = packet[40:]
+	default:
+		return "", "", 0, nil, errors.New("not an IP packet")
+	}
+
+	offset := int(tcp[12]>>4) * 4
+	if len(tcp) < offset {
+		return "", "", 0, nil, errors.New("truncated TCP header")
+	}
+
+	src = net.JoinHostPort(srcIP.String(), strconv.Itoa(int(binary.BigEndian.Uint16(tcp[0:]))))
+	dst = net.JoinHostPort(dstIP.String(), strconv.Itoa(int(binary.BigEndian.Uint16(tcp[2:]))))
+	return src, dst, tcp[13], tcp[offset:], nil
+}
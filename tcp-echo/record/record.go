@@ -0,0 +1,213 @@
+// Package record captures the bytes each connection sends and receives so a
+// session can be inspected later or replayed against another server with
+// Replay. Recordings are written as JSON lines or as a pcap file that
+// Wireshark can open.
+package record
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Direction of an event relative to the server
+type Direction string
+
+const (
+	Open  Direction = "open"  // Connection accepted
+	In    Direction = "in"    // Bytes read from the client
+	Out   Direction = "out"   // Bytes written to the client
+	Close Direction = "close" // Connection closed
+)
+
+// Event is one entry in a recording
+type Event struct {
+	Time   time.Time `json:"time"`
+	Conn   uint64    `json:"conn"`
+	Dir    Direction `json:"dir"`
+	Remote string    `json:"remote,omitempty"` // Set on open
+	Local  string    `json:"local,omitempty"`  // Set on open
+	Data   []byte    `json:"data,omitempty"`   // Base64 in JSON
+}
+
+// Format selects how events are written
+type Format string
+
+const (
+	JSONLines Format = "jsonl"
+	PCAP      Format = "pcap"
+)
+
+// ParseFormat parses "jsonl" or "pcap"
+func ParseFormat(s string) (Format, error) {
+	switch Format(s) {
+	case JSONLines, PCAP:
+		return Format(s), nil
+	default:
+		return "", fmt.Errorf("unknown record format %q", s)
+	}
+}
+
+// encoder writes events in one format
+type encoder interface {
+	encode(Event) error
+}
+
+// Recorder writes the events of every wrapped connection to a single file.
+// It is safe for concurrent use.
+type Recorder struct {
+	conns atomic.Uint64
+
+	mu      sync.Mutex
+	w       *bufio.Writer
+	closer  io.Closer
+	encoder encoder
+	err     error // First write error, after which recording stops
+}
+
+// NewRecorder writes events to w in the given format
+func NewRecorder(w io.Writer, format Format) (*Recorder, error) {
+	r := &Recorder{w: bufio.NewWriter(w)}
+
+	switch format {
+	case JSONLines:
+		r.encoder = newJSONEncoder(r.w)
+	case PCAP:
+		pcap, err := newPcapEncoder(r.w)
+		if err != nil {
+			return nil, err
+		}
+		r.encoder = pcap
+	default:
+		return nil, fmt.Errorf("unknown record format %q", format)
+	}
+
+	if closer, ok := w.(io.Closer); ok {
+		r.closer = closer
+	}
+	return r, nil
+}
+
+// Create records to a new file at path
+func Create(path string, format Format) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewRecorder(file, format)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// WrapConn returns conn with its traffic recorded under a new connection id
+func (r *Recorder) WrapConn(conn net.Conn) net.Conn {
+	c := &Conn{Conn: conn, recorder: r, id: r.conns.Add(1)}
+	r.record(Event{
+		Conn:   c.id,
+		Dir:    Open,
+		Remote: conn.RemoteAddr().String(),
+		Local:  conn.LocalAddr().String(),
+	})
+	return c
+}
+
+// Flush writes buffered events to the underlying writer
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+	return r.w.Flush()
+}
+
+// Close flushes and closes the underlying file
+func (r *Recorder) Close() error {
+	err := r.Flush()
+	if r.closer != nil {
+		if closeErr := r.closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// record timestamps and writes one event
+func (r *Recorder) record(e Event) {
+	e.Time = time.Now()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return
+	}
+	err := r.encoder.encode(e)
+
+	// Flush whole connections so a crash loses as little as possible
+	if err == nil && e.Dir == Close {
+		err = r.w.Flush()
+	}
+	if err != nil {
+		r.err = err
+		log.Printf("recording stopped, err: %v", err)
+	}
+}
+
+// Conn records everything read from and written to a connection
+type Conn struct {
+	net.Conn
+	recorder *Recorder
+	id       uint64
+	once     sync.Once
+}
+
+// Read records the bytes read as an inbound event
+func (c *Conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.recorder.record(Event{Conn: c.id, Dir: In, Data: append([]byte(nil), p[:n]...)})
+	}
+	return n, err
+}
+
+// Write records the bytes written as an outbound event
+func (c *Conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.recorder.record(Event{Conn: c.id, Dir: Out, Data: append([]byte(nil), p[:n]...)})
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the underlying connection if it supports it
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// NetConn returns the wrapped connection
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Close records the end of the connection once
+func (c *Conn) Close() error {
+	c.once.Do(func() {
+		c.recorder.record(Event{Conn: c.id, Dir: Close})
+	})
+	return c.Conn.Close()
+}
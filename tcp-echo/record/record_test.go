@@ -0,0 +1,217 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startServer echoes lines with prefix on a random local port, recording
+// connections when recorder is set
+func startServer(t *testing.T, prefix string, recorder *Recorder) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if recorder != nil {
+				conn = recorder.WrapConn(conn)
+			}
+
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					conn.Write([]byte(prefix + line))
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// recordSession sends lines to an echo server and returns the recording
+func recordSession(t *testing.T, format Format, lines ...string) []*Session {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "session."+string(format))
+	recorder, err := Create(path, format)
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	addr := startServer(t, "Echo: ", recorder)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	reader := bufio.NewReader(conn)
+	for _, line := range lines {
+		conn.Write([]byte(line + "\n"))
+		if _, err := reader.ReadString('\n'); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+	conn.Close()
+
+	// Wait for the server side to record the close
+	deadline := time.Now().Add(time.Second)
+	for {
+		recorder.Flush()
+		sessions, err := ReadFile(path)
+		if err != nil {
+			t.Fatalf("ReadFile failed: %v", err)
+		}
+		if len(sessions) == 1 && len(sessions[0].Events) == 2*len(lines) {
+			recorder.Close()
+			return sessions
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Recording incomplete: %+v", sessions)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRecorder_Formats(t *testing.T) {
+	for _, format := range []Format{JSONLines, PCAP} {
+		t.Run(string(format), func(t *testing.T) {
+			sessions := recordSession(t, format, "hello", "world")
+			session := sessions[0]
+
+			if !strings.HasPrefix(session.Remote, "127.0.0.1:") {
+				t.Errorf("Expected the client address, got %q", session.Remote)
+			}
+
+			want := []struct {
+				dir  Direction
+				data string
+			}{{In, "hello\n"}, {Out, "Echo: hello\n"}, {In, "world\n"}, {Out, "Echo: world\n"}}
+			for i, w := range want {
+				event := session.Events[i]
+				if event.Dir != w.dir || string(event.Data) != w.data {
+					t.Errorf("Event %d: expected %s %q, got %s %q", i, w.dir, w.data, event.Dir, event.Data)
+				}
+				if event.Time.IsZero() {
+					t.Errorf("Event %d has no timestamp", i)
+				}
+			}
+		})
+	}
+}
+
+func TestReplay_Matches(t *testing.T) {
+	sessions := recordSession(t, JSONLines, "one", "two", "three")
+	addr := startServer(t, "Echo: ", nil)
+
+	result, err := Replay(context.Background(), sessions[0], ReplayConfig{Addr: addr})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if result.Exchanges != 3 || len(result.Mismatches) != 0 {
+		t.Errorf("Expected 3 matching exchanges, got %+v", result)
+	}
+}
+
+func TestReplay_ReportsDifferences(t *testing.T) {
+	sessions := recordSession(t, PCAP, "one", "two")
+
+	addr := startServer(t, "Echo! ", nil)
+
+	result, err := Replay(context.Background(), sessions[0], ReplayConfig{Addr: addr, ReadTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Replay failed: %v", err)
+	}
+	if len(result.Mismatches) != 2 {
+		t.Fatalf("Expected 2 mismatches, got %+v", result.Mismatches)
+	}
+
+	mismatch := result.Mismatches[0]
+	if string(mismatch.Got) != "Echo! one\n" || mismatch.Offset != 4 {
+		t.Errorf("Unexpected mismatch: %s", mismatch)
+	}
+}
+
+func TestSession_ServerSpeaksFirst(t *testing.T) {
+	session := &Session{Events: []Event{
+		{Dir: Out, Data: []byte("welcome\n")},
+		{Dir: In, Data: []byte("he")},
+		{Dir: In, Data: []byte("llo\n")},
+		{Dir: Out, Data: []byte("hello\n")},
+	}}
+
+	exchanges := session.exchanges()
+	if len(exchanges) != 2 {
+		t.Fatalf("Expected 2 exchanges, got %d", len(exchanges))
+	}
+	if len(exchanges[0].request) != 0 || string(exchanges[0].response) != "welcome\n" {
+		t.Errorf("Unexpected greeting exchange: %+v", exchanges[0])
+	}
+	if string(exchanges[1].request) != "hello\n" {
+		t.Errorf("Expected request chunks to be joined, got %q", exchanges[1].request)
+	}
+}
+
+func TestPcap_IPv6AndUnixAddresses(t *testing.T) {
+	var buf bytes.Buffer
+	recorder, _ := NewRecorder(&buf, PCAP)
+
+	now := time.Now()
+	recorder.encoder.encode(Event{Time: now, Conn: 1, Dir: Open, Remote: "[::1]:5000", Local: "[::1]:9000"})
+	recorder.encoder.encode(Event{Time: now, Conn: 1, Dir: In, Data: []byte("v6")})
+	recorder.encoder.encode(Event{Time: now, Conn: 2, Dir: Open, Remote: "@", Local: "/tmp/echo.sock"})
+	recorder.encoder.encode(Event{Time: now, Conn: 2, Dir: Out, Data: []byte("unix")})
+	recorder.encoder.encode(Event{Time: now, Conn: 2, Dir: Close})
+	recorder.Flush()
+
+	events, err := ReadEvents(&buf)
+	if err != nil {
+		t.Fatalf("ReadEvents failed: %v", err)
+	}
+
+	sessions := Sessions(events)
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", len(sessions))
+	}
+	if sessions[0].Remote != "[::1]:5000" || string(sessions[0].Events[0].Data) != "v6" {
+		t.Errorf("Unexpected IPv6 session: %+v", sessions[0])
+	}
+	if sessions[1].Events[0].Dir != Out || string(sessions[1].Events[0].Data) != "unix" {
+		t.Errorf("Unexpected unix session: %+v", sessions[1])
+	}
+}
+
+func TestPcap_RejectsOversizedRecords(t *testing.T) {
+	var buf bytes.Buffer
+	recorder, _ := NewRecorder(&buf, PCAP)
+	recorder.Flush()
+
+	// A record header claiming 4GB, as a corrupt file might
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[8:], 0xFFFFFFFF)
+	buf.Write(record)
+
+	if _, err := ReadEvents(&buf); err == nil || !strings.Contains(err.Error(), "snapshot length") {
+		t.Errorf("Expected the oversized record to be rejected, got %v", err)
+	}
+}
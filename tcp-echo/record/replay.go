@@ -0,0 +1,235 @@
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+// Session is the recorded traffic of one connection
+type Session struct {
+	Conn   uint64
+	Remote string
+	Events []Event // In and Out events in order
+}
+
+// ReadFile reads a recording in either format and groups it by connection
+func ReadFile(path string) ([]*Session, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	events, err := ReadEvents(file)
+	if err != nil {
+		return nil, err
+	}
+	return Sessions(events), nil
+}
+
+// ReadEvents reads a recording, detecting the format from the first bytes
+func ReadEvents(r io.Reader) ([]Event, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil && len(magic) == 0 {
+		return nil, nil
+	}
+
+	if len(magic) == 4 {
+		switch binary.LittleEndian.Uint32(magic) {
+		case pcapMagicNanos, pcapMagicMicros:
+			return readPcap(br)
+		}
+	}
+	return readJSONLines(br)
+}
+
+// Sessions groups events by connection, ordered by connection id
+func Sessions(events []Event) []*Session {
+	byConn := make(map[uint64]*Session)
+	for _, event := range events {
+		session, ok := byConn[event.Conn]
+		if !ok {
+			session = &Session{Conn: event.Conn}
+			byConn[event.Conn] = session
+		}
+
+		switch event.Dir {
+		case Open:
+			session.Remote = event.Remote
+		case In, Out:
+			session.Events = append(session.Events, event)
+		}
+	}
+
+	sessions := make([]*Session, 0, len(byConn))
+	for _, session := range byConn {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Conn < sessions[j].Conn })
+	return sessions
+}
+
+// exchange is what the client sent followed by what the server answered
+type exchange struct {
+	at       time.Time // When the request was sent, or the first response for server-first protocols
+	request  []byte
+	response []byte
+}
+
+// exchanges splits a session into request/response pairs
+func (s *Session) exchanges() []exchange {
+	var result []exchange
+	for _, event := range s.Events {
+		last := len(result) - 1
+		switch {
+		case event.Dir == In && (last < 0 || len(result[last].response) > 0):
+			result = append(result, exchange{at: event.Time, request: event.Data})
+		case event.Dir == In:
+			result[last].request = append(result[last].request, event.Data...)
+		case last < 0:
+			result = append(result, exchange{at: event.Time, response: event.Data})
+		default:
+			result[last].response = append(result[last].response, event.Data...)
+		}
+	}
+	return result
+}
+
+// ReplayConfig holds configuration for Replay
+type ReplayConfig struct {
+	Network     string        // Defaults to "tcp"
+	Addr        string        // Server to replay against
+	Speed       float64       // Replay the recorded gaps between requests at this multiple (0 = no delays)
+	ReadTimeout time.Duration // How long to wait for each expected response, defaults to 2s
+}
+
+// Mismatch is a response that differed from the recording
+type Mismatch struct {
+	Exchange int    // Index of the request/response pair
+	Request  []byte // What was sent
+	Expected []byte // What the recording says the server answered
+	Got      []byte // What the server answered this time
+	Offset   int    // First differing byte
+}
+
+func (m Mismatch) String() string {
+	return fmt.Sprintf("exchange %d, request %q: expected %q, got %q (differs at byte %d)",
+		m.Exchange, m.Request, m.Expected, m.Got, m.Offset)
+}
+
+// ReplayResult summarises the replay of one session
+type ReplayResult struct {
+	Conn       uint64
+	Exchanges  int
+	Mismatches []Mismatch
+}
+
+// Replay sends a session's requests to a server and compares each response
+// with the recorded one
+func Replay(ctx context.Context, session *Session, config ReplayConfig) (*ReplayResult, error) {
+	// Set defaults
+	if config.Network == "" {
+		config.Network = "tcp"
+	}
+	if config.ReadTimeout == 0 {
+		config.ReadTimeout = 2 * time.Second
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, config.Network, config.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	exchanges := session.exchanges()
+	result := &ReplayResult{Conn: session.Conn, Exchanges: len(exchanges)}
+
+	for i, ex := range exchanges {
+		if i > 0 && config.Speed > 0 {
+			gap := time.Duration(float64(ex.at.Sub(exchanges[i-1].at)) / config.Speed)
+			select {
+			case <-time.After(gap):
+			case <-ctx.Done():
+				return result, ctx.Err()
+			}
+		}
+
+		if len(ex.request) > 0 {
+			conn.SetWriteDeadline(time.Now().Add(config.ReadTimeout))
+			if _, err := conn.Write(ex.request); err != nil {
+				return result, fmt.Errorf("exchange %d: %w", i, err)
+			}
+		}
+
+		got := make([]byte, len(ex.response))
+		conn.SetReadDeadline(time.Now().Add(config.ReadTimeout))
+		n, err := io.ReadFull(conn, got)
+		got = got[:n]
+		if err != nil && !isTimeout(err) && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return result, fmt.Errorf("exchange %d: %w", i, err)
+		}
+
+		if !bytes.Equal(got, ex.response) {
+			// Pick up the rest of a longer answer so the next exchange lines up
+			if err == nil {
+				got = append(got, drain(conn, min(config.ReadTimeout, drainWindow))...)
+			}
+			result.Mismatches = append(result.Mismatches, Mismatch{
+				Exchange: i,
+				Request:  ex.request,
+				Expected: ex.response,
+				Got:      got,
+				Offset:   firstDifference(ex.response, got),
+			})
+		}
+		if err != nil {
+			// The server went quiet or hung up; later exchanges can't line up
+			break
+		}
+	}
+	return result, nil
+}
+
+// drainWindow bounds how long a mismatched response is given to finish
+const drainWindow = 100 * time.Millisecond
+
+// drain returns whatever the server sends within window
+func drain(conn net.Conn, window time.Duration) []byte {
+	conn.SetReadDeadline(time.Now().Add(window))
+
+	var extra []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		extra = append(extra, buf[:n]...)
+		if err != nil {
+			return extra
+		}
+	}
+}
+
+// firstDifference returns the index of the first byte where a and b differ
+func firstDifference(a, b []byte) int {
+	for i := range min(len(a), len(b)) {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return min(len(a), len(b))
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,229 @@
+// Package resp serves a small key/value store over a subset of the Redis
+// protocol (RESP2), so Redis clients can be pointed at tcp-echo. Commands may
+// be sent as RESP arrays or as plain text lines ("SET k v EX 10").
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"tcp-echo/framing"
+	"tcp-echo/metrics"
+)
+
+// Handler answers PING, ECHO, GET, SET, DEL, INCR and EXPIRE. Handlers
+// serving several listeners can share one Store.
+type Handler struct {
+	Store       *Store
+	MaxBulkSize int // Largest accepted argument or inline line, defaults to framing.DefaultMaxFrameSize
+}
+
+// NewHandler creates a handler with its own empty store
+func NewHandler() *Handler {
+	return &Handler{
+		Store:       NewStore(),
+		MaxBulkSize: framing.DefaultMaxFrameSize,
+	}
+}
+
+// ServeConn answers commands until the client disconnects, sends QUIT or ctx
+// is cancelled. Replies to pipelined commands are flushed together.
+func (h *Handler) ServeConn(ctx context.Context, conn net.Conn) error {
+	maxBulk := h.MaxBulkSize
+	if maxBulk <= 0 {
+		maxBulk = framing.DefaultMaxFrameSize
+	}
+
+	r := bufio.NewReader(conn)
+	w := writer{bufio.NewWriter(conn)}
+
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		args, err := readCommand(r, maxBulk)
+		if errors.Is(err, ErrProtocol) {
+			w.error("ERR " + err.Error())
+			w.Flush()
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		quit := h.execute(w, args)
+		metrics.ConnFromContext(ctx).AddFrame()
+
+		// Only flush once the pipeline is drained
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		if quit {
+			return nil
+		}
+	}
+}
+
+// execute runs one command and writes its reply. It returns true for QUIT.
+func (h *Handler) execute(w writer, args [][]byte) bool {
+	name := strings.ToUpper(string(args[0]))
+	args = args[1:]
+
+	switch name {
+	case "PING":
+		switch len(args) {
+		case 0:
+			w.simple("PONG")
+		case 1:
+			w.bulk(args[0])
+		default:
+			wrongArgs(w, name)
+		}
+
+	case "ECHO":
+		if len(args) != 1 {
+			wrongArgs(w, name)
+			return false
+		}
+		w.bulk(args[0])
+
+	case "GET":
+		if len(args) != 1 {
+			wrongArgs(w, name)
+			return false
+		}
+		if value, ok := h.Store.Get(string(args[0])); ok {
+			w.bulk(value)
+		} else {
+			w.null()
+		}
+
+	case "SET":
+		h.set(w, args)
+
+	case "DEL":
+		if len(args) == 0 {
+			wrongArgs(w, name)
+			return false
+		}
+		keys := make([]string, len(args))
+		for i, arg := range args {
+			keys[i] = string(arg)
+		}
+		w.integer(int64(h.Store.Delete(keys...)))
+
+	case "INCR":
+		if len(args) != 1 {
+			wrongArgs(w, name)
+			return false
+		}
+		n, err := h.Store.Incr(string(args[0]))
+		if err != nil {
+			w.error("ERR " + err.Error())
+			return false
+		}
+		w.integer(n)
+
+	case "EXPIRE":
+		if len(args) != 2 {
+			wrongArgs(w, name)
+			return false
+		}
+		seconds, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			w.error("ERR " + errNotInteger.Error())
+			return false
+		}
+		if seconds > math.MaxInt64/int64(time.Second) {
+			w.error("ERR invalid expire time in 'expire' command")
+			return false
+		}
+		if h.Store.Expire(string(args[0]), time.Duration(seconds)*time.Second) {
+			w.integer(1)
+		} else {
+			w.integer(0)
+		}
+
+	case "COMMAND":
+		// redis-cli asks for command docs on connect; an empty list is fine
+		w.array(0)
+
+	case "QUIT":
+		w.simple("OK")
+		return true
+
+	default:
+		w.error("ERR unknown command '" + strings.ToLower(name) + "'")
+	}
+	return false
+}
+
+// set handles SET key value [EX seconds|PX milliseconds] [NX|XX]
+func (h *Handler) set(w writer, args [][]byte) {
+	if len(args) < 2 {
+		wrongArgs(w, "SET")
+		return
+	}
+
+	var (
+		ttl                         time.Duration
+		onlyIfMissing, onlyIfExists bool
+	)
+	for i := 2; i < len(args); i++ {
+		option := strings.ToUpper(string(args[i]))
+		switch option {
+		case "NX":
+			onlyIfMissing = true
+		case "XX":
+			onlyIfExists = true
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				w.error("ERR syntax error")
+				return
+			}
+			i++
+			unit := time.Second
+			if option == "PX" {
+				unit = time.Millisecond
+			}
+			// Larger values would overflow into a negative TTL that never expires
+			n, err := strconv.ParseInt(string(args[i]), 10, 64)
+			if err != nil || n <= 0 || n > math.MaxInt64/int64(unit) {
+				w.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			ttl = time.Duration(n) * unit
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+
+	if onlyIfMissing && onlyIfExists {
+		w.error("ERR syntax error")
+		return
+	}
+
+	if h.Store.Set(string(args[0]), args[1], ttl, onlyIfMissing, onlyIfExists) {
+		w.simple("OK")
+	} else {
+		w.null()
+	}
+}
+
+// wrongArgs writes Redis' arity error
+func wrongArgs(w writer, name string) {
+	w.error("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+}
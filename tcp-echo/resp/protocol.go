@@ -0,0 +1,145 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// maxArgs bounds the number of arguments in a single command
+const maxArgs = 1024
+
+// ErrProtocol is returned for input that is neither RESP nor an inline command
+var ErrProtocol = errors.New("protocol error")
+
+// readCommand reads one command, either a RESP array of bulk strings
+// ("*2\r\n$4\r\nECHO\r\n$2\r\nhi\r\n") or an inline line ("ECHO hi\r\n").
+// An empty inline line returns no arguments.
+func readCommand(r *bufio.Reader, maxBulk int) ([][]byte, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] != '*' {
+		line, err := readLine(r, maxBulk)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.Fields(line), nil
+	}
+
+	header, err := readLine(r, maxBulk)
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(string(header[1:]))
+	if err != nil || count < 0 || count > maxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", ErrProtocol)
+	}
+
+	args := make([][]byte, 0, count)
+	for range count {
+		arg, err := readBulk(r, maxBulk)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// readBulk reads "$<len>\r\n<data>\r\n"
+func readBulk(r *bufio.Reader, maxBulk int) ([]byte, error) {
+	header, err := readLine(r, maxBulk)
+	if err != nil {
+		return nil, err
+	}
+	if len(header) == 0 || header[0] != '$' {
+		return nil, fmt.Errorf("%w: expected '$', got %q", ErrProtocol, header)
+	}
+
+	size, err := strconv.Atoi(string(header[1:]))
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+	}
+	if size > maxBulk {
+		return nil, fmt.Errorf("%w: bulk length %d exceeds %d", ErrProtocol, size, maxBulk)
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, noEOF(err)
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", ErrProtocol)
+	}
+	return data[:size], nil
+}
+
+// readLine reads up to '\n' and strips the line ending, refusing lines
+// longer than limit so a client can't make us buffer without bound
+func readLine(r *bufio.Reader, limit int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > limit+2 {
+			return nil, fmt.Errorf("%w: line too long", ErrProtocol)
+		}
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			if len(line) > 0 {
+				return nil, noEOF(err)
+			}
+			return nil, err
+		}
+	}
+
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r")), nil
+}
+
+// noEOF turns an EOF in the middle of a command into ErrUnexpectedEOF
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// writer encodes RESP2 replies
+type writer struct {
+	*bufio.Writer
+}
+
+func (w writer) simple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w writer) error(s string) {
+	w.WriteString("-" + s + "\r\n")
+}
+
+func (w writer) integer(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w writer) bulk(b []byte) {
+	w.WriteString("$" + strconv.Itoa(len(b)) + "\r\n")
+	w.Write(b)
+	w.WriteString("\r\n")
+}
+
+func (w writer) null() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w writer) array(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
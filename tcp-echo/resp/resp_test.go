@@ -0,0 +1,168 @@
+package resp
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serve runs a handler on one end of a pipe and returns the client end
+func serve(t *testing.T, h *Handler) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	go func() {
+		defer server.Close()
+		h.ServeConn(context.Background(), server)
+	}()
+	t.Cleanup(func() { client.Close() })
+
+	return client, bufio.NewReader(client)
+}
+
+// roundTrip sends raw protocol bytes and reads back n reply lines
+func roundTrip(t *testing.T, conn net.Conn, r *bufio.Reader, request string, n int) string {
+	t.Helper()
+
+	go conn.Write([]byte(request))
+
+	var reply strings.Builder
+	for range n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Read failed after %q: %v", reply.String(), err)
+		}
+		reply.WriteString(line)
+	}
+	return reply.String()
+}
+
+func TestHandler_Commands(t *testing.T) {
+	conn, r := serve(t, NewHandler())
+
+	tests := []struct {
+		request string
+		lines   int
+		want    string
+	}{
+		{"*1\r\n$4\r\nPING\r\n", 1, "+PONG\r\n"},
+		{"*2\r\n$4\r\nECHO\r\n$5\r\nhello\r\n", 2, "$5\r\nhello\r\n"},
+		{"*3\r\n$3\r\nSET\r\n$3\r\nkey\r\n$5\r\nvalue\r\n", 1, "+OK\r\n"},
+		{"*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n", 2, "$5\r\nvalue\r\n"},
+		{"*2\r\n$3\r\nGET\r\n$7\r\nmissing\r\n", 1, "$-1\r\n"},
+		{"INCR counter\r\n", 1, ":1\r\n"},
+		{"incr counter\r\n", 1, ":2\r\n"},
+		{"INCR key\r\n", 1, "-ERR value is not an integer or out of range\r\n"},
+		{"EXPIRE counter 10\r\n", 1, ":1\r\n"},
+		{"EXPIRE missing 10\r\n", 1, ":0\r\n"},
+		{"DEL key counter missing\r\n", 1, ":2\r\n"},
+		{"SET a 1 NX\r\n", 1, "+OK\r\n"},
+		{"SET a 2 NX\r\n", 1, "$-1\r\n"},
+		{"SET b 1 XX\r\n", 1, "$-1\r\n"},
+		{"SET a 1 EX 0\r\n", 1, "-ERR invalid expire time in 'set' command\r\n"},
+		{"SET a 1 EX 9223372036854775807\r\n", 1, "-ERR invalid expire time in 'set' command\r\n"},
+		{"SET a 1 PX 9223372036854776\r\n", 1, "-ERR invalid expire time in 'set' command\r\n"},
+		{"EXPIRE a 9223372037\r\n", 1, "-ERR invalid expire time in 'expire' command\r\n"},
+		{"*3\r\n$3\r\nSET\r\n$5\r\nempty\r\n$0\r\n\r\n", 1, "+OK\r\n"},
+		{"INCR empty\r\n", 1, "-ERR value is not an integer or out of range\r\n"},
+		{"GET\r\n", 1, "-ERR wrong number of arguments for 'get' command\r\n"},
+		{"FLUSHALL\r\n", 1, "-ERR unknown command 'flushall'\r\n"},
+	}
+
+	for _, tt := range tests {
+		if got := roundTrip(t, conn, r, tt.request, tt.lines); got != tt.want {
+			t.Errorf("%q: expected %q, got %q", tt.request, tt.want, got)
+		}
+	}
+}
+
+func TestHandler_Pipelining(t *testing.T) {
+	conn, r := serve(t, NewHandler())
+
+	got := roundTrip(t, conn, r, "SET k 1\r\nINCR k\r\nGET k\r\n", 4)
+	if want := "+OK\r\n:2\r\n$1\r\n2\r\n"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestHandler_BinarySafeValues(t *testing.T) {
+	conn, r := serve(t, NewHandler())
+
+	roundTrip(t, conn, r, "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$4\r\na\r\nb\r\n", 1)
+	got := roundTrip(t, conn, r, "GET k\r\n", 3)
+	if want := "$4\r\na\r\nb\r\n"; got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestHandler_ProtocolErrorCloses(t *testing.T) {
+	h := NewHandler()
+	h.MaxBulkSize = 8
+	conn, r := serve(t, h)
+
+	got := roundTrip(t, conn, r, "*2\r\n$4\r\nECHO\r\n$100\r\n", 1)
+	if !strings.HasPrefix(got, "-ERR protocol error") {
+		t.Errorf("Expected a protocol error, got %q", got)
+	}
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+}
+
+func TestHandler_Quit(t *testing.T) {
+	conn, r := serve(t, NewHandler())
+
+	if got := roundTrip(t, conn, r, "QUIT\r\n", 1); got != "+OK\r\n" {
+		t.Errorf("Expected +OK, got %q", got)
+	}
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+}
+
+func TestStore_Expiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := NewStore()
+	s.now = func() time.Time { return now }
+
+	s.Set("session", []byte("abc"), 10*time.Second, false, false)
+	s.Set("forever", []byte("x"), 0, false, false)
+	s.Incr("hits")
+	s.Expire("hits", 5*time.Second)
+
+	now = now.Add(5 * time.Second)
+	if _, ok := s.Get("hits"); ok {
+		t.Error("Expected hits to expire after 5s")
+	}
+	if _, ok := s.Get("session"); !ok {
+		t.Error("Expected session to survive 5s")
+	}
+
+	// INCR keeps the existing TTL
+	s.Incr("session2")
+	s.Expire("session2", time.Second)
+	s.Set("session2", []byte("41"), time.Second, false, true)
+	s.Incr("session2")
+
+	now = now.Add(10 * time.Second)
+	if _, ok := s.Get("session"); ok {
+		t.Error("Expected session to expire after 10s")
+	}
+	if _, ok := s.Get("session2"); ok {
+		t.Error("Expected INCR to keep the TTL")
+	}
+	if _, ok := s.Get("forever"); !ok {
+		t.Error("Key without TTL expired")
+	}
+
+	// Sweeping on write clears keys nobody reads again
+	s.Set("short", []byte("x"), time.Second, false, false)
+	now = now.Add(2 * time.Second)
+	s.Set("other", []byte("x"), 0, false, false)
+	if s.Len() != 2 {
+		t.Errorf("Expected expired keys to be swept, %d keys left", s.Len())
+	}
+}
@@ -0,0 +1,162 @@
+package resp
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errNotInteger matches the error Redis returns from INCR on a non-number
+var errNotInteger = errors.New("value is not an integer or out of range")
+
+// sweepInterval is how often writes also remove expired keys nobody read
+const sweepInterval = time.Second
+
+type entry struct {
+	value   []byte
+	expires time.Time // Zero means no expiry
+}
+
+// Store is an in-memory key/value map with per-key expiry, safe for
+// concurrent use. Expired keys are removed when they are next accessed and
+// by a periodic sweep during writes.
+type Store struct {
+	mu        sync.Mutex
+	data      map[string]entry
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewStore creates an empty store
+func NewStore() *Store {
+	return &Store{
+		data: make(map[string]entry),
+		now:  time.Now,
+	}
+}
+
+// Get returns the value of key and whether it exists
+func (s *Store) Get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.lookup(key)
+	return e.value, ok
+}
+
+// Set stores value under key. A ttl of zero keeps the key until it is
+// deleted. With onlyIfMissing (NX) or onlyIfExists (XX) Set may do nothing
+// and returns false.
+func (s *Store) Set(key string, value []byte, ttl time.Duration, onlyIfMissing, onlyIfExists bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, exists := s.lookup(key)
+	if (onlyIfMissing && exists) || (onlyIfExists && !exists) {
+		return false
+	}
+
+	e := entry{value: append([]byte(nil), value...)}
+	if ttl > 0 {
+		e.expires = s.now().Add(ttl)
+	}
+	s.data[key] = e
+	s.sweep()
+	return true
+}
+
+// Delete removes keys and returns how many existed
+func (s *Store) Delete(keys ...string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for _, key := range keys {
+		if _, ok := s.lookup(key); ok {
+			delete(s.data, key)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+// Incr adds one to the integer stored at key, starting from zero, and keeps
+// any expiry the key already had
+func (s *Store) Incr(key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, exists := s.lookup(key)
+	var n int64
+	if exists {
+		var err error
+		if n, err = strconv.ParseInt(string(e.value), 10, 64); err != nil {
+			return 0, errNotInteger
+		}
+	}
+	if n == 1<<63-1 {
+		return 0, errNotInteger
+	}
+
+	n++
+	e.value = strconv.AppendInt(nil, n, 10)
+	s.data[key] = e
+	s.sweep()
+	return n, nil
+}
+
+// Expire sets a key's time to live and reports whether the key exists. A
+// non-positive ttl deletes the key, as in Redis.
+func (s *Store) Expire(key string, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.lookup(key)
+	if !ok {
+		return false
+	}
+
+	if ttl <= 0 {
+		delete(s.data, key)
+		return true
+	}
+	e.expires = s.now().Add(ttl)
+	s.data[key] = e
+	return true
+}
+
+// Len returns the number of keys, including expired ones not yet removed
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.data)
+}
+
+// lookup returns a live entry, deleting it if it has expired. Callers hold mu.
+func (s *Store) lookup(key string) (entry, bool) {
+	e, ok := s.data[key]
+	if !ok {
+		return entry{}, false
+	}
+	if !e.expires.IsZero() && !s.now().Before(e.expires) {
+		delete(s.data, key)
+		return entry{}, false
+	}
+	return e, true
+}
+
+// sweep removes expired keys at most once per sweepInterval. Callers hold mu.
+func (s *Store) sweep() {
+	now := s.now()
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+
+	for key, e := range s.data {
+		if !e.expires.IsZero() && !now.Before(e.expires) {
+			delete(s.data, key)
+		}
+	}
+}
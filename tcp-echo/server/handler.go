@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+
+	"tcp-echo/framing"
+	"tcp-echo/metrics"
+	"tcp-echo/ratelimit"
+)
+
+// Handler serves a single client connection.
+//
+// ServeConn should return when the client disconnects or ctx is cancelled.
+// The returned error is logged by the server as the close reason; nil or
+// io.EOF means the client closed the connection normally.
+type Handler interface {
+	ServeConn(ctx context.Context, conn net.Conn) error
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface
+type HandlerFunc func(ctx context.Context, conn net.Conn) error
+
+// ServeConn calls f(ctx, conn)
+func (f HandlerFunc) ServeConn(ctx context.Context, conn net.Conn) error {
+	return f(ctx, conn)
+}
+
+// DefaultMaxLineLength is the default line limit.
+//
+// Deprecated: use framing.DefaultMaxFrameSize.
+const DefaultMaxLineLength = framing.DefaultMaxFrameSize
+
+// ErrLineTooLong is returned when a client sends a line longer than the limit.
+//
+// Deprecated: use framing.ErrFrameTooLarge, which this is the same error as.
+var ErrLineTooLong = framing.ErrFrameTooLarge
+
+// EchoHandler writes every frame it receives back to the client
+type EchoHandler struct {
+	Prefix         string         // Prepended to every echoed frame, ignored for fixed-size frames
+	Framing        framing.Config // How frames are delimited, newline by default
+	ShowClientAddr bool           // Prefix echoes with the client address, e.g. "[10.0.0.1:5000] "
+	LogPayload     bool           // Log every request and response, very noisy under load
+
+	// Longest accepted line including the newline, used when
+	// Framing.MaxFrameSize is zero.
+	//
+	// Deprecated: use Framing.MaxFrameSize.
+	MaxLineLength int
+}
+
+// NewEchoHandler creates a newline echo handler with the default "Echo: " prefix
+func NewEchoHandler() *EchoHandler {
+	return &EchoHandler{
+		Prefix: "Echo: ",
+		Framing: framing.Config{
+			Mode:         framing.Newline,
+			MaxFrameSize: framing.DefaultMaxFrameSize,
+		},
+	}
+}
+
+// ServeConn echoes frames until the client disconnects or ctx is cancelled.
+// Cancellation is only checked between frames, so a frame that has already
+// been read is always answered.
+func (h *EchoHandler) ServeConn(ctx context.Context, conn net.Conn) error {
+	prefix := h.Prefix
+	if h.ShowClientAddr {
+		prefix = fmt.Sprintf("[%s] %s", conn.RemoteAddr(), prefix)
+	}
+	if h.Framing.Mode == framing.Fixed {
+		prefix = ""
+	}
+
+	// The limit applies to what clients send. Echoes are longer by the
+	// prefix, so the framer gets room for it, and len16 payloads are capped
+	// so their echo still fits in the header.
+	maxPayload := h.Framing.MaxFrameSize
+	if maxPayload <= 0 && h.MaxLineLength > 0 {
+		maxPayload = h.MaxLineLength - 1
+	}
+	if maxPayload <= 0 {
+		maxPayload = framing.DefaultMaxFrameSize
+	}
+	if h.Framing.Mode == framing.LengthPrefix16 {
+		maxPayload = min(maxPayload, framing.MaxLength16-len(prefix))
+	}
+
+	config := h.Framing
+	config.MaxFrameSize = maxPayload + len(prefix)
+	framer, err := framing.New(conn, config)
+	if err != nil {
+		return err
+	}
+
+	limiter := ratelimit.MessagesFromContext(ctx)
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		payload, err := framer.ReadFrame()
+		if err != nil {
+			return err
+		}
+		if len(payload) > maxPayload {
+			return framing.ErrFrameTooLarge
+		}
+
+		switch err := limiter.Wait(ctx); {
+		case errors.Is(err, ratelimit.ErrDropped):
+			continue
+		case err != nil:
+			return err
+		}
+
+		response := append([]byte(prefix), payload...)
+		if h.LogPayload {
+			log.Printf("request from %s: %q", conn.RemoteAddr(), payload)
+			log.Printf("response to %s: %q", conn.RemoteAddr(), response)
+		}
+
+		if err := framer.WriteFrame(response); err != nil {
+			return err
+		}
+		metrics.ConnFromContext(ctx).AddFrame()
+	}
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// ErrNotListening is returned by File before the server has a socket
+var ErrNotListening = errors.New("server is not listening")
+
+// File returns a duplicate of the listening socket so it can be passed to a
+// new process, which serves it via Config.Listener or Config.PacketConn.
+// For unix sockets the socket file is no longer removed when this server
+// closes, since the new process now owns it.
+func (s *Server) File() (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var socket any
+	switch {
+	case s.packetConn != nil:
+		socket = s.packetConn
+	case s.rawListener != nil:
+		socket = s.rawListener
+	case s.listener != nil:
+		socket = s.listener
+	default:
+		return nil, ErrNotListening
+	}
+
+	if unixListener, ok := socket.(*net.UnixListener); ok {
+		unixListener.SetUnlinkOnClose(false)
+	}
+
+	filer, ok := socket.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, fmt.Errorf("%T can't be passed to another process", socket)
+	}
+	return filer.File()
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	errTooManyConns      = errors.New("too many connections")
+	errTooManyConnsForIP = errors.New("too many connections from your address")
+)
+
+// rejectWriteTimeout bounds how long we spend telling a client it was rejected
+const rejectWriteTimeout = time.Second
+
+// AdmissionPolicy decides what happens to connections over the MaxConns limit
+type AdmissionPolicy int
+
+const (
+	// AdmitReject accepts the connection, writes a short error line and closes it
+	AdmitReject AdmissionPolicy = iota
+	// AdmitQueue stops calling Accept until a slot frees up, leaving new
+	// connections waiting in the kernel's accept backlog
+	AdmitQueue
+)
+
+func (p AdmissionPolicy) String() string {
+	switch p {
+	case AdmitReject:
+		return "reject"
+	case AdmitQueue:
+		return "queue"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseAdmissionPolicy parses "reject" or "queue"
+func ParseAdmissionPolicy(s string) (AdmissionPolicy, error) {
+	switch s {
+	case "reject":
+		return AdmitReject, nil
+	case "queue":
+		return AdmitQueue, nil
+	default:
+		return 0, fmt.Errorf("unknown admission policy %q", s)
+	}
+}
+
+// Stats is a snapshot of the server's connection counters
+type Stats struct {
+	Active        int    // Connections currently being served
+	Rejected      uint64 // Rejected because MaxConns was reached
+	RejectedPerIP uint64 // Rejected because MaxConnsPerIP was reached
+	RateLimited   uint64 // Refused because the source IP connected faster than ConnRate allows
+}
+
+// Stats returns a snapshot of the connection counters
+func (s *Server) Stats() Stats {
+	s.mu.Lock()
+	active := len(s.conns)
+	s.mu.Unlock()
+
+	return Stats{
+		Active:        active,
+		Rejected:      s.rejected.Load(),
+		RejectedPerIP: s.rejectedPerIP.Load(),
+		RateLimited:   s.rateLimited.Load(),
+	}
+}
+
+// ConnLimits caps concurrent connections. Servers sharing one ConnLimits
+// count against the same totals, so several listeners together stay within
+// a single MaxConns and MaxConnsPerIP.
+type ConnLimits struct {
+	slots    chan struct{} // Semaphore for the total, nil when unlimited
+	maxPerIP int
+
+	mu    sync.Mutex
+	perIP map[string]int
+}
+
+// NewConnLimits creates limits of maxConns connections in total and maxPerIP
+// from each source IP (0 = unlimited)
+func NewConnLimits(maxConns, maxPerIP int) *ConnLimits {
+	l := &ConnLimits{
+		maxPerIP: maxPerIP,
+		perIP:    make(map[string]int),
+	}
+	if maxConns > 0 {
+		l.slots = make(chan struct{}, maxConns)
+	}
+	return l
+}
+
+// acquireIP counts a connection from ip, failing if ip is at the limit
+func (l *ConnLimits) acquireIP(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return false
+	}
+	l.perIP[ip]++
+	return true
+}
+
+// releaseIP undoes acquireIP
+func (l *ConnLimits) releaseIP(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.perIP[ip]--
+	if l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// acquireSlot blocks until a connection slot is free (AdmitQueue only).
+// It returns false if the server is closed while waiting.
+func (s *Server) acquireSlot() bool {
+	if s.limits.slots == nil || s.admission != AdmitQueue {
+		return true
+	}
+
+	select {
+	case s.limits.slots <- struct{}{}:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// tryAcquireSlot takes a connection slot without blocking (AdmitReject only)
+func (s *Server) tryAcquireSlot() bool {
+	if s.limits.slots == nil || s.admission != AdmitReject {
+		return true
+	}
+
+	select {
+	case s.limits.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// releaseSlot frees a slot taken by acquireSlot or tryAcquireSlot
+func (s *Server) releaseSlot() {
+	if s.limits.slots != nil {
+		<-s.limits.slots
+	}
+}
+
+// reject tells the client why it is being turned away and closes the connection
+func (s *Server) reject(conn net.Conn, reason error) {
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+	fmt.Fprintf(conn, "ERR %v\n", reason)
+}
+
+// remoteIP returns the host part of the connection's remote address
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr().String()
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
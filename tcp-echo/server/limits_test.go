@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"tcp-echo/ratelimit"
+)
+
+// blockingHandler holds every connection open until the client closes it
+var blockingHandler = HandlerFunc(func(ctx context.Context, conn net.Conn) error {
+	_, err := conn.Read(make([]byte, 1))
+	return err
+})
+
+func TestServer_RejectsOverMaxConns(t *testing.T) {
+	srv, addr := startTestServer(t, Config{
+		MaxConns: 1,
+		Handler:  blockingHandler,
+	})
+
+	first := dialTest(t, addr)
+	defer first.Close()
+	waitForActive(t, srv, 1)
+
+	second := dialTest(t, addr)
+	defer second.Close()
+
+	line, err := bufio.NewReader(second).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if line != "ERR too many connections\n" {
+		t.Errorf("Unexpected rejection line %q", line)
+	}
+
+	if stats := srv.Stats(); stats.Rejected != 1 {
+		t.Errorf("Expected 1 rejected connection, got %d", stats.Rejected)
+	}
+}
+
+func TestServer_RejectsOverMaxConnsPerIP(t *testing.T) {
+	srv, addr := startTestServer(t, Config{
+		MaxConnsPerIP: 1,
+		Handler:       blockingHandler,
+	})
+
+	first := dialTest(t, addr)
+	defer first.Close()
+	waitForActive(t, srv, 1)
+
+	second := dialTest(t, addr)
+	defer second.Close()
+
+	line, err := bufio.NewReader(second).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if line != "ERR too many connections from your address\n" {
+		t.Errorf("Unexpected rejection line %q", line)
+	}
+
+	if stats := srv.Stats(); stats.RejectedPerIP != 1 {
+		t.Errorf("Expected 1 per-IP rejection, got %d", stats.RejectedPerIP)
+	}
+}
+
+func TestServer_SharedLimitsAcrossListeners(t *testing.T) {
+	limits := NewConnLimits(2, 1)
+	first, firstAddr := startTestServer(t, Config{Limits: limits, Handler: blockingHandler})
+	second, secondAddr := startTestServer(t, Config{Limits: limits, Handler: blockingHandler})
+
+	conn := dialTest(t, firstAddr)
+	defer conn.Close()
+	waitForActive(t, first, 1)
+
+	// The per-IP cap counts connections on both listeners
+	rejected := dialTest(t, secondAddr)
+	defer rejected.Close()
+
+	line, err := bufio.NewReader(rejected).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if line != "ERR too many connections from your address\n" {
+		t.Errorf("Unexpected rejection line %q", line)
+	}
+	if stats := second.Stats(); stats.RejectedPerIP != 1 {
+		t.Errorf("Expected 1 per-IP rejection on the second listener, got %d", stats.RejectedPerIP)
+	}
+}
+
+func TestServer_QueuesOverMaxConns(t *testing.T) {
+	srv, addr := startTestServer(t, Config{
+		MaxConns:  1,
+		Admission: AdmitQueue,
+	})
+
+	first := dialTest(t, addr)
+	waitForActive(t, srv, 1)
+
+	// The second client sits in the backlog until the first one leaves
+	second := dialTest(t, addr)
+	defer second.Close()
+	second.Write([]byte("queued\n"))
+
+	second.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := bufio.NewReader(second).ReadString('\n'); err == nil {
+		t.Fatal("Queued connection was served while the limit was reached")
+	}
+
+	first.Close()
+
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(second).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if line != "Echo: queued\n" {
+		t.Errorf("Expected %q, got %q", "Echo: queued\n", line)
+	}
+
+	if stats := srv.Stats(); stats.Rejected != 0 {
+		t.Errorf("Expected no rejections in queue mode, got %d", stats.Rejected)
+	}
+}
+
+func dialTest(t *testing.T, addr string) net.Conn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	return conn
+}
+
+// waitForActive waits until the server is serving n connections
+func waitForActive(t *testing.T, srv *Server, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for srv.Stats().Active != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d active connections, got %d", n, srv.Stats().Active)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestServer_ConnRate(t *testing.T) {
+	limiter, _ := ratelimit.NewLimiter(ratelimit.FixedWindow, 1, time.Minute)
+	srv := startNetworkServer(t, Config{Addr: "127.0.0.1:0", ConnRate: limiter})
+
+	first := dialTest(t, srv.Addr().String())
+	defer first.Close()
+	first.Write([]byte("hi\n"))
+	if line, _ := bufio.NewReader(first).ReadString('\n'); line != "Echo: hi\n" {
+		t.Fatalf("Expected the first connection to be served, got %q", line)
+	}
+
+	second := dialTest(t, srv.Addr().String())
+	defer second.Close()
+	if line, _ := bufio.NewReader(second).ReadString('\n'); line != "ERR rate limit exceeded\n" {
+		t.Errorf("Unexpected rejection line %q", line)
+	}
+
+	if stats := srv.Stats(); stats.RateLimited != 1 {
+		t.Errorf("Expected 1 rate limited connection, got %d", stats.RateLimited)
+	}
+}
+
+func TestServer_MessageRateDisconnect(t *testing.T) {
+	srv, addr := startTestServer(t, Config{
+		MessageRate: &ratelimit.MessageConfig{Rate: 1, Action: ratelimit.Disconnect},
+	})
+
+	conn := dialTest(t, addr)
+	defer conn.Close()
+	conn.Write([]byte("one\ntwo\nthree\n"))
+
+	reader := bufio.NewReader(conn)
+	for _, want := range []string{"Echo: one\n", "ERR rate limit exceeded\n"} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if line != want {
+			t.Errorf("Expected %q, got %q", want, line)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for srv.Metrics().Snapshot().CloseReasons["rate_limited"] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected rate_limited close reason, got %v", srv.Metrics().Snapshot().CloseReasons)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// PacketHandler answers a single datagram. A nil response sends nothing back.
+type PacketHandler interface {
+	ServePacket(ctx context.Context, payload []byte, addr net.Addr) ([]byte, error)
+}
+
+// ServePacket echoes a datagram back with the configured prefix
+func (h *EchoHandler) ServePacket(ctx context.Context, payload []byte, addr net.Addr) ([]byte, error) {
+	if h.LogPayload {
+		log.Printf("request from %s: %q", addr, payload)
+	}
+
+	prefix := h.Prefix
+	if h.ShowClientAddr {
+		prefix = fmt.Sprintf("[%s] %s", addr, prefix)
+	}
+	return append([]byte(prefix), payload...), nil
+}
+
+// ServePacket reads datagrams from packetConn and answers each one with the
+// server's handler, which must implement PacketHandler
+func (s *Server) ServePacket(packetConn net.PacketConn) error {
+	handler, ok := s.handler.(PacketHandler)
+	if !ok {
+		packetConn.Close()
+		return fmt.Errorf("handler %T does not support datagrams", s.handler)
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		packetConn.Close()
+		return ErrServerClosed
+	}
+	s.packetConn = packetConn
+	s.mu.Unlock()
+
+	// One extra byte lets us tell a datagram of exactly the maximum size
+	// apart from one the kernel truncated to fit the buffer
+	buf := make([]byte, s.maxDatagramSize+1)
+	for {
+		n, addr, err := packetConn.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Printf("failed to read datagram, err: %v", err)
+			continue
+		}
+
+		if n > s.maxDatagramSize {
+			log.Printf("dropped datagram from %s: exceeds %d bytes", addr, s.maxDatagramSize)
+			continue
+		}
+
+		response, err := handler.ServePacket(s.ctx, buf[:n], addr)
+		if err != nil {
+			log.Printf("datagram from %s failed: %v", addr, err)
+			continue
+		}
+		if s.chaos != nil {
+			response = s.chaos.FilterPacket(response)
+		}
+		if response == nil {
+			continue
+		}
+
+		if s.writeTimeout > 0 {
+			packetConn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+		}
+		if _, err := packetConn.WriteTo(response, addr); err != nil {
+			log.Printf("failed to reply to %s, err: %v", addr, err)
+			continue
+		}
+		s.metrics.RecordPacket(n, len(response))
+	}
+}
+
+// isPacketNetwork reports whether network is datagram based
+func isPacketNetwork(network string) bool {
+	return strings.HasPrefix(network, "udp")
+}
+
+// removeStaleSocket deletes a unix socket file left behind by a previous
+// process. It refuses to delete anything that is not a socket.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	// Only remove it if nobody is listening on it any more
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	return os.Remove(path)
+}
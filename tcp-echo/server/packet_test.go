@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startNetworkServer runs ListenAndServe with config and waits for it to listen
+func startNetworkServer(t *testing.T, config Config) *Server {
+	t.Helper()
+
+	srv := NewServer(config)
+	go srv.ListenAndServe()
+	t.Cleanup(func() { srv.Close() })
+
+	deadline := time.Now().Add(time.Second)
+	for srv.Addr() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Server did not start listening")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return srv
+}
+
+func TestServer_UDPEcho(t *testing.T) {
+	srv := startNetworkServer(t, Config{Network: "udp", Addr: "127.0.0.1:0"})
+
+	conn, err := net.Dial("udp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("datagram"))
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if got := string(buf[:n]); got != "Echo: datagram" {
+		t.Errorf("Expected %q, got %q", "Echo: datagram", got)
+	}
+}
+
+func TestServer_UDPDropsOversizedDatagrams(t *testing.T) {
+	srv := startNetworkServer(t, Config{Network: "udp", Addr: "127.0.0.1:0", MaxDatagramSize: 4})
+
+	conn, err := net.Dial("udp", srv.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("too big"))
+	conn.Write([]byte("ok"))
+
+	// Only the datagram within the limit is answered
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if got := string(buf[:n]); got != "Echo: ok" {
+		t.Errorf("Expected %q, got %q", "Echo: ok", got)
+	}
+}
+
+func TestServer_UnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "echo.sock")
+
+	// A stale socket file from a crashed process must not block startup
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	srv := startNetworkServer(t, Config{Network: "unix", Addr: path, SocketMode: 0600})
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat failed: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("Expected socket mode 0600, got %o", perm)
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	conn.Write([]byte("local\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	conn.Close()
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if line != "Echo: local\n" {
+		t.Errorf("Expected %q, got %q", "Echo: local\n", line)
+	}
+
+	srv.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected socket file to be removed on close, got %v", err)
+	}
+}
+
+func TestRemoveStaleSocket_RefusesRegularFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "not-a-socket")
+	os.WriteFile(path, []byte("data"), 0644)
+
+	if err := removeStaleSocket(path); err == nil {
+		t.Error("Expected error for a regular file")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("Regular file was removed: %v", err)
+	}
+}
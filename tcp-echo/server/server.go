@@ -0,0 +1,711 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"tcp-echo/chaos"
+	"tcp-echo/chat"
+	"tcp-echo/framing"
+	"tcp-echo/metrics"
+	"tcp-echo/proxyproto"
+	"tcp-echo/ratelimit"
+	"tcp-echo/record"
+
+	"rate-limiter/ratelimiter"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Close or
+// Shutdown, and by reads that were interrupted because the server is draining
+var ErrServerClosed = errors.New("server closed")
+
+var (
+	// ErrIdleTimeout is returned by reads on a connection that sent nothing
+	// for Config.IdleTimeout
+	ErrIdleTimeout = errors.New("idle timeout exceeded")
+
+	// ErrWriteTimeout is returned by writes that a client didn't read within
+	// Config.WriteTimeout
+	ErrWriteTimeout = errors.New("write deadline exceeded")
+)
+
+// DefaultMaxDatagramSize is used when Config.MaxDatagramSize is zero
+const DefaultMaxDatagramSize = 64 * 1024
+
+// Config holds configuration for the server
+type Config struct {
+	Network      string        // "tcp" (default), "unix" or "udp"
+	Addr         string        // Address to listen on, e.g. ":9000" or "/tmp/echo.sock"
+	Handler      Handler       // Connection handler, defaults to an EchoHandler
+	DrainTimeout time.Duration // How long Shutdown waits for connections to finish
+	IdleTimeout  time.Duration // Close connections that send nothing for this long (0 = never)
+	WriteTimeout time.Duration // Deadline for each write to a client (0 = none)
+
+	MaxConns      int             // Maximum concurrent connections (0 = unlimited)
+	MaxConnsPerIP int             // Maximum concurrent connections per source IP (0 = unlimited)
+	Admission     AdmissionPolicy // What to do with connections over MaxConns
+	Limits        *ConnLimits     // Limits shared with other servers, used instead of MaxConns and MaxConnsPerIP
+
+	ConnRate    ratelimiter.RateLimiter  // Limits how often each source IP may connect, keyed before any PROXY header
+	MessageRate *ratelimit.MessageConfig // Limits the messages each connection may send
+
+	TLS           *TLSConfig         // Serve TLS instead of plaintext when set
+	ProxyProtocol *proxyproto.Config // Read PROXY protocol headers from trusted load balancers
+
+	Metrics  *metrics.Metrics // Counters for this listener, created if nil
+	Chaos    *chaos.Injector  // Inject faults into this listener's responses when set
+	Recorder *record.Recorder // Record every connection's traffic when set
+
+	SocketMode      os.FileMode   // Permissions for unix socket files, defaults to 0666
+	MaxDatagramSize int           // Largest UDP datagram accepted, larger ones are truncated and dropped
+	Socket          SocketOptions // TCP tuning applied by ListenAndServe
+
+	// Already open sockets for ListenAndServe to use instead of listening on
+	// Addr, e.g. ones inherited from the previous process during an upgrade
+	Listener   net.Listener
+	PacketConn net.PacketConn
+}
+
+// ShutdownSummary reports how open connections ended during Shutdown
+type ShutdownSummary struct {
+	Drained int // Handlers that returned on their own within the drain timeout
+	Killed  int // Connections force-closed after the drain timeout
+}
+
+// Server accepts stream connections and serves each one with a Handler, or
+// answers UDP datagrams with a PacketHandler
+type Server struct {
+	network      string
+	addr         string
+	handler      Handler
+	drainTimeout time.Duration
+	idleTimeout  time.Duration
+	writeTimeout time.Duration
+
+	admission     AdmissionPolicy
+	limits        *ConnLimits
+	rejected      atomic.Uint64
+	rejectedPerIP atomic.Uint64
+	rateLimited   atomic.Uint64
+	connRate      ratelimiter.RateLimiter
+	messageRate   *ratelimit.MessageConfig
+
+	tlsConfig     *TLSConfig
+	certs         *CertReloader
+	proxyProtocol *proxyproto.Config
+	metrics       *metrics.Metrics
+	chaos         *chaos.Injector
+	recorder      *record.Recorder
+
+	socketMode      os.FileMode
+	maxDatagramSize int
+	socket          SocketOptions
+
+	inheritedListener   net.Listener
+	inheritedPacketConn net.PacketConn
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu          sync.Mutex
+	listener    net.Listener
+	rawListener net.Listener // listener before PROXY and TLS wrapping
+	packetConn  net.PacketConn
+	conns       map[net.Conn]struct{}
+	closed      bool
+}
+
+// NewServer creates a new server
+func NewServer(config Config) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := &Server{
+		network:         config.Network,
+		addr:            config.Addr,
+		handler:         config.Handler,
+		drainTimeout:    config.DrainTimeout,
+		idleTimeout:     config.IdleTimeout,
+		writeTimeout:    config.WriteTimeout,
+		admission:       config.Admission,
+		limits:          config.Limits,
+		connRate:        config.ConnRate,
+		messageRate:     config.MessageRate,
+		tlsConfig:       config.TLS,
+		proxyProtocol:   config.ProxyProtocol,
+		metrics:         config.Metrics,
+		chaos:           config.Chaos,
+		recorder:        config.Recorder,
+		socketMode:      config.SocketMode,
+		maxDatagramSize: config.MaxDatagramSize,
+		socket:          config.Socket,
+
+		inheritedListener:   config.Listener,
+		inheritedPacketConn: config.PacketConn,
+
+		ctx:    ctx,
+		cancel: cancel,
+		conns:  make(map[net.Conn]struct{}),
+	}
+
+	if s.limits == nil {
+		s.limits = NewConnLimits(config.MaxConns, config.MaxConnsPerIP)
+	}
+
+	// Set defaults
+	if s.network == "" {
+		s.network = "tcp"
+	}
+	if s.socketMode == 0 {
+		s.socketMode = 0666
+	}
+	if s.maxDatagramSize == 0 {
+		s.maxDatagramSize = DefaultMaxDatagramSize
+	}
+	if s.handler == nil {
+		s.handler = NewEchoHandler()
+	}
+	if s.metrics == nil {
+		s.metrics = metrics.New()
+	}
+	if s.drainTimeout == 0 {
+		s.drainTimeout = 10 * time.Second
+	}
+
+	return s
+}
+
+// ListenAndServe listens on the configured network and address and serves
+// connections, wrapping stream listeners in TLS if TLS is configured
+func (s *Server) ListenAndServe() error {
+	if isPacketNetwork(s.network) {
+		if s.tlsConfig != nil {
+			return fmt.Errorf("tls is not supported over %s", s.network)
+		}
+
+		packetConn := s.inheritedPacketConn
+		if packetConn == nil {
+			var err error
+			if packetConn, err = net.ListenPacket(s.network, s.addr); err != nil {
+				return err
+			}
+		}
+		log.Printf("listening on %s/%s", s.network, packetConn.LocalAddr())
+
+		return s.ServePacket(packetConn)
+	}
+
+	var tlsConfig *tls.Config
+	if s.tlsConfig != nil {
+		certs, err := NewCertReloader(*s.tlsConfig)
+		if err != nil {
+			return err
+		}
+
+		s.mu.Lock()
+		s.certs = certs
+		s.mu.Unlock()
+		tlsConfig = certs.TLSConfig()
+	}
+
+	listener := s.inheritedListener
+	if listener == nil {
+		var err error
+		if listener, err = s.listen(); err != nil {
+			return err
+		}
+	}
+
+	// An inherited unix socket is ours to clean up now
+	if unixListener, ok := listener.(*net.UnixListener); ok && s.inheritedListener != nil {
+		unixListener.SetUnlinkOnClose(true)
+	}
+
+	s.mu.Lock()
+	s.rawListener = listener
+	s.mu.Unlock()
+
+	if s.connRate != nil {
+		listener = ratelimit.NewListener(listener, ratelimit.ListenerConfig{
+			Limiter: s.connRate,
+			OnReject: func(ip string) {
+				s.rateLimited.Add(1)
+				s.metrics.Reject("conn_rate")
+			},
+			Silent: tlsConfig != nil,
+		})
+	}
+
+	if s.socket != (SocketOptions{}) {
+		listener = &tunedListener{Listener: listener, options: s.socket}
+	}
+
+	// The PROXY header is sent in plaintext ahead of any TLS handshake
+	if s.proxyProtocol != nil {
+		listener = proxyproto.NewListener(listener, *s.proxyProtocol)
+	}
+
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+		log.Printf("listening on %s/%s (tls)", s.network, listener.Addr())
+	} else {
+		log.Printf("listening on %s/%s", s.network, listener.Addr())
+	}
+
+	return s.Serve(listener)
+}
+
+// listen opens the stream listener, preparing the socket file for unix sockets
+func (s *Server) listen() (net.Listener, error) {
+	if s.network != "unix" {
+		listenConfig := s.socket.listenConfig()
+		return listenConfig.Listen(context.Background(), s.network, s.addr)
+	}
+
+	if err := removeStaleSocket(s.addr); err != nil {
+		return nil, err
+	}
+
+	// The listener removes the socket file again when it is closed
+	listener, err := net.Listen("unix", s.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Chmod(s.addr, s.socketMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// ReloadTLS re-reads the certificate files. Existing connections keep their
+// session; new handshakes use the reloaded certificates.
+func (s *Server) ReloadTLS() error {
+	s.mu.Lock()
+	certs := s.certs
+	s.mu.Unlock()
+
+	if certs == nil {
+		return ErrTLSDisabled
+	}
+	return certs.Reload()
+}
+
+// Serve accepts connections on listener until the server is closed
+func (s *Server) Serve(listener net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		if !s.acquireSlot() {
+			return ErrServerClosed
+		}
+
+		conn, err := listener.Accept()
+		if err != nil {
+			if s.admission == AdmitQueue {
+				s.releaseSlot()
+			}
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			log.Printf("failed to accept connection, err: %v", err)
+			continue
+		}
+
+		if !s.tryAcquireSlot() {
+			s.rejected.Add(1)
+			s.metrics.Reject("max_conns")
+			if !s.addConn() {
+				conn.Close()
+				return ErrServerClosed
+			}
+			go func() {
+				defer s.wg.Done()
+				s.reject(conn, errTooManyConns)
+			}()
+			continue
+		}
+
+		if !s.addConn() {
+			conn.Close()
+			s.releaseSlot()
+			return ErrServerClosed
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// addConn counts a goroutine for an accepted connection in s.wg. It fails
+// once the server is closed, so Shutdown and Close never wait while the
+// count can still grow from zero.
+func (s *Server) addConn() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+// Addr returns the listener address, or nil if the server is not serving yet
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.packetConn != nil {
+		return s.packetConn.LocalAddr()
+	}
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Close stops accepting and immediately closes all open connections
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.cancel()
+
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	if s.packetConn != nil {
+		err = s.packetConn.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// Shutdown stops accepting new connections and lets open connections finish
+// the line they are currently serving, including one that is only partly
+// received. Connections still open after the drain timeout are force-closed
+// and Shutdown returns without waiting for their handlers.
+func (s *Server) Shutdown() ShutdownSummary {
+	s.mu.Lock()
+	s.closed = true
+	s.cancel()
+
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.packetConn != nil {
+		s.packetConn.Close()
+	}
+
+	// Wake up handlers blocked waiting for the next line. Ones in the middle
+	// of a line keep reading until it's complete.
+	open := len(s.conns)
+	for conn := range s.conns {
+		if conn.(*serverConn).betweenFrames() {
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return ShutdownSummary{Drained: open}
+	case <-time.After(s.drainTimeout):
+	}
+
+	// Drain timeout expired, force-close whatever is left
+	s.mu.Lock()
+	killed := len(s.conns)
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+
+	return ShutdownSummary{Drained: open - killed, Killed: killed}
+}
+
+// serveConn runs the handler for a single connection. Anything that may read
+// the PROXY header, such as the recorder asking for the client address, runs
+// here rather than in the accept loop so a silent client can't hold up others.
+func (s *Server) serveConn(accepted net.Conn) {
+	defer s.wg.Done()
+	defer s.releaseSlot()
+
+	// Record what actually crosses the wire, after faults are injected
+	if s.recorder != nil {
+		accepted = s.recorder.WrapConn(accepted)
+	}
+
+	// Faults go underneath serverConn so injected delays count against
+	// the write deadline like real ones would
+	if s.chaos != nil {
+		accepted = s.chaos.WrapConn(accepted)
+	}
+	conn := &serverConn{Conn: accepted, srv: s}
+
+	ip := remoteIP(conn)
+	if err := s.trackConn(conn, ip); err != nil {
+		if errors.Is(err, errTooManyConnsForIP) {
+			s.rejectedPerIP.Add(1)
+			s.metrics.Reject("max_conns_per_ip")
+			s.reject(conn, err)
+			return
+		}
+		conn.Close()
+		return
+	}
+	defer s.untrackConn(conn, ip)
+	defer conn.Close()
+
+	conn.stats = s.metrics.Open(conn.RemoteAddr().String())
+	ctx := metrics.WithConn(s.ctx, conn.stats)
+	if s.messageRate != nil {
+		ctx = ratelimit.WithMessages(ctx, ratelimit.NewMessages(*s.messageRate))
+	}
+
+	err := s.handler.ServeConn(ctx, conn)
+	reason := closeReason(err)
+	s.metrics.Close(conn.stats, reason)
+
+	switch reason {
+	case "client_closed":
+		// A client that half-closed may still be reading its last echoes
+		conn.closeGracefully()
+	case "rate_limited":
+		conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+		fmt.Fprintf(conn.Conn, "ERR %v\n", err)
+	}
+
+	if err != nil && !errors.Is(err, io.EOF) && !s.isClosed() {
+		log.Printf("connection %s closed: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// Metrics returns the server's counters
+func (s *Server) Metrics() *metrics.Metrics {
+	return s.metrics
+}
+
+// closeReason maps a handler's return value to a short metrics label
+func closeReason(err error) string {
+	switch {
+	case err == nil, errors.Is(err, io.EOF):
+		return "client_closed"
+	case errors.Is(err, ErrServerClosed):
+		return "drained"
+	case errors.Is(err, ErrIdleTimeout):
+		return "idle_timeout"
+	case errors.Is(err, ErrWriteTimeout):
+		return "write_timeout"
+	case errors.Is(err, framing.ErrFrameTooLarge):
+		return "frame_too_large"
+	case errors.Is(err, ratelimit.ErrRateLimited):
+		return "rate_limited"
+	case errors.Is(err, chat.ErrSlowConsumer):
+		return "slow_consumer"
+	case errors.Is(err, chaos.ErrInjectedReset), errors.Is(err, chaos.ErrInjectedPartialWrite):
+		return "chaos"
+	case errors.Is(err, net.ErrClosed):
+		return "killed"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	default:
+		return "error"
+	}
+}
+
+// trackConn registers an open connection, failing if the server is closed or
+// the client's IP already has MaxConnsPerIP connections open
+func (s *Server) trackConn(conn net.Conn, ip string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrServerClosed
+	}
+	if !s.limits.acquireIP(ip) {
+		return errTooManyConnsForIP
+	}
+
+	s.conns[conn] = struct{}{}
+	return nil
+}
+
+// untrackConn removes a connection once its handler has returned
+func (s *Server) untrackConn(conn net.Conn, ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns, conn)
+	s.limits.releaseIP(ip)
+}
+
+// serverConn wraps an accepted connection to apply the idle and write
+// deadlines, and to report why a deadline fired: ErrServerClosed when the
+// server is draining, ErrIdleTimeout or ErrWriteTimeout otherwise
+type serverConn struct {
+	net.Conn
+	srv   *Server
+	stats *metrics.Conn
+
+	// Set when the handler reads through a framing.Framer, which reports
+	// when a frame is complete, so Shutdown can leave partial frames alone
+	framed  atomic.Bool
+	partial atomic.Bool // Bytes of the next frame have been received
+
+	// Set by handlers whose clients may only receive, so that data sent to
+	// the client also holds off the idle timeout
+	writesActive atomic.Bool
+}
+
+// Read reads from the connection, failing fast once the server is draining
+// unless part of a frame has already been received
+func (c *serverConn) Read(p []byte) (int, error) {
+	if c.srv.idleTimeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.srv.idleTimeout))
+	}
+
+	// Checked after arming the idle deadline so that a concurrent Shutdown,
+	// which cancels first and then resets the deadline, always wins
+	if c.srv.ctx.Err() != nil {
+		if c.betweenFrames() {
+			return 0, ErrServerClosed
+		}
+		if c.srv.idleTimeout == 0 {
+			// Undo Shutdown's wake-up so the rest of the frame can arrive
+			c.Conn.SetReadDeadline(time.Time{})
+		}
+	}
+
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.partial.Store(true)
+		if c.stats != nil {
+			c.stats.AddBytesIn(n)
+		}
+	}
+	if err != nil && isTimeout(err) {
+		if c.srv.ctx.Err() != nil {
+			return n, ErrServerClosed
+		}
+		if c.srv.idleTimeout > 0 {
+			return n, ErrIdleTimeout
+		}
+	}
+	return n, err
+}
+
+// Write writes to the connection within the configured write deadline
+func (c *serverConn) Write(p []byte) (int, error) {
+	if c.srv.writeTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.srv.writeTimeout))
+	}
+
+	n, err := c.Conn.Write(p)
+	if n > 0 && c.stats != nil {
+		c.stats.AddBytesOut(n)
+	}
+	if n > 0 && c.writesActive.Load() && c.srv.idleTimeout > 0 {
+		// Push back the deadline of a read that may be blocked meanwhile.
+		// As in Read, a concurrent Shutdown's wake-up must win.
+		c.Conn.SetReadDeadline(time.Now().Add(c.srv.idleTimeout))
+		if c.srv.ctx.Err() != nil && c.betweenFrames() {
+			c.Conn.SetReadDeadline(time.Now())
+		}
+	}
+	if err != nil && isTimeout(err) && c.srv.writeTimeout > 0 {
+		return n, ErrWriteTimeout
+	}
+	return n, err
+}
+
+// CloseWrite half-closes the underlying connection if it supports it, so
+// handlers such as proxies can signal EOF while still reading
+func (c *serverConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// TrackFrames is called by framing.New when the handler reads frames
+func (c *serverConn) TrackFrames() {
+	c.framed.Store(true)
+}
+
+// FrameDone is called by the framer when a frame has been read and nothing of
+// the next one is buffered
+func (c *serverConn) FrameDone() {
+	c.partial.Store(false)
+}
+
+// CountWritesAsActivity makes data sent to the client reset the idle timeout
+// like data received from it, for handlers such as proxies and chat rooms
+// where a client may only receive for a long time
+func (c *serverConn) CountWritesAsActivity() {
+	c.writesActive.Store(true)
+}
+
+// betweenFrames reports whether interrupting a read would not cut off a frame.
+// Without a framer there is no way to tell, so reads are always interruptible.
+func (c *serverConn) betweenFrames() bool {
+	return !c.framed.Load() || !c.partial.Load()
+}
+
+// NetConn returns the wrapped connection
+func (c *serverConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// closeGracefully sends a FIN after everything written so far, even if
+// SO_LINGER 0 was configured to reset connections on close
+func (c *serverConn) closeGracefully() {
+	if tcpConn := tcpConn(c.Conn); tcpConn != nil {
+		tcpConn.SetLinger(-1)
+	}
+	c.CloseWrite()
+}
+
+// isTimeout reports whether err is a deadline expiry
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// isClosed reports whether Close has been called
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
@@ -0,0 +1,597 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"tcp-echo/chaos"
+	"tcp-echo/chat"
+	"tcp-echo/framing"
+	"tcp-echo/proxyproto"
+	"tcp-echo/record"
+)
+
+func TestEchoHandler_EchoesLines(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- NewEchoHandler().ServeConn(context.Background(), conn)
+	}()
+
+	reader := bufio.NewReader(client)
+	for _, msg := range []string{"hello\n", "world\n"} {
+		if _, err := client.Write([]byte(msg)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+
+		got, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		if want := "Echo: " + msg; got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+	}
+
+	client.Close()
+	if err := <-done; err == nil {
+		t.Error("Expected handler to return an error after client closed")
+	}
+}
+
+func TestEchoHandler_CustomPrefix(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	handler := &EchoHandler{Prefix: "> "}
+	go handler.ServeConn(context.Background(), conn)
+
+	client.Write([]byte("ping\n"))
+
+	got, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if got != "> ping\n" {
+		t.Errorf("Expected %q, got %q", "> ping\n", got)
+	}
+}
+
+func TestServer_ServesCustomHandler(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	srv := NewServer(Config{
+		Handler: HandlerFunc(func(ctx context.Context, conn net.Conn) error {
+			_, err := conn.Write([]byte("hi\n"))
+			return err
+		}),
+	})
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(listener)
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	got, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if got != "hi\n" {
+		t.Errorf("Expected %q, got %q", "hi\n", got)
+	}
+
+	srv.Close()
+	if err := <-serveErr; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("Expected ErrServerClosed, got %v", err)
+	}
+}
+
+func TestServer_ShutdownDrainsIdleConnections(t *testing.T) {
+	srv, addr := startTestServer(t, Config{DrainTimeout: time.Second})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	// Make sure the connection is being served before shutting down
+	conn.Write([]byte("hello\n"))
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	summary := srv.Shutdown()
+	if summary.Drained != 1 || summary.Killed != 0 {
+		t.Errorf("Expected 1 drained and 0 killed, got %+v", summary)
+	}
+}
+
+func TestServer_ShutdownFinishesPartialLine(t *testing.T) {
+	srv, addr := startTestServer(t, Config{DrainTimeout: 2 * time.Second})
+
+	busy, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer busy.Close()
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer idle.Close()
+
+	// Both connections are served, and one has started its next line
+	for _, conn := range []net.Conn{busy, idle} {
+		conn.Write([]byte("hello\n"))
+		if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+	}
+	busy.Write([]byte("wor"))
+	time.Sleep(20 * time.Millisecond)
+
+	done := make(chan ShutdownSummary, 1)
+	go func() { done <- srv.Shutdown() }()
+
+	// The idle connection is closed straight away
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the idle connection to be closed")
+	}
+
+	// The rest of the line still gets its echo
+	time.Sleep(100 * time.Millisecond)
+	busy.Write([]byte("ld\n"))
+	busy.SetReadDeadline(time.Now().Add(time.Second))
+	got, err := bufio.NewReader(busy).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if got != "Echo: world\n" {
+		t.Errorf("Expected the partial line to be echoed, got %q", got)
+	}
+
+	if summary := <-done; summary.Drained != 2 || summary.Killed != 0 {
+		t.Errorf("Expected 2 drained and 0 killed, got %+v", summary)
+	}
+}
+
+func TestServer_ShutdownKillsStuckConnections(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	started := make(chan struct{})
+	srv, addr := startTestServer(t, Config{
+		DrainTimeout: 50 * time.Millisecond,
+		Handler: HandlerFunc(func(ctx context.Context, conn net.Conn) error {
+			close(started)
+			// Ignore ctx to simulate a handler stuck mid-request
+			<-release
+			return nil
+		}),
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	<-started
+
+	summary := srv.Shutdown()
+	if summary.Drained != 0 || summary.Killed != 1 {
+		t.Errorf("Expected 0 drained and 1 killed, got %+v", summary)
+	}
+}
+
+func TestEchoHandler_RejectsLongLines(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		handler := &EchoHandler{Framing: framing.Config{MaxFrameSize: 8}}
+		done <- handler.ServeConn(context.Background(), conn)
+	}()
+
+	// No newline within the limit, so the handler must give up
+	go client.Write([]byte("this line is far too long\n"))
+
+	if err := <-done; !errors.Is(err, framing.ErrFrameTooLarge) {
+		t.Errorf("Expected ErrFrameTooLarge, got %v", err)
+	}
+}
+
+func TestEchoHandler_EchoesMaxSizeFrames(t *testing.T) {
+	tests := []struct {
+		name    string
+		framing framing.Config
+		size    int // Largest payload that is echoed
+	}{
+		{name: "newline", framing: framing.Config{Mode: framing.Newline, MaxFrameSize: 100}, size: 100},
+		{name: "len32", framing: framing.Config{Mode: framing.LengthPrefix32, MaxFrameSize: 100}, size: 100},
+		// The echo's length has to fit in 16 bits, prefix included
+		{name: "len16", framing: framing.Config{Mode: framing.LengthPrefix16, MaxFrameSize: framing.MaxLength16}, size: framing.MaxLength16 - len("Echo: ")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, size := range []int{tt.size, tt.size + 1} {
+				client, conn := net.Pipe()
+				handler := &EchoHandler{Prefix: "Echo: ", Framing: tt.framing}
+
+				done := make(chan error, 1)
+				go func() { done <- handler.ServeConn(context.Background(), conn) }()
+
+				clientFramer, _ := framing.New(client, framing.Config{Mode: tt.framing.Mode, MaxFrameSize: framing.MaxLength16})
+				go clientFramer.WriteFrame(bytes.Repeat([]byte("x"), size))
+
+				if size == tt.size {
+					got, err := clientFramer.ReadFrame()
+					if err != nil {
+						t.Fatalf("Expected a %d-byte frame to be echoed, got %v", size, err)
+					}
+					if len(got) != len("Echo: ")+size {
+						t.Errorf("Expected a %d-byte echo, got %d bytes", len("Echo: ")+size, len(got))
+					}
+					client.Close()
+					<-done
+					continue
+				}
+
+				if err := <-done; !errors.Is(err, framing.ErrFrameTooLarge) {
+					t.Errorf("Expected ErrFrameTooLarge for a %d-byte frame, got %v", size, err)
+				}
+				client.Close()
+			}
+		})
+	}
+}
+
+func TestEchoHandler_DeprecatedMaxLineLength(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		handler := &EchoHandler{MaxLineLength: 8}
+		done <- handler.ServeConn(context.Background(), conn)
+	}()
+
+	// 7 bytes plus the newline fit, 8 don't
+	go client.Write([]byte("1234567\n12345678\n"))
+	reply, err := bufio.NewReader(client).ReadString('\n')
+	if err != nil || reply != "1234567\n" {
+		t.Fatalf("Expected the short line to be echoed, got %q, %v", reply, err)
+	}
+
+	if err := <-done; !errors.Is(err, ErrLineTooLong) {
+		t.Errorf("Expected ErrLineTooLong, got %v", err)
+	}
+}
+
+func TestServer_IdleTimeoutClosesConnection(t *testing.T) {
+	handlerErr := make(chan error, 1)
+	_, addr := startTestServer(t, Config{
+		IdleTimeout: 50 * time.Millisecond,
+		Handler: HandlerFunc(func(ctx context.Context, conn net.Conn) error {
+			_, err := conn.Read(make([]byte, 1))
+			handlerErr <- err
+			return err
+		}),
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	select {
+	case err := <-handlerErr:
+		if !errors.Is(err, ErrIdleTimeout) {
+			t.Errorf("Expected ErrIdleTimeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Idle connection was not closed")
+	}
+}
+
+func TestServer_WriteTimeoutClosesConnection(t *testing.T) {
+	handlerErr := make(chan error, 1)
+	srv, addr := startTestServer(t, Config{
+		WriteTimeout: 50 * time.Millisecond,
+		Handler: HandlerFunc(func(ctx context.Context, conn net.Conn) error {
+			// Keep writing until the socket buffers fill up
+			chunk := make([]byte, 64*1024)
+			for {
+				if _, err := conn.Write(chunk); err != nil {
+					handlerErr <- err
+					return err
+				}
+			}
+		}),
+	})
+
+	// The client never reads
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	select {
+	case err := <-handlerErr:
+		if !errors.Is(err, ErrWriteTimeout) {
+			t.Errorf("Expected ErrWriteTimeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write to a client that isn't reading never timed out")
+	}
+
+	// The close reason is recorded once the handler has returned
+	deadline := time.Now().Add(time.Second)
+	for srv.Metrics().Snapshot().CloseReasons["write_timeout"] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected a write_timeout close reason, got %v", srv.Metrics().Snapshot().CloseReasons)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServer_ChatListenerOutlivesIdleTimeout(t *testing.T) {
+	_, addr := startTestServer(t, Config{
+		IdleTimeout: 100 * time.Millisecond,
+		Handler:     chat.NewHub(chat.Config{}),
+	})
+
+	listener := dialTest(t, addr)
+	talker := dialTest(t, addr)
+	r := bufio.NewReader(listener)
+
+	// The listener never sends, but the broadcasts it receives over several
+	// idle timeouts keep it connected
+	for i := range 6 {
+		fmt.Fprintf(talker, "message %d\n", i)
+		listener.SetReadDeadline(time.Now().Add(time.Second))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Listener was disconnected before message %d: %v", i, err)
+			}
+			if strings.Contains(line, fmt.Sprintf("message %d", i)) {
+				break
+			}
+		}
+		time.Sleep(40 * time.Millisecond)
+	}
+}
+
+func TestCloseReason_SlowConsumer(t *testing.T) {
+	if reason := closeReason(chat.ErrSlowConsumer); reason != "slow_consumer" {
+		t.Errorf("Expected slow_consumer, got %s", reason)
+	}
+}
+
+// startTestServer serves config on a random local port
+func startTestServer(t *testing.T, config Config) (*Server, string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	srv := NewServer(config)
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	return srv, listener.Addr().String()
+}
+
+func TestServer_ProxyProtocolClientAddress(t *testing.T) {
+	trusted, _ := proxyproto.ParseTrusted("127.0.0.1")
+	handler := NewEchoHandler()
+	handler.ShowClientAddr = true
+
+	srv := startNetworkServer(t, Config{
+		Addr:          "127.0.0.1:0",
+		Handler:       handler,
+		ProxyProtocol: &proxyproto.Config{Trusted: trusted},
+	})
+
+	conn := dialTest(t, srv.Addr().String())
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 4000 9000\r\nhi\n"))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if want := "[203.0.113.7:4000] Echo: hi\n"; line != want {
+		t.Errorf("Expected %q, got %q", want, line)
+	}
+}
+
+func TestServer_RecordsMetrics(t *testing.T) {
+	srv, addr := startTestServer(t, Config{})
+
+	conn := dialTest(t, addr)
+	conn.Write([]byte("hello\n"))
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	conn.Close()
+
+	deadline := time.Now().Add(time.Second)
+	for srv.Metrics().Snapshot().Closed != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Connection close was not recorded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	snapshot := srv.Metrics().Snapshot()
+	if snapshot.Accepted != 1 || snapshot.Frames != 1 {
+		t.Errorf("Expected 1 accepted connection and 1 frame, got %+v", snapshot)
+	}
+	if snapshot.BytesIn != 6 || snapshot.BytesOut != 12 {
+		t.Errorf("Expected 6 bytes in and 12 out, got %d/%d", snapshot.BytesIn, snapshot.BytesOut)
+	}
+	if snapshot.CloseReasons["client_closed"] != 1 {
+		t.Errorf("Expected client_closed reason, got %v", snapshot.CloseReasons)
+	}
+}
+
+func TestServer_ChaosReset(t *testing.T) {
+	injector, _ := chaos.NewInjector(chaos.Config{Enabled: true, ResetRate: 1})
+	srv, addr := startTestServer(t, Config{Chaos: injector})
+
+	conn := dialTest(t, addr)
+	defer conn.Close()
+	conn.Write([]byte("hello\n"))
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err == nil {
+		t.Fatal("Expected the connection to be reset")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for srv.Metrics().Snapshot().CloseReasons["chaos"] != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected chaos close reason, got %v", srv.Metrics().Snapshot().CloseReasons)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Turning injection off restores normal echoes on new connections
+	injector.SetEnabled(false)
+	conn = dialTest(t, addr)
+	defer conn.Close()
+	conn.Write([]byte("hello\n"))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "Echo: hello\n" {
+		t.Errorf("Expected a normal echo, got %q (%v)", line, err)
+	}
+}
+
+func TestServer_RecordsSessions(t *testing.T) {
+	var buf bytes.Buffer
+	recorder, _ := record.NewRecorder(&buf, record.JSONLines)
+	srv, addr := startTestServer(t, Config{Recorder: recorder})
+
+	conn := dialTest(t, addr)
+	conn.Write([]byte("hello\n"))
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	conn.Close()
+
+	// Close waits for the handler, so nothing is still being recorded
+	srv.Close()
+	recorder.Flush()
+
+	events, err := record.ReadEvents(&buf)
+	if err != nil {
+		t.Fatalf("ReadEvents failed: %v", err)
+	}
+	sessions := record.Sessions(events)
+	if len(sessions) != 1 || len(sessions[0].Events) != 2 || string(sessions[0].Events[1].Data) != "Echo: hello\n" {
+		t.Errorf("Unexpected recording: %+v", sessions)
+	}
+}
+
+func TestServer_SilentProxyClientDoesNotBlockRecording(t *testing.T) {
+	var buf bytes.Buffer
+	recorder, _ := record.NewRecorder(&buf, record.JSONLines)
+	trusted, _ := proxyproto.ParseTrusted("127.0.0.1")
+
+	srv := startNetworkServer(t, Config{
+		Addr:          "127.0.0.1:0",
+		Recorder:      recorder,
+		ProxyProtocol: &proxyproto.Config{Trusted: trusted, HeaderTimeout: 2 * time.Second},
+	})
+
+	// A trusted client that never sends its header
+	silent := dialTest(t, srv.Addr().String())
+	defer silent.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	conn := dialTest(t, srv.Addr().String())
+	defer conn.Close()
+	conn.Write([]byte("PROXY TCP4 203.0.113.7 10.0.0.1 4000 9000\r\nhi\n"))
+
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Echo waited %s behind the silent client", elapsed)
+	}
+	conn.Close()
+	silent.Close()
+
+	srv.Close()
+	recorder.Flush()
+
+	// The recording has the address from the header
+	events, err := record.ReadEvents(&buf)
+	if err != nil {
+		t.Fatalf("ReadEvents failed: %v", err)
+	}
+	found := false
+	for _, event := range events {
+		found = found || event.Remote == "203.0.113.7:4000"
+	}
+	if !found {
+		t.Errorf("Expected a session from 203.0.113.7:4000, got %+v", events)
+	}
+}
+
+func TestServer_HandsOffListener(t *testing.T) {
+	old := startNetworkServer(t, Config{Addr: "127.0.0.1:0"})
+	addr := old.Addr().String()
+
+	file, err := old.File()
+	if err != nil {
+		t.Fatalf("File failed: %v", err)
+	}
+	listener, err := net.FileListener(file)
+	file.Close()
+	if err != nil {
+		t.Fatalf("FileListener failed: %v", err)
+	}
+
+	next := startNetworkServer(t, Config{Listener: listener, Handler: &EchoHandler{Prefix: "next: "}})
+	if got := next.Addr().String(); got != addr {
+		t.Fatalf("Expected inherited address %s, got %s", addr, got)
+	}
+	old.Shutdown()
+
+	// The socket stays open, so new clients land on the new server
+	conn := dialTest(t, addr)
+	defer conn.Close()
+	conn.Write([]byte("hello\n"))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "next: hello\n" {
+		t.Errorf("Expected the new server to answer, got %q (%v)", line, err)
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// SocketOptions tunes a TCP listener and the connections it accepts. The zero
+// value keeps Go's and the OS defaults.
+type SocketOptions struct {
+	NoDelay        *bool         // TCP_NODELAY, which Go enables by default
+	KeepAlive      time.Duration // Idle time before the first probe and between probes (0 = Go's 15s, negative disables)
+	KeepAliveCount int           // Unanswered probes before the connection is dropped (0 = Go's 9)
+	SendBuffer     int           // SO_SNDBUF in bytes (0 = OS default)
+	ReceiveBuffer  int           // SO_RCVBUF in bytes (0 = OS default)
+	Linger         *int          // SO_LINGER in seconds, 0 resets connections on close instead of sending a FIN
+	IPv6Only       bool          // IPV6_V6ONLY, so "[::]:port" doesn't also accept IPv4 clients
+}
+
+// ParseSocketOptions parses options in URL query form, e.g.
+// "nodelay=false&keepalive=30s&keepalive-count=3&sndbuf=65536&rcvbuf=65536&linger=0&v6only=true"
+func ParseSocketOptions(query string) (SocketOptions, error) {
+	var options SocketOptions
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return options, fmt.Errorf("invalid socket options %q: %v", query, err)
+	}
+
+	for name := range values {
+		value := values.Get(name)
+
+		switch name {
+		case "nodelay":
+			noDelay, err := strconv.ParseBool(value)
+			if err != nil {
+				return options, fmt.Errorf("invalid nodelay %q", value)
+			}
+			options.NoDelay = &noDelay
+		case "keepalive":
+			if options.KeepAlive, err = time.ParseDuration(value); err != nil {
+				return options, fmt.Errorf("invalid keepalive %q", value)
+			}
+		case "keepalive-count":
+			if options.KeepAliveCount, err = strconv.Atoi(value); err != nil || options.KeepAliveCount < 0 {
+				return options, fmt.Errorf("invalid keepalive-count %q", value)
+			}
+		case "sndbuf":
+			if options.SendBuffer, err = strconv.Atoi(value); err != nil || options.SendBuffer < 0 {
+				return options, fmt.Errorf("invalid sndbuf %q", value)
+			}
+		case "rcvbuf":
+			if options.ReceiveBuffer, err = strconv.Atoi(value); err != nil || options.ReceiveBuffer < 0 {
+				return options, fmt.Errorf("invalid rcvbuf %q", value)
+			}
+		case "linger":
+			linger, err := strconv.Atoi(value)
+			if err != nil || linger < 0 {
+				return options, fmt.Errorf("invalid linger %q", value)
+			}
+			options.Linger = &linger
+		case "v6only":
+			if options.IPv6Only, err = strconv.ParseBool(value); err != nil {
+				return options, fmt.Errorf("invalid v6only %q", value)
+			}
+		default:
+			return options, fmt.Errorf("unknown socket option %q", name)
+		}
+	}
+	return options, nil
+}
+
+// listenConfig sets the options that must be in place before the socket is
+// bound. Buffer sizes set on the listener are inherited by accepted
+// connections, and the receive buffer has to be sized before the handshake
+// for large TCP windows to be negotiated.
+func (o SocketOptions) listenConfig() net.ListenConfig {
+	return net.ListenConfig{
+		Control: func(network, address string, conn syscall.RawConn) error {
+			var sockErr error
+			err := conn.Control(func(fd uintptr) {
+				if o.IPv6Only && network == "tcp6" {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1)
+				}
+				if sockErr == nil && o.SendBuffer > 0 {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, o.SendBuffer)
+				}
+				if sockErr == nil && o.ReceiveBuffer > 0 {
+					sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, o.ReceiveBuffer)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			return sockErr
+		},
+	}
+}
+
+// tunedListener applies per-connection options as connections are accepted,
+// which also covers listeners inherited from another process
+type tunedListener struct {
+	net.Listener
+	options SocketOptions
+}
+
+func (l *tunedListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return conn, nil
+	}
+
+	if l.options.NoDelay != nil {
+		tcpConn.SetNoDelay(*l.options.NoDelay)
+	}
+	if l.options.Linger != nil {
+		tcpConn.SetLinger(*l.options.Linger)
+	}
+
+	switch {
+	case l.options.KeepAlive < 0:
+		tcpConn.SetKeepAlive(false)
+	case l.options.KeepAlive > 0 || l.options.KeepAliveCount > 0:
+		tcpConn.SetKeepAliveConfig(net.KeepAliveConfig{
+			Enable:   true,
+			Idle:     l.options.KeepAlive,
+			Interval: l.options.KeepAlive,
+			Count:    l.options.KeepAliveCount,
+		})
+	}
+	return conn, nil
+}
+
+// tcpConn finds the TCP connection underneath conn's wrappers, or nil
+func tcpConn(conn net.Conn) *net.TCPConn {
+	for {
+		if tcpConn, ok := conn.(*net.TCPConn); ok {
+			return tcpConn
+		}
+
+		// Look through wrappers such as *tls.Conn
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return nil
+		}
+		conn = wrapper.NetConn()
+	}
+}
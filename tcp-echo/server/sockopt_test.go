@@ -0,0 +1,129 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseSocketOptions(t *testing.T) {
+	options, err := ParseSocketOptions("nodelay=false&keepalive=30s&keepalive-count=3&sndbuf=65536&rcvbuf=131072&linger=0&v6only=true")
+	if err != nil {
+		t.Fatalf("ParseSocketOptions failed: %v", err)
+	}
+
+	if options.NoDelay == nil || *options.NoDelay {
+		t.Errorf("Expected nodelay=false, got %v", options.NoDelay)
+	}
+	if options.Linger == nil || *options.Linger != 0 {
+		t.Errorf("Expected linger=0, got %v", options.Linger)
+	}
+	if options.KeepAlive != 30*time.Second || options.KeepAliveCount != 3 {
+		t.Errorf("Unexpected keepalive %s x%d", options.KeepAlive, options.KeepAliveCount)
+	}
+	if options.SendBuffer != 65536 || options.ReceiveBuffer != 131072 || !options.IPv6Only {
+		t.Errorf("Unexpected options %+v", options)
+	}
+
+	for _, query := range []string{"nodelay=maybe", "keepalive=soon", "rcvbuf=-1", "linger=x", "mss=1400"} {
+		if _, err := ParseSocketOptions(query); err == nil {
+			t.Errorf("Expected an error for %q", query)
+		}
+	}
+}
+
+func TestServer_AppliesSocketOptions(t *testing.T) {
+	noDelay, linger := false, 0
+	options := make(chan map[string]int, 1)
+
+	srv := startNetworkServer(t, Config{
+		Addr: "127.0.0.1:0",
+		Socket: SocketOptions{
+			NoDelay:       &noDelay,
+			KeepAlive:     30 * time.Second,
+			ReceiveBuffer: 64 * 1024,
+			Linger:        &linger,
+		},
+		Handler: HandlerFunc(func(ctx context.Context, conn net.Conn) error {
+			options <- socketOptions(t, tcpConn(conn), map[string][2]int{
+				"nodelay":   {syscall.IPPROTO_TCP, syscall.TCP_NODELAY},
+				"keepalive": {syscall.SOL_SOCKET, syscall.SO_KEEPALIVE},
+				"keepidle":  {syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE},
+				"rcvbuf":    {syscall.SOL_SOCKET, syscall.SO_RCVBUF},
+			})
+			return nil
+		}),
+	})
+
+	conn := dialTest(t, srv.Addr().String())
+	defer conn.Close()
+
+	got := <-options
+	if got["nodelay"] != 0 || got["keepalive"] != 1 || got["keepidle"] != 30 {
+		t.Errorf("Unexpected TCP options %v", got)
+	}
+	// Linux doubles the requested size for bookkeeping
+	if got["rcvbuf"] < 64*1024 {
+		t.Errorf("Expected a receive buffer of at least 64KB, got %d", got["rcvbuf"])
+	}
+}
+
+func TestServer_HalfCloseDeliversEchoesDespiteLinger(t *testing.T) {
+	// Linger 0 resets connections the server closes, which would throw away
+	// echoes still in the send buffer
+	linger := 0
+	srv := startNetworkServer(t, Config{Addr: "127.0.0.1:0", Socket: SocketOptions{Linger: &linger}})
+
+	conn := dialTest(t, srv.Addr().String())
+	defer conn.Close()
+
+	conn.Write([]byte("one\ntwo\nthree"))
+	conn.(*net.TCPConn).CloseWrite()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if want := "Echo: one\nEcho: two\nEcho: three\n"; string(got) != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestSocketOptions_IPv6Only(t *testing.T) {
+	listenConfig := SocketOptions{IPv6Only: true}.listenConfig()
+	listener, err := listenConfig.Listen(context.Background(), "tcp6", "[::]:0")
+	if err != nil {
+		t.Skipf("IPv6 is not available: %v", err)
+	}
+	defer listener.Close()
+
+	// The IPv4 side of the same port is left for another listener
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener4, err := net.Listen("tcp4", net.JoinHostPort("0.0.0.0", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("Expected the IPv4 port to be free, got %v", err)
+	}
+	listener4.Close()
+}
+
+// socketOptions reads integer socket options from conn
+func socketOptions(t *testing.T, conn *net.TCPConn, names map[string][2]int) map[string]int {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Errorf("SyscallConn failed: %v", err)
+		return nil
+	}
+
+	values := make(map[string]int, len(names))
+	raw.Control(func(fd uintptr) {
+		for name, option := range names {
+			values[name], _ = syscall.GetsockoptInt(int(fd), option[0], option[1])
+		}
+	})
+	return values
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestCert writes a self-signed pair into dir and returns the file paths
+func writeTestCert(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err := WriteSelfSignedCert(certFile, keyFile, "127.0.0.1"); err != nil {
+		t.Fatalf("WriteSelfSignedCert failed: %v", err)
+	}
+	return certFile, keyFile
+}
+
+// startTLSServer runs ListenAndServe on a random port and waits for it
+func startTLSServer(t *testing.T, config Config) (*Server, string) {
+	t.Helper()
+
+	config.Addr = "127.0.0.1:0"
+	srv := startNetworkServer(t, config)
+	return srv, srv.Addr().String()
+}
+
+func certPool(t *testing.T, certFile string) *x509.CertPool {
+	t.Helper()
+
+	pem, err := os.ReadFile(certFile)
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+	return pool
+}
+
+func TestServer_TLSEcho(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "server")
+	_, addr := startTLSServer(t, Config{
+		TLS: &TLSConfig{CertFile: certFile, KeyFile: keyFile},
+	})
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: certPool(t, certFile)})
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("secure\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	if line != "Echo: secure\n" {
+		t.Errorf("Expected %q, got %q", "Echo: secure\n", line)
+	}
+}
+
+func TestServer_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "server")
+	clientCert, clientKey := writeTestCert(t, dir, "client")
+
+	_, addr := startTLSServer(t, Config{
+		TLS: &TLSConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: clientCert},
+	})
+
+	// Without a client certificate the handshake must fail
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: certPool(t, certFile)})
+	if err == nil {
+		conn.Write([]byte("anonymous\n"))
+		_, err = bufio.NewReader(conn).ReadString('\n')
+		conn.Close()
+	}
+	if err == nil {
+		t.Error("Expected connection without client certificate to fail")
+	}
+
+	pair, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair failed: %v", err)
+	}
+
+	conn, err = tls.Dial("tcp", addr, &tls.Config{
+		RootCAs:      certPool(t, certFile),
+		Certificates: []tls.Certificate{pair},
+	})
+	if err != nil {
+		t.Fatalf("Dial with client certificate failed: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("trusted\n"))
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Errorf("Read with client certificate failed: %v", err)
+	}
+}
+
+func TestServer_ReloadTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "server")
+	srv, addr := startTLSServer(t, Config{
+		TLS: &TLSConfig{CertFile: certFile, KeyFile: keyFile},
+	})
+
+	oldPool := certPool(t, certFile)
+
+	// Replace the files on disk and reload
+	writeTestCert(t, dir, "server")
+	if err := srv.ReloadTLS(); err != nil {
+		t.Fatalf("ReloadTLS failed: %v", err)
+	}
+
+	if conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: oldPool}); err == nil {
+		conn.Close()
+		t.Error("Expected old certificate to be replaced after reload")
+	}
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: certPool(t, certFile)})
+	if err != nil {
+		t.Fatalf("Dial with reloaded certificate failed: %v", err)
+	}
+	conn.Close()
+}
+
+func TestServer_ReloadTLSWithoutTLS(t *testing.T) {
+	srv := NewServer(Config{})
+	if err := srv.ReloadTLS(); err != ErrTLSDisabled {
+		t.Errorf("Expected ErrTLSDisabled, got %v", err)
+	}
+}
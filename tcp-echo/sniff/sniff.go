@@ -0,0 +1,299 @@
+// Package sniff serves several protocols on one port. It peeks at the first
+// bytes of each connection and hands HTTP requests (including WebSocket
+// upgrades) to an http.Handler and everything else to a raw stream handler.
+package sniff
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"tcp-echo/server"
+)
+
+// rewakeInterval is how often a client that is still sending when the peek
+// timeout expires is woken up again
+const rewakeInterval = 10 * time.Millisecond
+
+// httpMethods are the request line prefixes that mark a connection as HTTP
+var httpMethods = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+// Config holds configuration for the sniffing handler
+type Config struct {
+	Raw  server.Handler // Serves connections that aren't HTTP
+	HTTP http.Handler   // Serves HTTP and WebSocket connections
+
+	// How long to wait for the client to speak first before treating the
+	// connection as raw, so server-first protocols still get their greeting.
+	// Defaults to 1s.
+	PeekTimeout time.Duration
+}
+
+// Handler dispatches each connection by protocol. It implements server.Handler.
+type Handler struct {
+	raw         server.Handler
+	peekTimeout time.Duration
+
+	httpServer *http.Server
+	conns      *connListener
+	once       sync.Once
+}
+
+// NewHandler creates a sniffing handler
+func NewHandler(config Config) *Handler {
+	h := &Handler{
+		raw:         config.Raw,
+		peekTimeout: config.PeekTimeout,
+		httpServer:  &http.Server{Handler: config.HTTP, ReadHeaderTimeout: 10 * time.Second},
+		conns:       newConnListener(),
+	}
+
+	// Set defaults
+	if h.peekTimeout == 0 {
+		h.peekTimeout = time.Second
+	}
+	if h.raw == nil {
+		h.raw = server.NewEchoHandler()
+	}
+
+	return h
+}
+
+// ServeConn peeks at the connection and serves it with the matching handler
+func (h *Handler) ServeConn(ctx context.Context, conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	isHTTP, err := h.sniff(conn, r)
+	if err != nil {
+		return err
+	}
+
+	peeked := &peekedConn{Conn: conn, r: r, closed: make(chan struct{})}
+	if !isHTTP {
+		return h.raw.ServeConn(ctx, peeked)
+	}
+
+	// The HTTP server owns the connection from here and closes it when the
+	// client is done; wait so the server keeps counting it as open
+	h.once.Do(func() {
+		go h.httpServer.Serve(h.conns)
+	})
+	if err := h.conns.push(peeked); err != nil {
+		return err
+	}
+	<-peeked.closed
+	return nil
+}
+
+// Close stops the internal HTTP server
+func (h *Handler) Close() error {
+	h.conns.Close()
+	return h.httpServer.Close()
+}
+
+// sniff reports whether the connection starts with an HTTP request line. It
+// reads only as many bytes as it takes to rule every method in or out, and
+// then the rest of the line.
+func (h *Handler) sniff(conn net.Conn, r *bufio.Reader) (bool, error) {
+	var (
+		mu      sync.Mutex
+		done    bool
+		expired bool
+		timer   *time.Timer
+	)
+	mu.Lock()
+	timer = time.AfterFunc(h.peekTimeout, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if !done {
+			expired = true
+			conn.SetReadDeadline(time.Now())
+
+			// A read that was just starting re-arms the server's idle
+			// deadline over ours, so keep waking it until sniff returns
+			timer.Reset(rewakeInterval)
+		}
+	})
+	mu.Unlock()
+	defer func() {
+		timer.Stop()
+		mu.Lock()
+		defer mu.Unlock()
+		done = true
+		if expired {
+			// Clear our deadline; the server re-arms its idle timeout on the next read
+			conn.SetReadDeadline(time.Time{})
+		}
+	}()
+
+	peek := peekReader{Reader: r, expired: func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return expired
+	}}
+	isHTTP, err := hasMethod(peek)
+	if err == nil && isHTTP {
+		isHTTP, err = hasVersion(peek)
+	}
+	if err != nil {
+		mu.Lock()
+		timedOut := expired
+		mu.Unlock()
+
+		// A client that went quiet gets the raw handler, which may greet it
+		if timedOut {
+			return false, nil
+		}
+		return false, err
+	}
+	return isHTTP, nil
+}
+
+// peekReader stops reading from the connection once the sniff timeout has
+// expired. The server re-arms the read deadline on every read, so the timer's
+// wake-up alone would only interrupt the read in progress.
+type peekReader struct {
+	*bufio.Reader
+	expired func() bool
+}
+
+// Peek returns the next n bytes, failing without a read once the timeout has
+// expired and fewer than n bytes are buffered
+func (r peekReader) Peek(n int) ([]byte, error) {
+	if n > r.Buffered() && r.expired() {
+		return nil, os.ErrDeadlineExceeded
+	}
+	return r.Reader.Peek(n)
+}
+
+// hasMethod reports whether r starts with one of httpMethods
+func hasMethod(r peekReader) (bool, error) {
+	for n := 1; ; n++ {
+		prefix, err := r.Peek(n)
+		if err != nil {
+			return false, err
+		}
+
+		candidates := 0
+		for _, method := range httpMethods {
+			if len(method) < n {
+				continue
+			}
+			if method[:n] == string(prefix) {
+				if n == len(method) {
+					return true, nil
+				}
+				candidates++
+			}
+		}
+		if candidates == 0 {
+			return false, nil
+		}
+	}
+}
+
+// hasVersion reports whether the first line in r ends with an HTTP/1.x
+// version. Line protocols such as RESP's inline commands have a GET too, so
+// the method alone doesn't make a connection HTTP. Lines that don't fit in
+// r's buffer, or that the client ends the connection in, aren't HTTP either.
+func hasVersion(r peekReader) (bool, error) {
+	for {
+		buffered, _ := r.Peek(r.Buffered())
+		if i := bytes.IndexByte(buffered, '\n'); i >= 0 {
+			line := bytes.TrimSuffix(buffered[:i], []byte("\r"))
+			space := bytes.LastIndexByte(line, ' ')
+			return space >= 0 && bytes.HasPrefix(line[space:], []byte(" HTTP/1.")), nil
+		}
+		if len(buffered) == r.Size() {
+			return false, nil
+		}
+
+		// Wait for more of the line
+		if _, err := r.Peek(len(buffered) + 1); err != nil {
+			if err == io.EOF {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+}
+
+// peekedConn replays the sniffed bytes before reading from the connection
+// and signals when it is closed
+type peekedConn struct {
+	net.Conn
+	r      *bufio.Reader
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *peekedConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// CloseWrite half-closes the underlying connection if it supports it
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// connListener feeds already accepted connections to an http.Server
+type connListener struct {
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newConnListener() *connListener {
+	return &connListener{
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+}
+
+// push hands conn to the HTTP server
+func (l *connListener) push(conn net.Conn) error {
+	select {
+	case l.conns <- conn:
+		return nil
+	case <-l.done:
+		conn.Close()
+		return net.ErrClosed
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+// Addr returns a placeholder; connections come from many listeners
+func (l *connListener) Addr() net.Addr {
+	return sniffAddr{}
+}
+
+type sniffAddr struct{}
+
+func (sniffAddr) Network() string { return "sniff" }
+func (sniffAddr) String() string  { return "sniff" }
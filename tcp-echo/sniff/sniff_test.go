@@ -0,0 +1,173 @@
+package sniff
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"tcp-echo/server"
+)
+
+// startServer serves a sniffing handler on a random local port
+func startServer(t *testing.T, config Config) (*server.Server, string) {
+	t.Helper()
+
+	if config.HTTP == nil {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok\n"))
+		})
+		config.HTTP = mux
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+
+	h := NewHandler(config)
+	srv := server.NewServer(server.Config{Handler: h, IdleTimeout: time.Minute})
+	go srv.Serve(listener)
+	t.Cleanup(func() {
+		srv.Close()
+		h.Close()
+	})
+
+	return srv, listener.Addr().String()
+}
+
+func TestHandler_RawEcho(t *testing.T) {
+	_, addr := startServer(t, Config{})
+
+	// "HELLO" shares a prefix with "HEAD " but is not HTTP, and inline RESP
+	// commands start with a method but have no HTTP version
+	for _, line := range []string{"hi", "HELLO", "GET", "GET key", "DELETE /x HTTP/2"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		conn.Write([]byte(line + "\n"))
+
+		reply, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || reply != "Echo: "+line+"\n" {
+			t.Errorf("Expected echo of %q, got %q (%v)", line, reply, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestHandler_HTTP(t *testing.T) {
+	srv, addr := startServer(t, Config{})
+
+	resp, err := http.Get("http://" + addr + "/health")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "ok\n" {
+		t.Errorf("Expected 200 ok, got %d %q", resp.StatusCode, body)
+	}
+
+	// The HTTP connection counts as an open connection until it closes
+	if srv.Stats().Active != 1 {
+		t.Errorf("Expected the keep-alive connection to be tracked, got %d active", srv.Stats().Active)
+	}
+	http.DefaultClient.CloseIdleConnections()
+}
+
+func TestHandler_SilentClientGetsRawHandler(t *testing.T) {
+	greeting := server.HandlerFunc(func(ctx context.Context, conn net.Conn) error {
+		_, err := conn.Write([]byte("welcome\n"))
+		return err
+	})
+	_, addr := startServer(t, Config{Raw: greeting, PeekTimeout: 50 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "welcome\n" {
+		t.Errorf("Expected the greeting, got %q (%v)", line, err)
+	}
+}
+
+// rearmingConn ignores read deadlines, as if every read re-armed the server's
+// idle timeout over the one the peek timer set
+type rearmingConn struct {
+	net.Conn
+}
+
+func (rearmingConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func TestHandler_TricklingClientGetsRawHandlerAfterTimeout(t *testing.T) {
+	raw := make(chan struct{})
+	h := NewHandler(Config{
+		Raw: server.HandlerFunc(func(ctx context.Context, conn net.Conn) error {
+			close(raw)
+			return nil
+		}),
+		PeekTimeout: 50 * time.Millisecond,
+	})
+	defer h.Close()
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	go h.ServeConn(context.Background(), rearmingConn{conn})
+
+	// A request line sent a byte at a time, slower than the peek timeout
+	start := time.Now()
+	go func() {
+		for _, b := range []byte("GET /" + strings.Repeat("x", 100)) {
+			if _, err := client.Write([]byte{b}); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	select {
+	case <-raw:
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Errorf("Expected the raw handler soon after the peek timeout, took %s", elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Trickling client was never handed to the raw handler")
+	}
+}
+
+func TestHandler_ShutdownClosesHTTPConnections(t *testing.T) {
+	srv, addr := startServer(t, Config{})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /health HTTP/1.1\r\nHost: test\r\n\r\n"))
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("ReadResponse failed: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+
+	// The connection is idle in keep-alive; draining must not wait for it
+	summary := srv.Shutdown()
+	if summary.Killed != 0 {
+		t.Errorf("Expected the idle HTTP connection to drain, got %+v", summary)
+	}
+}
@@ -0,0 +1,200 @@
+// Package upgrade restarts a server without refusing connections. The
+// running process starts a new copy of its binary and passes it the listening
+// sockets; once the new process reports that it is serving, the old one stops
+// accepting and drains its open connections.
+package upgrade
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables describing what the parent passed down
+const (
+	envNames = "TCP_ECHO_UPGRADE_NAMES" // Comma-separated socket names, fds 3, 4, ... in order
+	envReady = "TCP_ECHO_UPGRADE_READY" // Fd of the pipe to report readiness on
+)
+
+// ErrChildExited is returned by Start when the new process exits before it is ready
+var ErrChildExited = errors.New("new process exited before it was ready")
+
+// Inherited holds the sockets passed down by a parent process
+type Inherited struct {
+	files map[string]*os.File
+	ready *os.File
+}
+
+// Inherit reads the sockets passed by a parent process. Without a parent it
+// returns an empty set, so callers can use it unconditionally.
+func Inherit() (*Inherited, error) {
+	inherited := &Inherited{files: make(map[string]*os.File)}
+
+	names := os.Getenv(envNames)
+	readyFD := os.Getenv(envReady)
+
+	// Our own children must not see these
+	os.Unsetenv(envNames)
+	os.Unsetenv(envReady)
+
+	if readyFD == "" {
+		return inherited, nil
+	}
+
+	fd, err := strconv.Atoi(readyFD)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q", envReady, readyFD)
+	}
+	inherited.ready = os.NewFile(uintptr(fd), "upgrade-ready")
+
+	if names != "" {
+		for i, name := range strings.Split(names, ",") {
+			inherited.files[name] = os.NewFile(uintptr(3+i), name)
+		}
+	}
+	return inherited, nil
+}
+
+// HasParent reports whether this process was started by Start
+func (i *Inherited) HasParent() bool {
+	return i.ready != nil
+}
+
+// Listener returns the inherited stream socket called name, or nil if the
+// parent didn't pass one
+func (i *Inherited) Listener(name string) (net.Listener, error) {
+	file, ok := i.files[name]
+	if !ok {
+		return nil, nil
+	}
+	defer file.Close()
+	delete(i.files, name)
+
+	return net.FileListener(file)
+}
+
+// PacketConn returns the inherited datagram socket called name, or nil if the
+// parent didn't pass one
+func (i *Inherited) PacketConn(name string) (net.PacketConn, error) {
+	file, ok := i.files[name]
+	if !ok {
+		return nil, nil
+	}
+	defer file.Close()
+	delete(i.files, name)
+
+	return net.FilePacketConn(file)
+}
+
+// Ready tells the parent that this process is serving, so the parent can
+// start draining. It is a no-op without a parent.
+func (i *Inherited) Ready() error {
+	if i.ready == nil {
+		return nil
+	}
+
+	// Sockets we were given but didn't use are no longer needed
+	for name, file := range i.files {
+		file.Close()
+		delete(i.files, name)
+	}
+
+	_, err := i.ready.Write([]byte{1})
+	i.ready.Close()
+	i.ready = nil
+	return err
+}
+
+// Config holds configuration for Start
+type Config struct {
+	Path         string        // Binary to run, defaults to the current executable
+	Args         []string      // Arguments, defaults to the current ones
+	Env          []string      // Extra environment variables
+	ReadyTimeout time.Duration // How long the new process has to call Ready, defaults to 30s
+}
+
+// Start runs a new process with the given sockets and waits until it calls
+// Ready. The caller keeps ownership of files and should close them after.
+func Start(files map[string]*os.File, config Config) (*os.Process, error) {
+	// Set defaults
+	if config.Path == "" {
+		path, err := os.Executable()
+		if err != nil {
+			return nil, err
+		}
+		config.Path = path
+	}
+	if config.Args == nil {
+		config.Args = os.Args[1:]
+	}
+	if config.ReadyTimeout == 0 {
+		config.ReadyTimeout = 30 * time.Second
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+
+	names := make([]string, 0, len(files))
+	extraFiles := make([]*os.File, 0, len(files)+1)
+	for name, file := range files {
+		if strings.Contains(name, ",") {
+			readyW.Close()
+			return nil, fmt.Errorf("socket name %q must not contain a comma", name)
+		}
+		names = append(names, name)
+		extraFiles = append(extraFiles, file)
+	}
+	extraFiles = append(extraFiles, readyW)
+
+	cmd := exec.Command(config.Path, config.Args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = extraFiles
+	cmd.Env = append(os.Environ(), config.Env...)
+	cmd.Env = append(cmd.Env,
+		envNames+"="+strings.Join(names, ","),
+		envReady+"="+strconv.Itoa(3+len(names)),
+	)
+
+	err = cmd.Start()
+	// Only the child holds the write end now, so a crash shows up as EOF
+	readyW.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	ready := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 1)
+		if _, err := readyR.Read(buf); err != nil {
+			ready <- ErrChildExited
+			return
+		}
+		ready <- nil
+	}()
+
+	select {
+	case err := <-ready:
+		if err != nil {
+			cmd.Wait()
+			return nil, err
+		}
+	case <-time.After(config.ReadyTimeout):
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("new process not ready after %s", config.ReadyTimeout)
+	}
+
+	// Avoid a zombie if the new process exits while we are still draining
+	go cmd.Wait()
+	return cmd.Process, nil
+}
@@ -0,0 +1,114 @@
+package upgrade
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestHelperChild is the "new process" started by the tests below. It serves
+// one echo on the inherited listener and exits.
+func TestHelperChild(t *testing.T) {
+	if os.Getenv("UPGRADE_HELPER") == "" {
+		t.Skip("only runs as a child process")
+	}
+
+	inherited, err := Inherit()
+	if err != nil || !inherited.HasParent() {
+		os.Exit(2)
+	}
+	if os.Getenv("UPGRADE_HELPER") == "crash" {
+		os.Exit(3)
+	}
+
+	listener, err := inherited.Listener("tcp")
+	if err != nil || listener == nil {
+		os.Exit(4)
+	}
+	inherited.Ready()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		os.Exit(5)
+	}
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	conn.Write([]byte("child: " + line))
+	conn.Close()
+	os.Exit(0)
+}
+
+func startChild(t *testing.T, listener net.Listener, mode string) (*os.Process, error) {
+	t.Helper()
+
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("File failed: %v", err)
+	}
+	defer file.Close()
+
+	return Start(map[string]*os.File{"tcp": file}, Config{
+		Args:         []string{"-test.run=^TestHelperChild$"},
+		Env:          []string{"UPGRADE_HELPER=" + mode},
+		ReadyTimeout: 10 * time.Second,
+	})
+}
+
+func TestStart_HandsOffListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	addr := listener.Addr().String()
+
+	process, err := startChild(t, listener, "serve")
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	defer process.Kill()
+
+	// The old process stops accepting; the socket stays open in the child
+	listener.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Connection refused after handoff: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("hello\n"))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "child: hello\n" {
+		t.Errorf("Expected the child to answer, got %q (%v)", line, err)
+	}
+}
+
+func TestStart_ChildCrashes(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+
+	if _, err := startChild(t, listener, "crash"); err != ErrChildExited {
+		t.Errorf("Expected ErrChildExited, got %v", err)
+	}
+}
+
+func TestInherit_WithoutParent(t *testing.T) {
+	inherited, err := Inherit()
+	if err != nil {
+		t.Fatalf("Inherit failed: %v", err)
+	}
+	if inherited.HasParent() {
+		t.Error("Expected no parent")
+	}
+	if listener, err := inherited.Listener("tcp"); listener != nil || err != nil {
+		t.Errorf("Expected no inherited listener, got %v (%v)", listener, err)
+	}
+	if err := inherited.Ready(); err != nil {
+		t.Errorf("Ready without a parent should be a no-op, got %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+// Package websocket implements just enough of RFC 6455 to echo messages back
+// to browsers and WebSocket clients without third-party dependencies.
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"tcp-echo/framing"
+)
+
+// acceptGUID is appended to the client's key to compute Sec-WebSocket-Accept
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Opcodes
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// Close status codes
+const (
+	closeNormal       = 1000
+	closeProtocol     = 1002
+	closeTooLarge     = 1009
+	maxControlPayload = 125
+)
+
+var (
+	errProtocol = errors.New("websocket protocol error")
+	errTooLarge = errors.New("websocket message too large")
+)
+
+// EchoHandler upgrades HTTP requests to WebSocket and echoes every message
+type EchoHandler struct {
+	MaxMessageSize int // Defaults to framing.DefaultMaxFrameSize
+}
+
+// ServeHTTP performs the opening handshake and echoes until the client closes
+func (h *EchoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusBadRequest)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported by this server", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	// The HTTP server's deadlines no longer apply after hijacking
+	conn.SetDeadline(time.Time{})
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", AcceptKey(key))
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	maxSize := h.MaxMessageSize
+	if maxSize <= 0 {
+		maxSize = framing.DefaultMaxFrameSize
+	}
+	echo(conn, rw.Reader, maxSize)
+}
+
+// AcceptKey computes the Sec-WebSocket-Accept value for a client key
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// echo reads messages and writes them back with the same opcode
+func echo(conn net.Conn, r *bufio.Reader, maxSize int) {
+	for {
+		opcode, message, err := readMessage(conn, r, maxSize)
+		switch {
+		case errors.Is(err, errTooLarge):
+			writeClose(conn, closeTooLarge)
+			return
+		case errors.Is(err, errProtocol):
+			writeClose(conn, closeProtocol)
+			return
+		case err != nil:
+			return
+		}
+
+		if opcode == opClose {
+			writeClose(conn, closeNormal)
+			return
+		}
+		if err := writeFrame(conn, opcode, message); err != nil {
+			return
+		}
+	}
+}
+
+// readMessage reads frames until a complete data message or a close frame,
+// answering pings along the way
+func readMessage(conn net.Conn, r *bufio.Reader, maxSize int) (byte, []byte, error) {
+	var (
+		opcode  byte
+		message []byte
+	)
+	for {
+		fin, op, payload, err := readFrame(r, maxSize)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case opPing:
+			if err := writeFrame(conn, opPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return opClose, nil, nil
+		case opText, opBinary:
+			if opcode != 0 {
+				return 0, nil, errProtocol
+			}
+			opcode = op
+		case opContinuation:
+			if opcode == 0 {
+				return 0, nil, errProtocol
+			}
+		default:
+			return 0, nil, errProtocol
+		}
+
+		if len(message)+len(payload) > maxSize {
+			return 0, nil, errTooLarge
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// readFrame reads one client frame and unmasks its payload
+func readFrame(r *bufio.Reader, maxSize int) (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, errProtocol // No extensions negotiated
+	}
+
+	// Clients must mask every frame
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, errProtocol
+	}
+
+	size := uint64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if opcode >= opClose && (size > maxControlPayload || !fin) {
+		return false, 0, nil, errProtocol
+	}
+	if size > uint64(maxSize) {
+		return false, 0, nil, errTooLarge
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload = make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame writes a single unmasked server frame
+func writeFrame(w io.Writer, opcode byte, payload []byte) error {
+	header := make([]byte, 2, 10+len(payload))
+	header[0] = 0x80 | opcode
+
+	switch size := len(payload); {
+	case size <= 125:
+		header[1] = byte(size)
+	case size <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(size))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(size))
+	}
+
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// writeClose sends a close frame with a status code
+func writeClose(w io.Writer, code uint16) error {
+	return writeFrame(w, opClose, binary.BigEndian.AppendUint16(nil, code))
+}
+
+// headerContains reports whether a comma-separated header contains token
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// Example from RFC 6455 section 1.3
+	if got := AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Unexpected accept key %q", got)
+	}
+}
+
+// dial performs the opening handshake against a test server
+func dial(t *testing.T, h http.Handler) (net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	conn.Write([]byte("GET /ws HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Unexpected handshake response: %d %v", resp.StatusCode, resp.Header)
+	}
+	return conn, r
+}
+
+// clientFrame builds a masked frame as a browser would send it
+func clientFrame(fin bool, opcode byte, payload []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+
+	frame := []byte{first}
+	switch {
+	case len(payload) <= 125:
+		frame = append(frame, 0x80|byte(len(payload)))
+	default:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	}
+
+	mask := []byte{1, 2, 3, 4}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// readServerFrame reads one unmasked frame
+func readServerFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	t.Helper()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+
+	size := int(header[1] & 0x7f)
+	if size == 126 {
+		ext := make([]byte, 2)
+		io.ReadFull(r, ext)
+		size = int(binary.BigEndian.Uint16(ext))
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+func TestEchoHandler_Messages(t *testing.T) {
+	conn, r := dial(t, &EchoHandler{})
+
+	conn.Write(clientFrame(true, opText, []byte("hello")))
+	if op, payload := readServerFrame(t, r); op != opText || string(payload) != "hello" {
+		t.Errorf("Expected text echo, got op %d %q", op, payload)
+	}
+
+	// Fragmented binary message with a ping in the middle
+	big := bytes.Repeat([]byte{0xab}, 300)
+	conn.Write(clientFrame(false, opBinary, big[:100]))
+	conn.Write(clientFrame(true, opPing, []byte("p")))
+	conn.Write(clientFrame(true, opContinuation, big[100:]))
+
+	if op, payload := readServerFrame(t, r); op != opPong || string(payload) != "p" {
+		t.Errorf("Expected pong, got op %d %q", op, payload)
+	}
+	if op, payload := readServerFrame(t, r); op != opBinary || !bytes.Equal(payload, big) {
+		t.Errorf("Expected reassembled binary echo, got op %d with %d bytes", op, len(payload))
+	}
+
+	conn.Write(clientFrame(true, opClose, []byte{0x03, 0xe8}))
+	if op, payload := readServerFrame(t, r); op != opClose || binary.BigEndian.Uint16(payload) != closeNormal {
+		t.Errorf("Expected close 1000, got op %d %v", op, payload)
+	}
+}
+
+func TestEchoHandler_RejectsLargeMessages(t *testing.T) {
+	conn, r := dial(t, &EchoHandler{MaxMessageSize: 10})
+
+	conn.Write(clientFrame(true, opText, []byte("this is far too long")))
+	if op, payload := readServerFrame(t, r); op != opClose || binary.BigEndian.Uint16(payload) != closeTooLarge {
+		t.Errorf("Expected close 1009, got op %d %v", op, payload)
+	}
+}
+
+func TestEchoHandler_RequiresUpgrade(t *testing.T) {
+	srv := httptest.NewServer(&EchoHandler{})
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Errorf("Expected 426, got %d", resp.StatusCode)
+	}
+}